@@ -8,15 +8,29 @@ import (
 	"syscall"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 
 	"github.com/andreyAKor/nut_client_service/internal/app"
+	"github.com/andreyAKor/nut_client_service/internal/audit"
 	"github.com/andreyAKor/nut_client_service/internal/configs"
+	"github.com/andreyAKor/nut_client_service/internal/events"
+	"github.com/andreyAKor/nut_client_service/internal/events/webhook"
+	"github.com/andreyAKor/nut_client_service/internal/history"
 	clientsNut "github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
 	"github.com/andreyAKor/nut_client_service/internal/http/server"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/auth"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	handlerProbe "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/probe"
 	"github.com/andreyAKor/nut_client_service/internal/logging"
 	metricsNut "github.com/andreyAKor/nut_client_service/internal/metrics/nut"
+	"github.com/andreyAKor/nut_client_service/internal/outages"
+	"github.com/andreyAKor/nut_client_service/internal/outputs/influxdb"
+	"github.com/andreyAKor/nut_client_service/internal/outputs/mqtt"
+	"github.com/andreyAKor/nut_client_service/internal/outputs/push"
+	"github.com/andreyAKor/nut_client_service/internal/shutdown"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
 )
 
 var cfgFile string
@@ -66,27 +80,246 @@ func run(cmd *cobra.Command, args []string) error {
 	}
 
 	// Init clients
-	nutClient, err := clientsNut.New(
-		cfg.Clients.NUT.Host,
-		cfg.Clients.NUT.Port,
-		cfg.Clients.NUT.Username,
-		cfg.Clients.NUT.Password,
+	upstreams, metricsUpstreams, err := initUpstreams(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize NUT clients")
+	}
+
+	// Init UPS snapshot store shared by the metrics poller and the http-server
+	store := snapshot.New()
+
+	// Init webhooks notified of power events
+	hooks := make([]webhook.Hook, 0, len(cfg.Events.Webhooks.Hooks))
+	for _, h := range cfg.Events.Webhooks.Hooks {
+		hooks = append(hooks, webhook.Hook{
+			Name:    h.Name,
+			URL:     h.URL,
+			Method:  h.Method,
+			Headers: h.Headers,
+			Body:    h.Body,
+			Secret:  h.Secret,
+			Events:  h.Events,
+		})
+	}
+
+	webhooks, err := webhook.New(
+		hooks,
+		cfg.Events.Webhooks.QueueFile,
+		cfg.Events.Webhooks.MaxAttempts,
+		cfg.Events.Webhooks.InitialBackoff,
+		cfg.Events.Webhooks.MaxBackoff,
+		cfg.Events.Webhooks.Timeout,
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize webhooks")
+	}
+
+	// Init shutdown of the local host
+	stages := make([]shutdown.Stage, 0, len(cfg.Shutdown.Stages))
+	for _, st := range cfg.Shutdown.Stages {
+		stage := shutdown.Stage{Name: st.Name}
+		for _, c := range st.Commands {
+			stage.Commands = append(stage.Commands, shutdown.Command{Command: c.Command, Timeout: c.Timeout})
+		}
+
+		stages = append(stages, stage)
+	}
+
+	orchestrator, err := shutdown.New(
+		cfg.Shutdown.Enabled,
+		cfg.Shutdown.DryRun,
+		cfg.Shutdown.UPS,
+		cfg.Shutdown.OnBatteryFor,
+		cfg.Shutdown.MinRuntime,
+		cfg.Shutdown.OnLowBattery,
+		cfg.Shutdown.OnFSD,
+		cfg.Shutdown.ForceShutdown,
+		stages,
+		store,
+		upstreams,
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize shutdown")
+	}
+
+	// Init journal of power outages
+	outageJournal, err := outages.New(cfg.Outages.File, cfg.Outages.MaxAge, cfg.Outages.MaxRecords, store)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize outage journal")
+	}
+
+	// Init power events engine
+	eventsEngine, err := events.New(
+		store,
+		[]events.Sink{webhooks, orchestrator, outageJournal},
+		cfg.Events.Debounce,
+		cfg.Events.CommBadAfter,
+		cfg.Events.NoCommAfter,
+		cfg.Events.LowBatteryCharge,
+		cfg.Events.Hysteresis,
+		cfg.Events.Recent,
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize events engine")
+	}
+
+	// Init modules for probing NUT servers
+	probeModules := make(map[string]handlerProbe.Module, len(cfg.Probe.Modules))
+	for name, m := range cfg.Probe.Modules {
+		probeModules[name] = handlerProbe.Module{
+			Username:  m.Username,
+			Password:  m.Password,
+			InfoAllow: m.Info.Allow,
+			InfoDeny:  m.Info.Deny,
+			TLS:       clientsNut.TLS(m.TLS),
+			Targets:   m.Targets,
+		}
+	}
+
+	// Init authentication of the API
+	users := make([]auth.User, 0, len(cfg.HTTP.Auth.Users))
+	for _, u := range cfg.HTTP.Auth.Users {
+		users = append(users, auth.User{
+			Name:        u.Name,
+			Token:       u.Token,
+			Subject:     u.Subject,
+			Permissions: u.Permissions,
+			Commands:    u.Commands,
+		})
+	}
+
+	authenticator, err := auth.New(cfg.HTTP.Auth.Enabled, cfg.HTTP.Auth.AnonymousMetrics, users, cfg.HTTP.Auth.UsersFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize authentication")
+	}
+
+	auditLog, err := audit.New(cfg.Audit.File, cfg.Audit.MaxSize, cfg.Audit.MaxBackups, cfg.Audit.HashChain)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize audit log")
+	}
+
+	dangerGuard, err := guard.New(cfg.HTTP.Dangerous.Commands, cfg.HTTP.Dangerous.ConfirmationTTL, auditLog)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize dangerous commands guard")
+	}
+
+	// Init MQTT publisher
+	mqttPublisher, err := mqtt.New(
+		cfg.Outputs.MQTT.Enabled,
+		cfg.Outputs.MQTT.Host,
+		cfg.Outputs.MQTT.Port,
+		cfg.Outputs.MQTT.ClientID,
+		cfg.Outputs.MQTT.Username,
+		cfg.Outputs.MQTT.Password,
+		cfg.Outputs.MQTT.QoS,
+		cfg.Outputs.MQTT.KeepAlive,
+		cfg.Outputs.MQTT.Timeout,
+		cfg.Outputs.MQTT.ReconnectInterval,
+		cfg.Outputs.MQTT.TopicPrefix,
+		cfg.Outputs.MQTT.Discovery.Enabled,
+		cfg.Outputs.MQTT.Discovery.Prefix,
+		cfg.Outputs.MQTT.Commands,
+		mqtt.TLS(cfg.Outputs.MQTT.TLS),
+		store,
+		upstreams,
+		auditLog,
+		dangerGuard,
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize MQTT publisher")
+	}
+
+	// Init InfluxDB writer
+	influxWriter, err := influxdb.New(
+		cfg.Outputs.InfluxDB.Enabled,
+		cfg.Outputs.InfluxDB.Version,
+		cfg.Outputs.InfluxDB.URL,
+		cfg.Outputs.InfluxDB.Org,
+		cfg.Outputs.InfluxDB.Bucket,
+		cfg.Outputs.InfluxDB.Token,
+		cfg.Outputs.InfluxDB.Database,
+		cfg.Outputs.InfluxDB.RetentionPolicy,
+		cfg.Outputs.InfluxDB.Username,
+		cfg.Outputs.InfluxDB.Password,
+		cfg.Outputs.InfluxDB.Measurement,
+		cfg.Outputs.InfluxDB.BatchSize,
+		cfg.Outputs.InfluxDB.BufferSize,
+		cfg.Outputs.InfluxDB.FlushInterval,
+		cfg.Outputs.InfluxDB.Timeout,
+		cfg.Outputs.InfluxDB.Gzip,
+		store,
 	)
 	if err != nil {
-		log.Fatal().Err(err).Msg("can't initialize NUT client")
+		log.Fatal().Err(err).Msg("can't initialize InfluxDB writer")
+	}
+
+	// Init Graphite and StatsD outputs
+	targets := make([]push.Target, 0, len(cfg.Outputs.Push.Targets))
+	for _, t := range cfg.Outputs.Push.Targets {
+		targets = append(targets, push.Target(t))
+	}
+
+	pusher, err := push.New(targets, cfg.Outputs.Push.Timeout, store)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize push outputs")
+	}
+
+	// Init history
+	tiers := make([]history.Tier, 0, len(cfg.History.Tiers))
+	for _, t := range cfg.History.Tiers {
+		tiers = append(tiers, history.Tier(t))
+	}
+
+	historyStore, err := history.New(cfg.History.Enabled, cfg.History.Dir, cfg.History.MaxSize, tiers, store)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize history")
 	}
 
 	// Init http-server
-	srv, err := server.New(cfg.HTTP.Host, cfg.HTTP.Port, cfg.HTTP.BodyLimit, nutClient)
+	srv, err := server.New(
+		cfg.HTTP.Host,
+		cfg.HTTP.Port,
+		cfg.HTTP.BodyLimit,
+		upstreams,
+		store,
+		eventsEngine,
+		probeModules,
+		authenticator,
+		dangerGuard,
+		auditLog,
+		historyStore,
+		outageJournal,
+		server.TLS{
+			CertFile:          cfg.HTTP.TLS.CertFile,
+			KeyFile:           cfg.HTTP.TLS.KeyFile,
+			ClientCAFile:      cfg.HTTP.TLS.ClientCAFile,
+			RequireClientCert: cfg.HTTP.TLS.RequireClientCert,
+			ReloadInterval:    cfg.HTTP.TLS.ReloadInterval,
+		},
+		cfg.HTTP.Metrics.Host,
+		cfg.HTTP.Metrics.Port,
+	)
 	if err != nil {
 		log.Fatal().Err(err).Msg("can't initialize http-server")
 	}
 
 	// Init metrics
-	nutMetrics, err := metricsNut.New(cfg.Metrics.NUT.Interval, nutClient)
+	nutMetrics, err := metricsNut.New(
+		cfg.Metrics.NUT.Mode,
+		cfg.Metrics.NUT.Info.Allow,
+		cfg.Metrics.NUT.Info.Deny,
+		metricsUpstreams,
+		store,
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't initialize NUT metrics")
+	}
+	if err := prometheus.Register(nutMetrics); err != nil {
+		log.Fatal().Err(err).Msg("can't register NUT metrics")
+	}
 
 	// Init and run app
-	a, err := app.New(srv, nutMetrics)
+	a, err := app.New(srv, nutMetrics, eventsEngine, webhooks, orchestrator, mqttPublisher, influxWriter, pusher, historyStore, outageJournal)
 	if err != nil {
 		log.Fatal().Err(err).Msg("can't initialize app")
 	}
@@ -109,6 +342,30 @@ func run(cmd *cobra.Command, args []string) error {
 	if err := a.Close(); err != nil {
 		log.Fatal().Err(err).Msg("app closing fail")
 	}
+	if err := mqttPublisher.Close(); err != nil {
+		log.Fatal().Err(err).Msg("MQTT publisher closing fail")
+	}
+	if err := influxWriter.Close(); err != nil {
+		log.Fatal().Err(err).Msg("InfluxDB writer closing fail")
+	}
+	if err := pusher.Close(); err != nil {
+		log.Fatal().Err(err).Msg("push outputs closing fail")
+	}
+	if err := historyStore.Close(); err != nil {
+		log.Fatal().Err(err).Msg("history closing fail")
+	}
+	if err := outageJournal.Close(); err != nil {
+		log.Fatal().Err(err).Msg("outage journal closing fail")
+	}
+	if err := upstreams.Close(); err != nil {
+		log.Fatal().Err(err).Msg("NUT clients closing fail")
+	}
+	if err := webhooks.Close(); err != nil {
+		log.Fatal().Err(err).Msg("webhooks closing fail")
+	}
+	if err := auditLog.Close(); err != nil {
+		log.Fatal().Err(err).Msg("audit log closing fail")
+	}
 
 	log.Info().Msg("Stopped")
 
@@ -119,3 +376,61 @@ func run(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// initUpstreams Initializes NUT clients of configured upstreams, the single NUT server
+// is the upstream named "default" if upstreams are absent.
+func initUpstreams(cfg *configs.Config) (*clientsNut.Upstreams, []metricsNut.Upstream, error) {
+	type upstream struct {
+		name, host         string
+		port               int
+		username, password string
+		interval           string
+	}
+
+	var list []upstream
+
+	for _, u := range cfg.Clients.NUT.Upstreams {
+		list = append(list, upstream{u.Name, u.Host, u.Port, u.Username, u.Password, u.Interval})
+	}
+	if len(list) == 0 {
+		n := cfg.Clients.NUT
+		list = append(list, upstream{"default", n.Host, n.Port, n.Username, n.Password, ""})
+	}
+
+	upstreams := clientsNut.NewUpstreams()
+	metricsUpstreams := make([]metricsNut.Upstream, 0, len(list))
+
+	for _, u := range list {
+		nutClient, err := clientsNut.New(
+			u.host,
+			u.port,
+			u.username,
+			u.password,
+			cfg.Clients.NUT.PoolSize,
+			cfg.Clients.NUT.IdleTimeout,
+			cfg.Clients.NUT.HealthCheckInterval,
+			cfg.Clients.NUT.MetadataRefreshInterval,
+			clientsNut.TLS(cfg.Clients.NUT.TLS),
+		)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "init NUT client of upstream %q fail", u.name)
+		}
+
+		if err := upstreams.Add(u.name, nutClient); err != nil {
+			return nil, nil, errors.Wrap(err, "add upstream fail")
+		}
+
+		interval := u.interval
+		if interval == "" {
+			interval = cfg.Metrics.NUT.Interval
+		}
+
+		metricsUpstreams = append(metricsUpstreams, metricsNut.Upstream{
+			Name:     u.name,
+			Interval: interval,
+			Client:   nutClient,
+		})
+	}
+
+	return upstreams, metricsUpstreams, nil
+}
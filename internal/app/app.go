@@ -6,8 +6,16 @@ import (
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/andreyAKor/nut_client_service/internal/events"
+	"github.com/andreyAKor/nut_client_service/internal/events/webhook"
+	"github.com/andreyAKor/nut_client_service/internal/history"
 	"github.com/andreyAKor/nut_client_service/internal/http/server"
 	metricsNut "github.com/andreyAKor/nut_client_service/internal/metrics/nut"
+	"github.com/andreyAKor/nut_client_service/internal/outages"
+	"github.com/andreyAKor/nut_client_service/internal/outputs/influxdb"
+	"github.com/andreyAKor/nut_client_service/internal/outputs/mqtt"
+	"github.com/andreyAKor/nut_client_service/internal/outputs/push"
+	"github.com/andreyAKor/nut_client_service/internal/shutdown"
 )
 
 var _ io.Closer = (*App)(nil)
@@ -15,12 +23,39 @@ var _ io.Closer = (*App)(nil)
 type App struct {
 	srv        *server.Server
 	nutMetrics *metricsNut.Metric
+	events     *events.Engine
+	webhooks   *webhook.Notifier
+	shutdown   *shutdown.Orchestrator
+	mqtt       *mqtt.Publisher
+	influxdb   *influxdb.Writer
+	push       *push.Pusher
+	history    *history.Store
+	outages    *outages.Journal
 }
 
-func New(srv *server.Server, nutMetrics *metricsNut.Metric) (*App, error) {
+func New(
+	srv *server.Server,
+	nutMetrics *metricsNut.Metric,
+	eventsEngine *events.Engine,
+	webhooks *webhook.Notifier,
+	orchestrator *shutdown.Orchestrator,
+	mqttPublisher *mqtt.Publisher,
+	influxWriter *influxdb.Writer,
+	pusher *push.Pusher,
+	historyStore *history.Store,
+	outageJournal *outages.Journal,
+) (*App, error) {
 	return &App{
 		srv:        srv,
 		nutMetrics: nutMetrics,
+		events:     eventsEngine,
+		webhooks:   webhooks,
+		shutdown:   orchestrator,
+		mqtt:       mqttPublisher,
+		influxdb:   influxWriter,
+		push:       pusher,
+		history:    historyStore,
+		outages:    outageJournal,
 	}, nil
 }
 
@@ -36,6 +71,46 @@ func (a *App) Run(ctx context.Context) error {
 			log.Fatal().Err(err).Msg("nut metrics running fail")
 		}
 	}()
+	go func() {
+		if err := a.events.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("events engine running fail")
+		}
+	}()
+	go func() {
+		if err := a.webhooks.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("webhooks running fail")
+		}
+	}()
+	go func() {
+		if err := a.shutdown.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("shutdown running fail")
+		}
+	}()
+	go func() {
+		if err := a.mqtt.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("MQTT publisher running fail")
+		}
+	}()
+	go func() {
+		if err := a.influxdb.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("InfluxDB writer running fail")
+		}
+	}()
+	go func() {
+		if err := a.push.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("push outputs running fail")
+		}
+	}()
+	go func() {
+		if err := a.history.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("history running fail")
+		}
+	}()
+	go func() {
+		if err := a.outages.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("outage journal running fail")
+		}
+	}()
 
 	return nil
 }
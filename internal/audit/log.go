@@ -0,0 +1,419 @@
+// Package audit keeps the append-only trail of write operations.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Results of audited operations.
+const (
+	ResultConfirmationRequired = "confirmation_required"
+	ResultInvalidConfirmation  = "invalid_confirmation"
+	ResultDenied               = "denied"
+	ResultDone                 = "done"
+	ResultFailed               = "failed"
+)
+
+// defaultLimit is the number of records returned by Query if the limit isn't given.
+const defaultLimit = 100
+
+var (
+	ErrTampered          = errors.New("audit record is tampered")
+	ErrHashChainDisabled = errors.New("audit hash chaining is disabled")
+
+	_ io.Closer = (*Log)(nil)
+)
+
+// Record is the audited attempt of the operation.
+type Record struct {
+	Time time.Time `json:"time"`
+
+	// Authenticated user, it's empty if authentication is disabled
+	User string `json:"user,omitempty"`
+	IP   string `json:"ip,omitempty"`
+
+	// Operation, e.g. "command", "fsd", "variable"
+	Action   string `json:"action"`
+	Upstream string `json:"upstream"`
+	UPS      string `json:"ups"`
+
+	// Command or variable name
+	Target string `json:"target,omitempty"`
+
+	// Values of the variable before and after the write
+	OldValue string `json:"oldValue,omitempty"`
+	Value    string `json:"value,omitempty"`
+
+	Result string `json:"result"`
+
+	// Error of the operation, e.g. the upsd error
+	Error string `json:"error,omitempty"`
+
+	// SHA-256 of the record with the empty Hash, the chain links each record to the previous one
+	PrevHash string `json:"prevHash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Filter selects records, empty fields match any record.
+type Filter struct {
+	User     string
+	Upstream string
+	UPS      string
+	Action   string
+	Target   string
+	Result   string
+	From     time.Time
+	To       time.Time
+
+	// Maximum number of the latest records
+	Limit int
+}
+
+func (f Filter) match(r Record) bool {
+	switch {
+	case len(f.User) > 0 && f.User != r.User,
+		len(f.Upstream) > 0 && f.Upstream != r.Upstream,
+		len(f.UPS) > 0 && f.UPS != r.UPS,
+		len(f.Action) > 0 && f.Action != r.Action,
+		len(f.Target) > 0 && f.Target != r.Target,
+		len(f.Result) > 0 && f.Result != r.Result,
+		!f.From.IsZero() && r.Time.Before(f.From),
+		!f.To.IsZero() && r.Time.After(f.To):
+		return false
+	}
+
+	return true
+}
+
+// Log appends records as JSON lines to the file, records are only logged if the file isn't set.
+//
+// The file is rotated to file.1, file.2, ... when it exceeds the maximum size.
+type Log struct {
+	file       string
+	maxSize    int64
+	maxBackups int
+	hashChain  bool
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	lastHash string
+}
+
+func New(file string, maxSize int64, maxBackups int, hashChain bool) (*Log, error) {
+	l := &Log{
+		file:       file,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		hashChain:  hashChain,
+	}
+
+	if len(file) == 0 {
+		return l, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return nil, errors.Wrap(err, "create directory fail")
+	}
+
+	if hashChain {
+		lastHash, err := l.recoverLastHash()
+		if err != nil {
+			return nil, errors.Wrap(err, "recover last hash fail")
+		}
+
+		l.lastHash = lastHash
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Write Appends the record, failures are logged since the audited operation must not fail because of them.
+func (l *Log) Write(r Record) {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+
+	log.Info().
+		Str("user", r.User).
+		Str("ip", r.IP).
+		Str("action", r.Action).
+		Str("upstream", r.Upstream).
+		Str("ups", r.UPS).
+		Str("target", r.Target).
+		Str("oldValue", r.OldValue).
+		Str("value", r.Value).
+		Str("result", r.Result).
+		Str("error", r.Error).
+		Msg("audit")
+
+	if len(l.file) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.hashChain {
+		r.PrevHash = l.lastHash
+
+		hash, err := hashRecord(r)
+		if err != nil {
+			log.Error().Err(err).Msg("audit record hashing fail")
+
+			return
+		}
+
+		r.Hash = hash
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Error().Err(err).Msg("audit record marshal fail")
+
+		return
+	}
+	data = append(data, '\n')
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Error().Err(err).Msg("audit log rotation fail")
+
+			return
+		}
+	}
+
+	n, err := l.f.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		log.Error().Err(err).Msg("audit record write fail")
+
+		return
+	}
+
+	l.lastHash = r.Hash
+}
+
+// Query Returns the latest records matching the filter, the newest record goes first.
+func (l *Log) Query(f Filter) ([]Record, error) {
+	if f.Limit <= 0 {
+		f.Limit = defaultLimit
+	}
+
+	records := make([]Record, 0)
+	if len(l.file) == 0 {
+		return records, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.scan(func(file string, line int, r Record) error {
+		if !f.match(r) {
+			return nil
+		}
+
+		records = append(records, r)
+		if len(records) > f.Limit {
+			records = records[1:]
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	return records, nil
+}
+
+// Verify Checks the hash chain of records kept in the file and its backups, it returns the number of checked records.
+//
+// The chain of the oldest kept record can't be checked since its predecessor is rotated out.
+func (l *Log) Verify() (int, error) {
+	if !l.hashChain {
+		return 0, ErrHashChainDisabled
+	}
+	if len(l.file) == 0 {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var (
+		count int
+		prev  string
+	)
+	err := l.scan(func(file string, line int, r Record) error {
+		if count > 0 && r.PrevHash != prev {
+			return errors.Wrapf(ErrTampered, "%s:%d: chain is broken", file, line)
+		}
+
+		hash, err := hashRecord(r)
+		if err != nil {
+			return err
+		}
+		if hash != r.Hash {
+			return errors.Wrapf(ErrTampered, "%s:%d: hash mismatch", file, line)
+		}
+
+		prev = r.Hash
+		count++
+
+		return nil
+	})
+
+	return count, err
+}
+
+func (l *Log) Close() error {
+	if l.f == nil {
+		return nil
+	}
+
+	return l.f.Close()
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "open fail")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+
+		return errors.Wrap(err, "stat fail")
+	}
+
+	l.f = f
+	l.size = info.Size()
+
+	return nil
+}
+
+// rotate Shifts backups and starts the new file, l.mu must be held.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return errors.Wrap(err, "close fail")
+	}
+
+	if l.maxBackups > 0 {
+		for i := l.maxBackups - 1; i > 0; i-- {
+			if err := os.Rename(l.backup(i), l.backup(i+1)); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "rename backup fail")
+			}
+		}
+
+		if err := os.Rename(l.file, l.backup(1)); err != nil {
+			return errors.Wrap(err, "rename fail")
+		}
+	} else if err := os.Remove(l.file); err != nil {
+		return errors.Wrap(err, "remove fail")
+	}
+
+	return l.open()
+}
+
+func (l *Log) backup(i int) string {
+	return l.file + "." + strconv.Itoa(i)
+}
+
+// files Returns existing files from the oldest backup to the current file.
+func (l *Log) files() []string {
+	files := make([]string, 0, l.maxBackups+1)
+	for i := l.maxBackups; i > 0; i-- {
+		if _, err := os.Stat(l.backup(i)); err == nil {
+			files = append(files, l.backup(i))
+		}
+	}
+
+	return append(files, l.file)
+}
+
+// scan Calls fn for each record from the oldest one.
+func (l *Log) scan(fn func(file string, line int, r Record) error) error {
+	for _, file := range l.files() {
+		if err := scanFile(file, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *Log) recoverLastHash() (string, error) {
+	var lastHash string
+	err := l.scan(func(file string, line int, r Record) error {
+		lastHash = r.Hash
+
+		return nil
+	})
+
+	return lastHash, err
+}
+
+func scanFile(file string, fn func(file string, line int, r Record) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return errors.Wrap(err, "open fail")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return errors.Wrapf(ErrTampered, "%s:%d: %s", file, line, err)
+		}
+
+		if err := fn(file, line, r); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(scanner.Err(), "read fail")
+}
+
+// hashRecord Returns SHA-256 of the record with the empty Hash.
+func hashRecord(r Record) (string, error) {
+	r.Hash = ""
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", errors.Wrap(err, "json marshal fail")
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	t.Run("query", func(t *testing.T) {
+		l, err := New(filepath.Join(t.TempDir(), "audit.log"), 0, 0, false)
+		require.NoError(t, err)
+		defer l.Close()
+
+		start := time.Now()
+		l.Write(Record{Time: start, User: "admin", Action: "command", UPS: "ups", Target: "beeper.enable", Result: ResultDone})
+		l.Write(Record{Time: start.Add(time.Minute), User: "grafana", Action: "variable", UPS: "ups", Target: "ups.delay.start", OldValue: "30", Value: "60", Result: ResultFailed})
+		l.Write(Record{Time: start.Add(time.Minute * 2), User: "admin", Action: "fsd", UPS: "ups", Result: ResultDone})
+
+		records, err := l.Query(Filter{})
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		require.Equal(t, "fsd", records[0].Action)
+		require.Equal(t, "60", records[1].Value)
+
+		records, err = l.Query(Filter{User: "admin", Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, "fsd", records[0].Action)
+
+		records, err = l.Query(Filter{From: start.Add(time.Second), To: start.Add(time.Minute * 1)})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, "grafana", records[0].User)
+	})
+
+	t.Run("no file", func(t *testing.T) {
+		l, err := New("", 0, 0, false)
+		require.NoError(t, err)
+
+		l.Write(Record{Action: "command", Result: ResultDone})
+
+		records, err := l.Query(Filter{})
+		require.NoError(t, err)
+		require.Empty(t, records)
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "audit.log")
+		l, err := New(file, 300, 2, true)
+		require.NoError(t, err)
+		defer l.Close()
+
+		for i := 0; i < 10; i++ {
+			l.Write(Record{Action: "command", UPS: "ups", Target: "beeper.enable", Result: ResultDone})
+		}
+
+		require.FileExists(t, file+".1")
+		require.FileExists(t, file+".2")
+		require.NoFileExists(t, file+".3")
+
+		// the oldest records are rotated out
+		records, err := l.Query(Filter{Limit: 100})
+		require.NoError(t, err)
+		require.Less(t, len(records), 10)
+
+		count, err := l.Verify()
+		require.NoError(t, err)
+		require.Equal(t, len(records), count)
+	})
+
+	t.Run("hash chain", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "audit.log")
+		l, err := New(file, 0, 0, true)
+		require.NoError(t, err)
+
+		l.Write(Record{Action: "variable", UPS: "ups", Target: "ups.delay.start", OldValue: "30", Value: "60", Result: ResultDone})
+		l.Write(Record{Action: "command", UPS: "ups", Target: "beeper.enable", Result: ResultDone})
+		require.NoError(t, l.Close())
+
+		// the chain goes on after restart
+		l, err = New(file, 0, 0, true)
+		require.NoError(t, err)
+		defer l.Close()
+
+		l.Write(Record{Action: "fsd", UPS: "ups", Result: ResultDone})
+
+		count, err := l.Verify()
+		require.NoError(t, err)
+		require.Equal(t, 3, count)
+
+		data, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(file, []byte(strings.Replace(string(data), `"value":"60"`, `"value":"90"`, 1)), 0o600))
+
+		_, err = l.Verify()
+		require.True(t, errors.Is(err, ErrTampered))
+
+		lines := strings.SplitAfter(string(data), "\n")
+		require.NoError(t, ioutil.WriteFile(file, []byte(lines[0]+lines[2]), 0o600))
+
+		_, err = l.Verify()
+		require.True(t, errors.Is(err, ErrTampered))
+	})
+
+	t.Run("hash chain disabled", func(t *testing.T) {
+		l, err := New(filepath.Join(t.TempDir(), "audit.log"), 0, 0, false)
+		require.NoError(t, err)
+		defer l.Close()
+
+		_, err = l.Verify()
+		require.True(t, errors.Is(err, ErrHashChainDisabled))
+	})
+}
@@ -36,20 +36,406 @@ type Config struct {
 
 		// Maximum content size limit
 		BodyLimit int
+
+		// TLS of the API listener, it's disabled if CertFile is empty
+		TLS struct {
+			CertFile string
+			KeyFile  string
+
+			// CA of client certificates, mutual TLS is enabled if it's set
+			ClientCAFile string
+
+			// Client certificates are required, otherwise they're verified only if they're given
+			RequireClientCert bool
+
+			// Certificate files are checked for modification after this interval, e.g. "1m"
+			ReloadInterval string
+		}
+
+		// Plain HTTP listener serving only /metrics beside the API listener, it's disabled if Port is zero
+		Metrics struct {
+			Host string
+			Port int
+		}
+
+		// Authentication of the API, every request is allowed if it's disabled
+		Auth struct {
+			Enabled bool
+
+			// /metrics is readable without authentication
+			AnonymousMetrics bool
+
+			// File of users' password hashes for HTTP Basic, lines are "name:pbkdf2-sha256$iterations$salt$hex",
+			// where hex is the PBKDF2-HMAC-SHA256 key of the password
+			UsersFile string
+
+			Users []struct {
+				Name string
+
+				// Static bearer token or API key sent by the X-API-Key header
+				Token string
+
+				// Subject of the client certificate verified by TLS.ClientCAFile, e.g. "CN=grafana,O=Monitoring" or "grafana"
+				Subject string
+
+				// Permissions: read, write (variables), command (instant commands),
+				// dangerous (dangerous commands and FSD beside the command permission), audit (the audit trail)
+				Permissions []string
+
+				// Allowed instant commands as name patterns, e.g. "beeper.*", all commands are allowed if it's empty
+				Commands []string
+			}
+		}
+
+		// Dangerous commands need the dangerous permission and the confirmation: the request returns
+		// the confirmation token which must be re-submitted by the X-Confirmation-Token header, FSD is always dangerous
+		Dangerous struct {
+			// Name patterns of dangerous commands, e.g. "shutdown.*"
+			Commands []string
+
+			// Lifetime of confirmation tokens, e.g. "30s"
+			ConfirmationTTL string
+		}
 	}
 
 	Clients struct {
 		NUT struct {
+			// The single NUT server, it's used as the upstream named "default" if Upstreams are absent
 			Host     string
 			Port     int
 			Username string
 			Password string
+
+			// Named NUT servers polled concurrently
+			Upstreams []struct {
+				Name     string
+				Host     string
+				Port     int
+				Username string
+				Password string
+
+				// Poll interval, Metrics.NUT.Interval is used if it's absent
+				Interval string
+			}
+
+			// Maximum number of simultaneously opened sessions to upsd
+			PoolSize int
+
+			// Idle session is closed after this timeout, e.g. "5m"
+			IdleTimeout string
+
+			// Idle session is checked by the VER command before reuse after this interval, e.g. "30s"
+			HealthCheckInterval string
+
+			// Descriptions, types and commands of UPS are re-read after this interval, e.g. "1h"
+			MetadataRefreshInterval string
+
+			// STARTTLS toward upsd
+			TLS struct {
+				Enabled bool
+
+				// Authentication over plaintext is refused if upsd doesn't support STARTTLS
+				Required bool
+
+				// CA of the upsd certificate, the system pool is used if it's empty
+				CAFile string
+
+				// Name verified against the upsd certificate, the host is used if it's empty
+				ServerName string
+
+				// The upsd certificate isn't verified, it's only for testing
+				InsecureSkipVerify bool
+
+				// Client certificate
+				CertFile string
+				KeyFile  string
+			}
+		}
+	}
+
+	// Probing NUT servers given by the target parameter of /probe
+	Probe struct {
+		// Named modules selected by the module parameter of /probe, "default" is used if it's absent
+		Modules map[string]struct {
+			Username string
+			Password string
+
+			// String variables exported as info metrics, see Metrics.NUT.Info
+			Info struct {
+				Allow []string
+				Deny  []string
+			}
+
+			// STARTTLS toward the probed upsd, see Clients.NUT.TLS
+			TLS struct {
+				Enabled            bool
+				Required           bool
+				CAFile             string
+				ServerName         string
+				InsecureSkipVerify bool
+				CertFile           string
+				KeyFile            string
+			}
+
+			// Host patterns of targets the module probes, e.g. "192.168.0.*", credentials of the module are
+			// sent to them. The module with credentials probes no target if it's empty.
+			Targets []string
+		}
+	}
+
+	// Power events derived from UPS status and variable transitions
+	Events struct {
+		// A condition must hold for this time before its event is raised, e.g. "5s"
+		Debounce string
+
+		// COMMBAD is raised when the UPS is absent in snapshots for this time, e.g. "15s"
+		CommBadAfter string
+
+		// NOCOMM is raised when communication has been lost for this time, e.g. "5m"
+		NoCommAfter string
+
+		// LOWBATT is raised when battery.charge falls to this percent beside the LB flag, 0 disables it
+		LowBatteryCharge float64
+
+		// LOWBATT by the charge is cleared only when it rises above LowBatteryCharge by this percent
+		Hysteresis float64
+
+		// Number of events kept for /api/v1/events/recent
+		Recent int
+
+		// Outbound webhooks notified of events
+		Webhooks struct {
+			// Undelivered requests are persisted to this file, so they survive restarts
+			QueueFile string
+
+			// The request is dropped after this number of failed attempts
+			MaxAttempts int
+
+			// Delay before the first retry, e.g. "1s", it's doubled after every attempt up to MaxBackoff
+			InitialBackoff string
+			MaxBackoff     string
+
+			// Timeout of a single request, e.g. "10s"
+			Timeout string
+
+			Hooks []struct {
+				Name    string
+				URL     string
+				Method  string
+				Headers map[string]string
+
+				// text/template of the body, e.g. '{{.Message}}, charge {{index .Variables "battery.charge"}}%',
+				// the event is sent as JSON if it's empty
+				Body string
+
+				// The body is signed by HMAC-SHA256 in the X-Signature-256 header if it's set
+				Secret string
+
+				// Event types, e.g. ONBATT, all events are sent if it's empty
+				Events []string
+			}
+		}
+	}
+
+	// Audit trail of write operations, it's served by /api/v1/audit
+	Audit struct {
+		// JSON lines file, records are only logged if it's empty
+		File string
+
+		// Size of the file in bytes the file is rotated after, zero disables rotation
+		MaxSize int64
+
+		// Number of rotated files kept as File.1, File.2, ...
+		MaxBackups int
+
+		// Each record contains the hash of the previous one, so tampering is detected by /api/v1/audit/verify
+		HashChain bool
+	}
+
+	// History of numeric variables written by the poller, it's served by /api/v1/ups/{name}/history
+	History struct {
+		Enabled bool
+
+		// Directory of segment files
+		Dir string
+
+		// Total size of files in bytes, the oldest files of the largest tier are deleted after it,
+		// zero disables the limit
+		MaxSize int64
+
+		// Samples are averaged over the resolution, e.g. "1m", and kept for the retention, e.g. "24h".
+		// The query reads the finest tier which keeps its range.
+		Tiers []struct {
+			Resolution string
+			Retention  string
+		}
+	}
+
+	// Journal of power outages, it's served by /api/v1/outages
+	Outages struct {
+		// JSON lines file of ended outages, they're kept only in memory if it's empty
+		File string
+
+		// Outages ended before this time, e.g. "8760h", and the oldest outages above the number are dropped,
+		// zero disables the limit
+		MaxAge     string
+		MaxRecords int
+	}
+
+	// Shutdown of the local host on power events, like upsmon does
+	Shutdown struct {
+		Enabled bool
+
+		// Steps are only logged, neither commands are run nor FSD is set
+		DryRun bool
+
+		// Monitored UPSes as "ups@upstream" or "ups", all UPSes are monitored if it's empty
+		UPS []string
+
+		// Shutdown is triggered when the UPS is on battery for this time, e.g. "5m", empty disables it
+		OnBatteryFor string
+
+		// Shutdown is triggered when battery.runtime of the UPS on battery falls below this number of seconds, 0 disables it
+		MinRuntime float64
+
+		// Shutdown is triggered by FSD events and when the battery of the UPS on battery (OB) is low,
+		// by LOWBATT or by ONBATT if the battery is still low after the previous outage
+		OnLowBattery bool
+		OnFSD        bool
+
+		// FSD is set on the UPS before stages are run, it needs the FSD action or upsmon primary in upsd.users
+		ForceShutdown bool
+
+		// Stages are run one after another, failed commands don't stop the shutdown
+		Stages []struct {
+			Name     string
+			Commands []struct {
+				Command []string
+				Timeout string
+			}
+		}
+	}
+
+	// Outputs pushing polled UPS variables to other systems
+	Outputs struct {
+		MQTT struct {
+			Enabled bool
+
+			// Broker
+			Host     string
+			Port     int
+			ClientID string
+			Username string
+			Password string
+
+			// QoS of published messages and the command subscription, 0 or 1
+			QoS int
+
+			// e.g. "30s"
+			KeepAlive         string
+			Timeout           string
+			ReconnectInterval string
+
+			// Variables are published as retained "<topicPrefix>/<ups>/<variable>", the availability
+			// is "<topicPrefix>/status" with the "offline" last will
+			TopicPrefix string
+
+			// Home Assistant MQTT discovery
+			Discovery struct {
+				Enabled bool
+				Prefix  string
+			}
+
+			// Instant commands allowed by "<topicPrefix>/<ups>/command" topics as name patterns,
+			// e.g. "beeper.*", commands are disabled if it's empty. Dangerous commands of http.dangerous
+			// are never allowed, retained command messages and commands the UPS doesn't list are dropped.
+			Commands []string
+
+			TLS struct {
+				Enabled            bool
+				CAFile             string
+				ServerName         string
+				InsecureSkipVerify bool
+				CertFile           string
+				KeyFile            string
+			}
+		}
+
+		InfluxDB struct {
+			Enabled bool
+
+			// API version: 2 writes to "/api/v2/write", 1 writes to "/write"
+			Version int
+
+			// e.g. "http://127.0.0.1:8086"
+			URL string
+
+			// InfluxDB 2.x
+			Org    string
+			Bucket string
+			Token  string
+
+			// InfluxDB 1.x, credentials are optional
+			Database        string
+			RetentionPolicy string
+			Username        string
+			Password        string
+
+			// Lines are tagged by "upstream" and "ups", fields are numeric and boolean variables
+			Measurement string
+
+			// Lines are sent by batches of BatchSize lines at least every FlushInterval, up to BufferSize
+			// lines are kept for retry while InfluxDB is unavailable
+			BatchSize     int
+			BufferSize    int
+			FlushInterval string
+			Timeout       string
+
+			Gzip bool
+		}
+
+		// Graphite plaintext and StatsD outputs pushing the same values as Prometheus metrics
+		Push struct {
+			// Timeout of connecting and writing, e.g. "5s"
+			Timeout string
+
+			Targets []struct {
+				Name string
+
+				// "graphite" or "statsd"
+				Protocol string
+
+				// "tcp" or "udp", it's "tcp" for Graphite and "udp" for StatsD by default
+				Transport string
+
+				// e.g. "127.0.0.1:2003"
+				Address string
+
+				// e.g. "10s"
+				Interval string
+
+				// Metric path with {upstream}, {ups} and {variable} placeholders,
+				// "nut.{upstream}.{ups}.{variable}" by default
+				Template string
+			}
 		}
 	}
 
 	Metrics struct {
 		NUT struct {
 			Interval string
+
+			// Mode of collecting metrics:
+			//  - poll - UPS list is polled on the interval, metrics are collected from the latest snapshot
+			//  - scrape - UPS list is read from NUT on every scrape of /metrics
+			Mode string
+
+			// String variables exported as info metrics with the value as a label.
+			// Both lists contain name patterns, e.g. "ups.*", an empty allow list allows everything.
+			Info struct {
+				Allow []string
+				Deny  []string
+			}
 		}
 	}
 }
@@ -62,6 +448,54 @@ func (c *Config) Init(file string) error {
 
 	viper.SetConfigFile(file)
 
+	// defaults for the settings which are absent in the config file
+	viper.SetDefault("http.tls.reloadInterval", "1m")
+	viper.SetDefault("http.auth.anonymousMetrics", true)
+	viper.SetDefault("http.dangerous.commands", []string{"shutdown.*", "load.off*", "beeper.disable"})
+	viper.SetDefault("http.dangerous.confirmationTTL", "30s")
+	viper.SetDefault("clients.nut.poolSize", 2)
+	viper.SetDefault("clients.nut.idleTimeout", "5m")
+	viper.SetDefault("clients.nut.healthCheckInterval", "30s")
+	viper.SetDefault("clients.nut.metadataRefreshInterval", "1h")
+	viper.SetDefault("metrics.nut.mode", "poll")
+	viper.SetDefault("events.debounce", "5s")
+	viper.SetDefault("events.commBadAfter", "15s")
+	viper.SetDefault("events.noCommAfter", "5m")
+	viper.SetDefault("events.hysteresis", 5)
+	viper.SetDefault("events.recent", 100)
+	viper.SetDefault("events.webhooks.maxAttempts", 10)
+	viper.SetDefault("events.webhooks.initialBackoff", "1s")
+	viper.SetDefault("events.webhooks.maxBackoff", "5m")
+	viper.SetDefault("events.webhooks.timeout", "10s")
+	viper.SetDefault("audit.maxSize", 10*1024*1024)
+	viper.SetDefault("audit.maxBackups", 5)
+	viper.SetDefault("history.maxSize", 16*1024*1024)
+	viper.SetDefault("history.tiers", []map[string]string{
+		{"resolution": "1m", "retention": "24h"},
+		{"resolution": "15m", "retention": "720h"},
+	})
+	viper.SetDefault("outages.maxAge", "8760h")
+	viper.SetDefault("outages.maxRecords", 1000)
+	viper.SetDefault("outputs.mqtt.port", 1883)
+	viper.SetDefault("outputs.mqtt.clientID", "nut_client_service")
+	viper.SetDefault("outputs.mqtt.keepAlive", "30s")
+	viper.SetDefault("outputs.mqtt.timeout", "10s")
+	viper.SetDefault("outputs.mqtt.reconnectInterval", "5s")
+	viper.SetDefault("outputs.mqtt.topicPrefix", "nut")
+	viper.SetDefault("outputs.mqtt.discovery.prefix", "homeassistant")
+	viper.SetDefault("outputs.influxdb.version", 2)
+	viper.SetDefault("outputs.influxdb.url", "http://127.0.0.1:8086")
+	viper.SetDefault("outputs.influxdb.measurement", "ups")
+	viper.SetDefault("outputs.influxdb.batchSize", 1000)
+	viper.SetDefault("outputs.influxdb.bufferSize", 100000)
+	viper.SetDefault("outputs.influxdb.flushInterval", "10s")
+	viper.SetDefault("outputs.influxdb.timeout", "10s")
+	viper.SetDefault("outputs.influxdb.gzip", true)
+	viper.SetDefault("outputs.push.timeout", "5s")
+	viper.SetDefault("shutdown.dryRun", true)
+	viper.SetDefault("shutdown.onLowBattery", true)
+	viper.SetDefault("shutdown.onFSD", true)
+
 	if err := viper.ReadInConfig(); err != nil {
 		return errors.Wrap(err, "open config file failed")
 	}
@@ -0,0 +1,39 @@
+package events
+
+import "time"
+
+// condition is the debounced boolean state of the UPS, e.g. "on battery".
+//
+// The observed value becomes active only after it has been held for the debounce time,
+// so short flaps don't raise events.
+type condition struct {
+	// raise is the event type sent when the condition becomes true, clear when it becomes false,
+	// no event is sent for the empty type
+	raise, clear string
+
+	active   bool
+	observed bool
+	since    time.Time
+}
+
+// observe Records the observed value.
+func (c *condition) observe(value bool, now time.Time) {
+	if value != c.observed {
+		c.observed = value
+		c.since = now
+	}
+}
+
+// settle Activates the observed value if it has been held for the debounce time and returns the event type.
+func (c *condition) settle(now time.Time, debounce time.Duration) (string, bool) {
+	if c.observed == c.active || now.Sub(c.since) < debounce {
+		return "", false
+	}
+
+	c.active = c.observed
+	if c.active {
+		return c.raise, len(c.raise) > 0
+	}
+
+	return c.clear, len(c.clear) > 0
+}
@@ -0,0 +1,342 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// checkInterval is the interval of settling debounced conditions and checking communication with UPSes.
+const checkInterval = time.Second
+
+var eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "nut_client_service",
+	Name:      "events_total",
+	Help:      "Number of power events by type.",
+}, []string{"server", "ups", "type"})
+
+// statusConditions are conditions raised by ups.status flags.
+var statusConditions = []struct {
+	flag         string
+	raise, clear string
+}{
+	{"OB", TypeOnBatt, TypeOnline},
+	{"FSD", TypeFSD, ""},
+	{"RB", TypeReplBatt, ""},
+	{"OVER", TypeOverload, ""},
+	{"BYPASS", TypeBypass, ""},
+}
+
+// upsState is the state of conditions of the UPS.
+type upsState struct {
+	upstream, name string
+	status         string
+	variables      map[string]interface{}
+
+	conditions map[string]*condition
+	lowBattery *condition
+	comm       *condition
+
+	lastSeen time.Time
+	noComm   bool
+}
+
+func (st *upsState) event(eventType, status string, t time.Time) Event {
+	return Event{
+		Type:       eventType,
+		Upstream:   st.upstream,
+		UPS:        st.name,
+		Time:       t,
+		Status:     status,
+		LowBattery: st.lowBattery.active,
+		Message:    fmt.Sprintf(messages[eventType], st.name+"@"+st.upstream),
+		Variables:  st.variables,
+	}
+}
+
+// Engine derives events from snapshots taken by the poller and delivers them to sinks.
+type Engine struct {
+	store *snapshot.Store
+	sinks []Sink
+
+	debounce     time.Duration
+	commBadAfter time.Duration
+	noCommAfter  time.Duration
+
+	// LOWBATT is raised when battery.charge falls to lowBatteryCharge and cleared when it rises
+	// above lowBatteryCharge+hysteresis, only the LB flag is used if lowBatteryCharge is zero
+	lowBatteryCharge float64
+	hysteresis       float64
+
+	mu         sync.Mutex
+	states     map[string]*upsState
+	recent     []Event
+	recentSize int
+}
+
+func New(
+	store *snapshot.Store,
+	sinks []Sink,
+	debounce, commBadAfter, noCommAfter string,
+	lowBatteryCharge, hysteresis float64,
+	recentSize int,
+) (*Engine, error) {
+	debounceDur, err := time.ParseDuration(debounce)
+	if err != nil {
+		return nil, errors.Wrapf(err, "debounce parsing fail (%s)", debounce)
+	}
+
+	commBadAfterDur, err := time.ParseDuration(commBadAfter)
+	if err != nil {
+		return nil, errors.Wrapf(err, "comm bad after parsing fail (%s)", commBadAfter)
+	}
+
+	noCommAfterDur, err := time.ParseDuration(noCommAfter)
+	if err != nil {
+		return nil, errors.Wrapf(err, "no comm after parsing fail (%s)", noCommAfter)
+	}
+
+	return &Engine{
+		store:            store,
+		sinks:            sinks,
+		debounce:         debounceDur,
+		commBadAfter:     commBadAfterDur,
+		noCommAfter:      noCommAfterDur,
+		lowBatteryCharge: lowBatteryCharge,
+		hysteresis:       hysteresis,
+		states:           make(map[string]*upsState),
+		recentSize:       recentSize,
+	}, nil
+}
+
+// Run Deriving events from snapshots set to the store until the context is done.
+func (e *Engine) Run(ctx context.Context) error {
+	snapshots, cancel := e.store.Subscribe()
+	defer cancel()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		var events []Event
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case s := <-snapshots:
+			events = e.observe(s, time.Now())
+		case <-ticker.C:
+			events = e.check(time.Now())
+		}
+
+		e.dispatch(ctx, events)
+	}
+}
+
+// Recent Returns up to limit latest events, the newest is the first.
+func (e *Engine) Recent(limit int) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if limit <= 0 || limit > len(e.recent) {
+		limit = len(e.recent)
+	}
+
+	res := make([]Event, 0, limit)
+	for i := len(e.recent) - 1; i >= len(e.recent)-limit; i-- {
+		res = append(res, e.recent[i])
+	}
+
+	return res
+}
+
+// observe Records conditions of UPSes of the snapshot and returns events of settled conditions.
+func (e *Engine) observe(s snapshot.Snapshot, now time.Time) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, ups := range s.List {
+		st := e.state(s.Upstream, ups.Name)
+		st.lastSeen = s.Time
+		st.status = variableString(ups, "ups.status")
+
+		st.variables = make(map[string]interface{}, len(ups.Variables))
+		for _, v := range ups.Variables {
+			st.variables[v.Name] = v.Value
+		}
+
+		flags := make(map[string]bool)
+		for _, flag := range strings.Fields(st.status) {
+			flags[flag] = true
+		}
+
+		for _, c := range statusConditions {
+			st.conditions[c.flag].observe(flags[c.flag], now)
+		}
+
+		st.lowBattery.observe(e.isLowBattery(st, ups, flags["LB"]), now)
+	}
+
+	return e.settle(now)
+}
+
+// check Checks communication with UPSes and returns events of settled conditions.
+func (e *Engine) check(now time.Time) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.settle(now)
+}
+
+// settle Settles conditions of all UPSes, e.mu must be held.
+func (e *Engine) settle(now time.Time) []Event {
+	var events []Event
+
+	for _, key := range e.keys() {
+		st := e.states[key]
+
+		// the UPS is considered lost if it's absent in snapshots for commBadAfter
+		lost := now.Sub(st.lastSeen)
+		st.comm.observe(lost >= e.commBadAfter, now)
+
+		if eventType, ok := st.comm.settle(now, 0); ok {
+			events = append(events, st.event(eventType, "", now))
+		}
+		if st.comm.active && !st.noComm && lost >= e.noCommAfter {
+			st.noComm = true
+			events = append(events, st.event(TypeNoComm, "", now))
+		}
+		if !st.comm.active {
+			st.noComm = false
+		}
+
+		for _, c := range statusConditions {
+			if eventType, ok := st.conditions[c.flag].settle(now, e.debounce); ok {
+				events = append(events, st.event(eventType, st.status, now))
+			}
+		}
+
+		if eventType, ok := st.lowBattery.settle(now, e.debounce); ok {
+			events = append(events, st.event(eventType, st.status, now))
+		}
+	}
+
+	e.recent = append(e.recent, events...)
+	if len(e.recent) > e.recentSize {
+		e.recent = append([]Event(nil), e.recent[len(e.recent)-e.recentSize:]...)
+	}
+
+	return events
+}
+
+// isLowBattery Checks the LB flag and battery.charge taking the hysteresis into account, e.mu must be held.
+func (e *Engine) isLowBattery(st *upsState, ups *nut_client.UPS, flag bool) bool {
+	if flag || e.lowBatteryCharge <= 0 {
+		return flag
+	}
+
+	charge, ok := variableFloat(ups, "battery.charge")
+	if !ok {
+		return false
+	}
+
+	if st.lowBattery.observed {
+		return charge <= e.lowBatteryCharge+e.hysteresis
+	}
+
+	return charge <= e.lowBatteryCharge
+}
+
+// state Returns the state of the UPS creating it on the first observation, e.mu must be held.
+func (e *Engine) state(upstream, name string) *upsState {
+	key := upstream + "/" + name
+
+	st, ok := e.states[key]
+	if !ok {
+		st = &upsState{
+			upstream:   upstream,
+			name:       name,
+			conditions: make(map[string]*condition, len(statusConditions)),
+			lowBattery: &condition{raise: TypeLowBatt},
+			comm:       &condition{raise: TypeCommBad, clear: TypeCommOK},
+		}
+		for _, c := range statusConditions {
+			st.conditions[c.flag] = &condition{raise: c.raise, clear: c.clear}
+		}
+
+		e.states[key] = st
+	}
+
+	return st
+}
+
+// keys Returns keys of UPS states sorted, so events are ordered stably, e.mu must be held.
+func (e *Engine) keys() []string {
+	keys := make([]string, 0, len(e.states))
+	for key := range e.states {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// dispatch Counts events and delivers them to sinks.
+func (e *Engine) dispatch(ctx context.Context, events []Event) {
+	for _, ev := range events {
+		eventsTotal.WithLabelValues(ev.Upstream, ev.UPS, ev.Type).Inc()
+
+		log.Info().
+			Str("type", ev.Type).
+			Str("upstream", ev.Upstream).
+			Str("ups", ev.UPS).
+			Msg(ev.Message)
+
+		for _, s := range e.sinks {
+			if err := s.Notify(ctx, ev); err != nil {
+				log.Error().Err(err).Str("type", ev.Type).Msg("event notifying fail")
+			}
+		}
+	}
+}
+
+func variableString(ups *nut_client.UPS, name string) string {
+	for _, v := range ups.Variables {
+		if v.Name == name {
+			if s, ok := v.Value.(string); ok {
+				return s
+			}
+		}
+	}
+
+	return ""
+}
+
+func variableFloat(ups *nut_client.UPS, name string) (float64, bool) {
+	for _, v := range ups.Variables {
+		if v.Name != name {
+			continue
+		}
+
+		switch value := v.Value.(type) {
+		case int64:
+			return float64(value), true
+		case float64:
+			return value, true
+		}
+	}
+
+	return 0, false
+}
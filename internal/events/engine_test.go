@@ -0,0 +1,88 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+func newSnapshot(t time.Time, status string, charge int64) snapshot.Snapshot {
+	return snapshot.Snapshot{
+		Upstream: "default",
+		Time:     t,
+		List: []*nut_client.UPS{{
+			Name: "ups",
+			Variables: []nut_client.Variable{
+				{Name: "ups.status", Value: status},
+				{Name: "battery.charge", Value: charge},
+			},
+		}},
+	}
+}
+
+func types(events []Event) []string {
+	res := make([]string, 0, len(events))
+	for _, e := range events {
+		res = append(res, e.Type)
+	}
+
+	return res
+}
+
+func TestEngine(t *testing.T) {
+	e, err := New(snapshot.New(), nil, "5s", "15s", "1m", 20, 5, 3)
+	require.NoError(t, err)
+
+	start := time.Now()
+	at := func(sec int) time.Time {
+		return start.Add(time.Duration(sec) * time.Second)
+	}
+
+	t.Run("online", func(t *testing.T) {
+		require.Empty(t, e.observe(newSnapshot(at(0), "OL", 100), at(0)))
+	})
+
+	t.Run("debounced flap", func(t *testing.T) {
+		require.Empty(t, e.observe(newSnapshot(at(1), "OB", 100), at(1)))
+		require.Empty(t, e.observe(newSnapshot(at(2), "OL", 100), at(2)))
+		require.Empty(t, e.check(at(10)))
+	})
+
+	t.Run("on battery", func(t *testing.T) {
+		require.Empty(t, e.observe(newSnapshot(at(11), "OB DISCHRG", 30), at(11)))
+		require.Equal(t, []string{TypeOnBatt}, types(e.check(at(16))))
+	})
+
+	t.Run("low battery with hysteresis", func(t *testing.T) {
+		require.Empty(t, e.observe(newSnapshot(at(17), "OB DISCHRG", 20), at(17)))
+		require.Equal(t, []string{TypeLowBatt}, types(e.check(at(22))))
+
+		// the charge above the threshold but within the hysteresis keeps the battery low
+		require.Empty(t, e.observe(newSnapshot(at(23), "OL CHRG", 24), at(23)))
+		require.Equal(t, []string{TypeOnline}, types(e.check(at(28))))
+		require.True(t, e.states["default/ups"].lowBattery.active)
+
+		require.Empty(t, e.observe(newSnapshot(at(29), "OL CHRG", 26), at(29)))
+		require.Empty(t, e.check(at(35)))
+		require.False(t, e.states["default/ups"].lowBattery.active)
+
+		// the charge below the hysteresis but above the threshold doesn't raise LOWBATT again
+		require.Empty(t, e.observe(newSnapshot(at(36), "OL", 22), at(36)))
+		require.Empty(t, e.check(at(42)))
+	})
+
+	t.Run("communication lost", func(t *testing.T) {
+		require.Equal(t, []string{TypeCommBad}, types(e.check(at(51))))
+		require.Equal(t, []string{TypeNoComm}, types(e.check(at(96))))
+		require.Equal(t, []string{TypeCommOK}, types(e.observe(newSnapshot(at(97), "OL", 100), at(97))))
+	})
+
+	t.Run("recent", func(t *testing.T) {
+		require.Equal(t, []string{TypeCommOK, TypeNoComm, TypeCommBad}, types(e.Recent(0)))
+		require.Equal(t, []string{TypeCommOK}, types(e.Recent(1)))
+	})
+}
@@ -0,0 +1,59 @@
+// Package events derives power events from UPS status and variable transitions, like upsmon's NOTIFY types.
+package events
+
+import (
+	"context"
+	"time"
+)
+
+// Types of events, they're named after upsmon's NOTIFY types.
+const (
+	TypeOnline   = "ONLINE"
+	TypeOnBatt   = "ONBATT"
+	TypeLowBatt  = "LOWBATT"
+	TypeFSD      = "FSD"
+	TypeCommOK   = "COMMOK"
+	TypeCommBad  = "COMMBAD"
+	TypeReplBatt = "REPLBATT"
+	TypeNoComm   = "NOCOMM"
+	TypeOverload = "OVERLOAD"
+	TypeBypass   = "BYPASS"
+)
+
+// messages are formats of event messages taking the UPS name.
+var messages = map[string]string{
+	TypeOnline:   "UPS %s on line power",
+	TypeOnBatt:   "UPS %s on battery",
+	TypeLowBatt:  "UPS %s battery is low",
+	TypeFSD:      "UPS %s: forced shutdown in progress",
+	TypeCommOK:   "Communications with UPS %s established",
+	TypeCommBad:  "Communications with UPS %s lost",
+	TypeReplBatt: "UPS %s battery needs to be replaced",
+	TypeNoComm:   "UPS %s is unavailable",
+	TypeOverload: "UPS %s is overloaded",
+	TypeBypass:   "UPS %s is on bypass",
+}
+
+// Event is the power event of the UPS.
+type Event struct {
+	Type     string    `json:"type"`
+	Upstream string    `json:"upstream"`
+	UPS      string    `json:"ups"`
+	Time     time.Time `json:"time"`
+
+	// ups.status at the moment of the event, it's empty for communication events
+	Status string `json:"status,omitempty"`
+
+	// The battery is low at the moment of the event, LOWBATT is sent only once when it becomes low
+	LowBattery bool `json:"lowBattery,omitempty"`
+
+	Message string `json:"message"`
+
+	// The latest known variables of the UPS
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Sink receives events, Notify must not block for long since events are delivered sequentially.
+type Sink interface {
+	Notify(ctx context.Context, e Event) error
+}
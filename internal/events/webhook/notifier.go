@@ -0,0 +1,413 @@
+// Package webhook delivers power events to outbound webhooks with retries and a persisted queue.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/andreyAKor/nut_client_service/internal/events"
+)
+
+// SignatureHeader is the header of the HMAC-SHA256 signature of the body, e.g. "sha256=5d41...".
+const SignatureHeader = "X-Signature-256"
+
+var (
+	_ events.Sink = (*Notifier)(nil)
+	_ io.Closer   = (*Notifier)(nil)
+)
+
+// Hook is the outbound webhook.
+type Hook struct {
+	Name    string
+	URL     string
+	Method  string
+	Headers map[string]string
+
+	// text/template of the body executed with events.Event, e.g. `{{.Message}}, {{index .Variables "battery.charge"}}%`,
+	// the event is sent as JSON if it's empty
+	Body string
+
+	// The body is signed by HMAC-SHA256 in SignatureHeader if it's set
+	Secret string
+
+	// Event types sent to the hook, all events are sent if it's empty
+	Events []string
+}
+
+type hook struct {
+	Hook
+	body *template.Template
+}
+
+// delivery is the rendered request waiting to be sent, it's persisted in the queue file.
+type delivery struct {
+	Hook        string            `json:"hook"`
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	Headers     map[string]string `json:"headers"`
+	Body        string            `json:"body"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"nextAttempt"`
+}
+
+// Notifier renders events to webhook requests and sends them retrying failed ones with exponential backoff.
+type Notifier struct {
+	hooks  []*hook
+	client *http.Client
+
+	// queue is persisted to this file, so undelivered requests survive restarts, it isn't persisted if it's empty
+	queueFile string
+
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu    sync.Mutex
+	queue []*delivery
+	wake  chan struct{}
+}
+
+func New(
+	hooks []Hook,
+	queueFile string,
+	maxAttempts int,
+	initialBackoff, maxBackoff, timeout string,
+) (*Notifier, error) {
+	initialBackoffDur, err := time.ParseDuration(initialBackoff)
+	if err != nil {
+		return nil, errors.Wrapf(err, "initial backoff parsing fail (%s)", initialBackoff)
+	}
+
+	maxBackoffDur, err := time.ParseDuration(maxBackoff)
+	if err != nil {
+		return nil, errors.Wrapf(err, "max backoff parsing fail (%s)", maxBackoff)
+	}
+
+	timeoutDur, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "timeout parsing fail (%s)", timeout)
+	}
+
+	n := &Notifier{
+		client:         &http.Client{Timeout: timeoutDur},
+		queueFile:      queueFile,
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoffDur,
+		maxBackoff:     maxBackoffDur,
+		wake:           make(chan struct{}, 1),
+	}
+
+	for _, h := range hooks {
+		if len(h.Method) == 0 {
+			h.Method = http.MethodPost
+		}
+
+		t, err := template.New(h.Name).Parse(h.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "body template of hook %q parsing fail", h.Name)
+		}
+
+		n.hooks = append(n.hooks, &hook{Hook: h, body: t})
+	}
+
+	if err := n.load(); err != nil {
+		return nil, errors.Wrapf(err, "queue loading fail (%s)", queueFile)
+	}
+
+	return n, nil
+}
+
+// Notify Renders the event for every hook subscribed to its type and queues requests.
+func (n *Notifier) Notify(ctx context.Context, e events.Event) error {
+	var queued []*delivery
+
+	for _, h := range n.hooks {
+		if !h.subscribed(e.Type) {
+			continue
+		}
+
+		d, err := h.render(e)
+		if err != nil {
+			return errors.Wrapf(err, "render request of hook %q fail", h.Name)
+		}
+
+		queued = append(queued, d)
+	}
+
+	if len(queued) == 0 {
+		return nil
+	}
+
+	n.mu.Lock()
+	n.queue = append(n.queue, queued...)
+	err := n.persist()
+	n.mu.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+
+	return err
+}
+
+// Run Sending queued requests until the context is done.
+func (n *Notifier) Run(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		case <-n.wake:
+		}
+
+		n.sendDue(ctx)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(n.untilNext())
+	}
+}
+
+// Close Persists the queue.
+func (n *Notifier) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.persist()
+}
+
+// sendDue Sends requests whose attempt is due.
+func (n *Notifier) sendDue(ctx context.Context) {
+	n.mu.Lock()
+	now := time.Now()
+
+	var due []*delivery
+
+	for _, d := range n.queue {
+		if !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, d := range due {
+		err := n.send(ctx, d)
+
+		n.mu.Lock()
+
+		d.Attempts++
+
+		switch {
+		case err == nil:
+			n.remove(d)
+		case d.Attempts >= n.maxAttempts:
+			log.Error().Err(err).Str("hook", d.Hook).Int("attempts", d.Attempts).Msg("webhook delivery fail, the request is dropped")
+			n.remove(d)
+		default:
+			d.NextAttempt = time.Now().Add(n.backoff(d.Attempts))
+			log.Warn().Err(err).Str("hook", d.Hook).Time("nextAttempt", d.NextAttempt).Msg("webhook delivery fail")
+		}
+
+		if err := n.persist(); err != nil {
+			log.Error().Err(err).Msg("webhook queue persisting fail")
+		}
+
+		n.mu.Unlock()
+	}
+}
+
+// send Sends the request, any status except 2xx is the failure.
+func (n *Notifier) send(ctx context.Context, d *delivery) error {
+	req, err := http.NewRequestWithContext(ctx, d.Method, d.URL, bytes.NewBufferString(d.Body))
+	if err != nil {
+		return errors.Wrap(err, "create request fail")
+	}
+
+	for k, v := range d.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "send request fail")
+	}
+	defer res.Body.Close()
+
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		return errors.Wrap(err, "read response fail")
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// backoff Returns the delay before the next attempt, it's doubled after every attempt up to maxBackoff.
+func (n *Notifier) backoff(attempts int) time.Duration {
+	d := n.initialBackoff
+	for i := 1; i < attempts && d < n.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > n.maxBackoff {
+		return n.maxBackoff
+	}
+
+	return d
+}
+
+// untilNext Returns the time until the nearest attempt, it's an hour if the queue is empty.
+func (n *Notifier) untilNext() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	next := time.Hour
+	for _, d := range n.queue {
+		if until := time.Until(d.NextAttempt); until < next {
+			next = until
+		}
+	}
+
+	if next < 0 {
+		return 0
+	}
+
+	return next
+}
+
+// remove Removes the delivery from the queue, n.mu must be held.
+func (n *Notifier) remove(d *delivery) {
+	for i, q := range n.queue {
+		if q == d {
+			n.queue = append(n.queue[:i], n.queue[i+1:]...)
+
+			return
+		}
+	}
+}
+
+// persist Writes the queue to the queue file atomically, n.mu must be held.
+func (n *Notifier) persist() error {
+	if len(n.queueFile) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(n.queue)
+	if err != nil {
+		return errors.Wrap(err, "JSON-marshal fail")
+	}
+
+	tmp := n.queueFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return errors.Wrap(err, "write fail")
+	}
+	if err := os.Rename(tmp, n.queueFile); err != nil {
+		return errors.Wrap(err, "rename fail")
+	}
+
+	return nil
+}
+
+// load Reads the queue persisted before restart.
+func (n *Notifier) load() error {
+	if len(n.queueFile) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(n.queueFile), 0o755); err != nil {
+		return errors.Wrap(err, "create directory fail")
+	}
+
+	data, err := ioutil.ReadFile(n.queueFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read fail")
+	}
+
+	if err := json.Unmarshal(data, &n.queue); err != nil {
+		return errors.Wrap(err, "JSON-unmarshal fail")
+	}
+
+	return nil
+}
+
+func (h *hook) subscribed(eventType string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+
+	for _, t := range h.Events {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// render Renders the request of the event.
+func (h *hook) render(e events.Event) (*delivery, error) {
+	var body []byte
+
+	if len(h.Body) == 0 {
+		var err error
+
+		if body, err = json.Marshal(e); err != nil {
+			return nil, errors.Wrap(err, "JSON-marshal fail")
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := h.body.Execute(&buf, e); err != nil {
+			return nil, errors.Wrap(err, "body template executing fail")
+		}
+
+		body = buf.Bytes()
+	}
+
+	headers := make(map[string]string, len(h.Headers)+1)
+	for k, v := range h.Headers {
+		headers[k] = v
+	}
+
+	if len(h.Secret) > 0 {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+
+		headers[SignatureHeader] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	return &delivery{
+		Hook:    h.Name,
+		URL:     h.URL,
+		Method:  h.Method,
+		Headers: headers,
+		Body:    string(body),
+	}, nil
+}
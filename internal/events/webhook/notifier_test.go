@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/events"
+)
+
+// standIn is the local webhook receiver failing the first failures requests.
+type standIn struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+	headers  []http.Header
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	s.bodies = append(s.bodies, string(body))
+	s.headers = append(s.headers, r.Header)
+}
+
+func (s *standIn) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.bodies...)
+}
+
+func TestNotifier(t *testing.T) {
+	receiver := &standIn{failures: 2}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	queueFile := filepath.Join(t.TempDir(), "queue.json")
+	hooks := []Hook{{
+		Name:    "test",
+		URL:     srv.URL,
+		Headers: map[string]string{"Content-Type": "text/plain"},
+		Body:    `{{.Type}} {{.UPS}} {{index .Variables "battery.charge"}}`,
+		Secret:  "secret",
+		Events:  []string{events.TypeOnBatt},
+	}}
+	e := events.Event{
+		Type:      events.TypeOnBatt,
+		UPS:       "ups",
+		Variables: map[string]interface{}{"battery.charge": int64(90)},
+	}
+
+	t.Run("persisted before delivery", func(t *testing.T) {
+		n, err := New(hooks, queueFile, 5, "10ms", "50ms", "1s")
+		require.NoError(t, err)
+
+		require.NoError(t, n.Notify(context.Background(), e))
+		require.NoError(t, n.Notify(context.Background(), events.Event{Type: events.TypeOnline}))
+		require.NoError(t, n.Close())
+
+		restored, err := New(hooks, queueFile, 5, "10ms", "50ms", "1s")
+		require.NoError(t, err)
+		require.Len(t, restored.queue, 1)
+	})
+
+	t.Run("delivered with retries", func(t *testing.T) {
+		n, err := New(hooks, queueFile, 5, "10ms", "50ms", "1s")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() { _ = n.Run(ctx) }()
+
+		require.Eventually(t, func() bool { return len(receiver.received()) == 1 }, time.Second*2, time.Millisecond*10)
+		require.Equal(t, "ONBATT ups 90", receiver.received()[0])
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte("ONBATT ups 90"))
+
+		receiver.mu.Lock()
+		require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), receiver.headers[0].Get(SignatureHeader))
+		require.Equal(t, "text/plain", receiver.headers[0].Get("Content-Type"))
+		receiver.mu.Unlock()
+
+		require.Eventually(t, func() bool { return n.untilNext() == time.Hour }, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		n, err := New(nil, "", 5, "1s", "5s", "1s")
+		require.NoError(t, err)
+
+		require.Equal(t, time.Second, n.backoff(1))
+		require.Equal(t, time.Second*4, n.backoff(3))
+		require.Equal(t, time.Second*5, n.backoff(10))
+	})
+}
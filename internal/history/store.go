@@ -0,0 +1,619 @@
+// Package history keeps the bounded on-disk history of numeric UPS variables.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	metricsNut "github.com/andreyAKor/nut_client_service/internal/metrics/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// segmentsPerRetention is the number of segment files the retention of the tier is split to,
+// the oldest segment is deleted as a whole once it's out of the retention.
+const segmentsPerRetention = 10
+
+// segmentExt is the extension of segment files, they're named by the unix time of their start.
+const segmentExt = ".tsv"
+
+var (
+	ErrDisabled = errors.New("history is disabled")
+
+	_ io.Closer = (*Store)(nil)
+)
+
+// Tier is the resolution samples are averaged over and the retention of the averages, e.g. "1m" for "24h".
+type Tier struct {
+	Resolution string
+	Retention  string
+}
+
+// Point is the average value of the variable over the step starting at Time.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// Query selects points of the variable of the UPS between From and To averaged over Step,
+// the step of the selected tier is used if it's finer.
+type Query struct {
+	Upstream string
+	UPS      string
+	Variable string
+	From     time.Time
+	To       time.Time
+	Step     time.Duration
+}
+
+type key struct {
+	upstream, ups, variable string
+}
+
+// bucket accumulates samples of the variable over the resolution of the tier.
+type bucket struct {
+	start time.Time
+	sum   float64
+	count int
+}
+
+func (b *bucket) value() float64 {
+	return b.sum / float64(b.count)
+}
+
+type tier struct {
+	resolution time.Duration
+	retention  time.Duration
+	segment    time.Duration
+	dir        string
+
+	buckets map[key]*bucket
+
+	// the current segment file
+	file      *os.File
+	fileStart time.Time
+}
+
+// Store writes numeric and boolean variables of snapshots taken by the poller, the same values as exported
+// as Prometheus metrics. Every tier averages samples over its resolution and keeps the averages
+// for its retention in "<dir>/<resolution in seconds>/<segment start>.tsv" files.
+//
+// The total size of files is bounded by maxSize, the oldest segment of the largest tier is deleted
+// when it's exceeded.
+type Store struct {
+	enabled bool
+	dir     string
+	maxSize int64
+	tiers   []*tier
+	store   *snapshot.Store
+
+	mu sync.Mutex
+}
+
+func New(enabled bool, dir string, maxSize int64, tiers []Tier, store *snapshot.Store) (*Store, error) {
+	h := &Store{
+		enabled: enabled,
+		dir:     dir,
+		maxSize: maxSize,
+		store:   store,
+	}
+
+	if !enabled {
+		return h, nil
+	}
+
+	if len(dir) == 0 {
+		return nil, errors.New("empty directory")
+	}
+	if len(tiers) == 0 {
+		return nil, errors.New("no tiers")
+	}
+
+	for _, t := range tiers {
+		resolution, err := time.ParseDuration(t.Resolution)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolution parsing fail (%s)", t.Resolution)
+		}
+		if resolution < time.Second || resolution%time.Second != 0 {
+			return nil, errors.Errorf("resolution must be whole seconds (%s)", t.Resolution)
+		}
+
+		retention, err := time.ParseDuration(t.Retention)
+		if err != nil {
+			return nil, errors.Wrapf(err, "retention parsing fail (%s)", t.Retention)
+		}
+		if retention < resolution {
+			return nil, errors.Errorf("retention must not be less than resolution (%s)", t.Retention)
+		}
+
+		segment := (retention / segmentsPerRetention).Truncate(resolution)
+		if segment < resolution {
+			segment = resolution
+		}
+
+		tr := &tier{
+			resolution: resolution,
+			retention:  retention,
+			segment:    segment,
+			dir:        filepath.Join(dir, strconv.FormatInt(int64(resolution/time.Second), 10)),
+			buckets:    make(map[key]*bucket),
+		}
+
+		if err := os.MkdirAll(tr.dir, 0o755); err != nil {
+			return nil, errors.Wrap(err, "create directory fail")
+		}
+
+		h.tiers = append(h.tiers, tr)
+	}
+
+	sort.Slice(h.tiers, func(i, j int) bool {
+		return h.tiers[i].resolution < h.tiers[j].resolution
+	})
+
+	for i := 1; i < len(h.tiers); i++ {
+		if h.tiers[i].resolution == h.tiers[i-1].resolution {
+			return nil, errors.Errorf("duplicate resolution %s", h.tiers[i].resolution)
+		}
+	}
+
+	return h, nil
+}
+
+// Run Writing snapshots until the context is done.
+func (h *Store) Run(ctx context.Context) error {
+	if !h.enabled {
+		return nil
+	}
+
+	snapshots, cancel := h.store.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case s := <-snapshots:
+			if err := h.add(s); err != nil {
+				log.Error().Err(err).Msg("write history fail")
+			}
+		}
+	}
+}
+
+// Close Writes pending averages and closes segment files.
+func (h *Store) Close() error {
+	if !h.enabled {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, t := range h.tiers {
+		var buf bytes.Buffer
+
+		for k, b := range t.buckets {
+			if err := t.write(&buf, k, b); err != nil {
+				return errors.Wrap(err, "write fail")
+			}
+		}
+		if err := t.flush(&buf); err != nil {
+			return errors.Wrap(err, "flush fail")
+		}
+
+		t.buckets = make(map[key]*bucket)
+
+		if t.file != nil {
+			if err := t.file.Close(); err != nil {
+				return errors.Wrap(err, "close fail")
+			}
+
+			t.file = nil
+		}
+	}
+
+	return nil
+}
+
+// Enabled Returns whether the history is kept.
+func (h *Store) Enabled() bool {
+	return h.enabled
+}
+
+// Query Returns points of the finest tier which keeps the whole range, or of the coarsest tier if none does.
+// A coarser tier is selected if its resolution still fits the step of the query.
+//
+// Segment files are read without holding h.mu, so long queries don't delay snapshots, the current segment
+// is read up to its size at the moment the pending bucket is copied.
+func (h *Store) Query(q Query) ([]Point, time.Duration, error) {
+	if !h.enabled {
+		return nil, 0, ErrDisabled
+	}
+
+	k := key{q.Upstream, q.UPS, q.Variable}
+
+	h.mu.Lock()
+
+	t := h.selectTier(q.From, q.Step)
+
+	segments, err := t.segments()
+	if err != nil {
+		h.mu.Unlock()
+
+		return nil, 0, errors.Wrap(err, "list segments fail")
+	}
+
+	current, currentSize := t.fileStart, int64(-1)
+	if t.file != nil {
+		fi, err := t.file.Stat()
+		if err != nil {
+			h.mu.Unlock()
+
+			return nil, 0, errors.Wrap(err, "stat segment fail")
+		}
+
+		currentSize = fi.Size()
+	}
+
+	var pending *bucket
+	if b, ok := t.buckets[k]; ok {
+		copied := *b
+		pending = &copied
+	}
+
+	h.mu.Unlock()
+
+	step := q.Step
+	if step < t.resolution {
+		step = t.resolution
+	}
+
+	// points are averaged over the step, averages of the same bucket written before a restart are merged too
+	type sum struct {
+		sum   float64
+		count int
+	}
+	sums := make(map[int64]*sum)
+
+	add := func(ts time.Time, value float64) {
+		if ts.Before(q.From) || ts.After(q.To) {
+			return
+		}
+
+		start := ts.Truncate(step).Unix()
+		s, ok := sums[start]
+		if !ok {
+			s = &sum{}
+			sums[start] = s
+		}
+
+		s.sum += value
+		s.count++
+	}
+
+	for _, start := range segments {
+		if start.After(q.To) || !start.Add(t.segment).After(q.From) {
+			continue
+		}
+
+		limit := int64(-1)
+		if currentSize >= 0 && start.Equal(current) {
+			limit = currentSize
+		}
+
+		err := t.scan(start, limit, k, add)
+		if errors.Is(err, os.ErrNotExist) {
+			// the segment is pruned after listing
+			continue
+		}
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "read segment %d fail", start.Unix())
+		}
+	}
+
+	if pending != nil {
+		add(pending.start, pending.value())
+	}
+
+	points := make([]Point, 0, len(sums))
+	for start, s := range sums {
+		points = append(points, Point{
+			Time:  time.Unix(start, 0).UTC(),
+			Value: s.sum / float64(s.count),
+		})
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+
+	return points, step, nil
+}
+
+// selectTier Returns the tier for the query starting at from with the step, h.mu must be held.
+func (h *Store) selectTier(from time.Time, step time.Duration) *tier {
+	var selected *tier
+
+	for _, t := range h.tiers {
+		// the resolution is the slack for ranges like "the last 24h" with the "24h" retention
+		if from.Before(time.Now().Add(-t.retention - t.resolution)) {
+			continue
+		}
+
+		if selected == nil || t.resolution <= step {
+			selected = t
+		}
+	}
+
+	if selected == nil {
+		return h.tiers[len(h.tiers)-1]
+	}
+
+	return selected
+}
+
+// add Accumulates samples of the snapshot writing averages of finished buckets.
+func (h *Store) add(s snapshot.Snapshot) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	written := false
+
+	for _, t := range h.tiers {
+		start := s.Time.Truncate(t.resolution)
+
+		var buf bytes.Buffer
+
+		for _, ups := range s.List {
+			for _, sample := range metricsNut.Samples(ups) {
+				k := key{s.Upstream, ups.Name, sample.Variable}
+
+				b, ok := t.buckets[k]
+				if ok && !b.start.Equal(start) {
+					if err := t.write(&buf, k, b); err != nil {
+						return errors.Wrap(err, "write fail")
+					}
+
+					written = true
+				}
+				if !ok || !b.start.Equal(start) {
+					b = &bucket{start: start}
+					t.buckets[k] = b
+				}
+
+				b.sum += sample.Value
+				b.count++
+			}
+		}
+
+		if err := t.flush(&buf); err != nil {
+			return errors.Wrap(err, "flush fail")
+		}
+	}
+
+	// files only grow when buckets are finished
+	if !written {
+		return nil
+	}
+
+	if err := h.prune(); err != nil {
+		return errors.Wrap(err, "prune fail")
+	}
+
+	return nil
+}
+
+// prune Deletes segments out of retention and the oldest segments of the largest tiers while
+// the total size exceeds maxSize, the current segment is never deleted. h.mu must be held.
+func (h *Store) prune() error {
+	type segment struct {
+		tier  *tier
+		start time.Time
+		size  int64
+	}
+
+	var (
+		total   int64
+		byTiers = make(map[*tier][]segment)
+		sizes   = make(map[*tier]int64)
+	)
+
+	for _, t := range h.tiers {
+		starts, err := t.segments()
+		if err != nil {
+			return errors.Wrap(err, "list segments fail")
+		}
+
+		for _, start := range starts {
+			if start.Add(t.segment).Before(time.Now().Add(-t.retention)) && !start.Equal(t.fileStart) {
+				if err := os.Remove(t.path(start)); err != nil {
+					return errors.Wrap(err, "remove fail")
+				}
+
+				continue
+			}
+
+			fi, err := os.Stat(t.path(start))
+			if err != nil {
+				return errors.Wrap(err, "stat fail")
+			}
+
+			byTiers[t] = append(byTiers[t], segment{t, start, fi.Size()})
+			sizes[t] += fi.Size()
+			total += fi.Size()
+		}
+	}
+
+	for h.maxSize > 0 && total > h.maxSize {
+		var largest *tier
+		for t, segments := range byTiers {
+			if len(segments) > 1 && (largest == nil || sizes[t] > sizes[largest]) {
+				largest = t
+			}
+		}
+		if largest == nil {
+			return nil
+		}
+
+		oldest := byTiers[largest][0]
+		if err := os.Remove(largest.path(oldest.start)); err != nil {
+			return errors.Wrap(err, "remove fail")
+		}
+
+		log.Debug().Dur("resolution", largest.resolution).Time("segment", oldest.start).Msg("history size is exceeded, the oldest segment is deleted")
+
+		byTiers[largest] = byTiers[largest][1:]
+		sizes[largest] -= oldest.size
+		total -= oldest.size
+	}
+
+	return nil
+}
+
+// write Writes the average of the bucket as the line "<unix time>\t<upstream>\t<ups>\t<variable>\t<value>",
+// lines are collected in buf and written by flush unless the bucket belongs to another segment.
+func (t *tier) write(buf *bytes.Buffer, k key, b *bucket) error {
+	if start := b.start.Truncate(t.segment); t.file == nil || !start.Equal(t.fileStart) {
+		if err := t.flush(buf); err != nil {
+			return err
+		}
+		if err := t.open(start); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteString(strconv.FormatInt(b.start.Unix(), 10))
+	buf.WriteByte('\t')
+	buf.WriteString(k.upstream)
+	buf.WriteByte('\t')
+	buf.WriteString(k.ups)
+	buf.WriteByte('\t')
+	buf.WriteString(k.variable)
+	buf.WriteByte('\t')
+	buf.WriteString(strconv.FormatFloat(b.value(), 'g', 8, 64))
+	buf.WriteByte('\n')
+
+	return nil
+}
+
+// flush Appends collected lines to the current segment file.
+func (t *tier) flush(buf *bytes.Buffer) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	if _, err := t.file.Write(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "write segment fail")
+	}
+
+	buf.Reset()
+
+	return nil
+}
+
+// open Opens the segment file starting at start for appending.
+func (t *tier) open(start time.Time) error {
+	if t.file != nil {
+		if err := t.file.Close(); err != nil {
+			return errors.Wrap(err, "close segment fail")
+		}
+
+		t.file = nil
+	}
+
+	f, err := os.OpenFile(t.path(start), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "open segment fail")
+	}
+
+	t.file, t.fileStart = f, start
+
+	return nil
+}
+
+// segments Returns starts of segment files sorted from the oldest.
+func (t *tier) segments() ([]time.Time, error) {
+	files, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read directory fail")
+	}
+
+	var res []time.Time
+
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		unix, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		res = append(res, time.Unix(unix, 0))
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Before(res[j])
+	})
+
+	return res, nil
+}
+
+// scan Passes averages of the variable from the segment to fn, malformed lines are skipped.
+// Only first limit bytes of the segment are read unless limit is negative.
+func (t *tier) scan(start time.Time, limit int64, k key, fn func(ts time.Time, value float64)) error {
+	f, err := os.Open(t.path(start))
+	if err != nil {
+		return errors.Wrap(err, "open fail")
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 5 || fields[1] != k.upstream || fields[2] != k.ups || fields[3] != k.variable {
+			continue
+		}
+
+		unix, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			continue
+		}
+
+		fn(time.Unix(unix, 0), value)
+	}
+
+	if err := s.Err(); err != nil {
+		return errors.Wrap(err, "scan fail")
+	}
+
+	return nil
+}
+
+func (t *tier) path(start time.Time) string {
+	return filepath.Join(t.dir, strconv.FormatInt(start.Unix(), 10)+segmentExt)
+}
@@ -0,0 +1,216 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+func testSnapshot(t time.Time, charge int64) snapshot.Snapshot {
+	return snapshot.Snapshot{
+		Upstream: "main",
+		Time:     t,
+		List: []*nut_client.UPS{{
+			Name: "ups",
+			Variables: []nut_client.Variable{
+				{Name: "battery.charge", Value: charge, Type: "INTEGER"},
+				{Name: "ups.model", Value: "Smart-UPS", Type: "STRING"},
+			},
+		}},
+	}
+}
+
+func TestStore(t *testing.T) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	tiers := []Tier{
+		{Resolution: "1h", Retention: "720h"},
+		{Resolution: "1m", Retention: "24h"},
+	}
+
+	query := func(from, to time.Time, step time.Duration) Query {
+		return Query{Upstream: "main", UPS: "ups", Variable: "battery.charge", From: from, To: to, Step: step}
+	}
+
+	t.Run("downsampling", func(t *testing.T) {
+		h, err := New(true, t.TempDir(), 0, tiers, snapshot.New())
+		require.NoError(t, err)
+
+		// two samples per minute for 3 minutes
+		for i := 0; i < 6; i++ {
+			require.NoError(t, h.add(testSnapshot(base.Add(time.Duration(i)*30*time.Second), int64(90+i))))
+		}
+
+		points, step, err := h.Query(query(base, base.Add(time.Hour), 0))
+		require.NoError(t, err)
+		require.Equal(t, time.Minute, step)
+		require.Equal(t, []Point{
+			{Time: base.UTC(), Value: 90.5},
+			{Time: base.Add(time.Minute).UTC(), Value: 92.5},
+			{Time: base.Add(2 * time.Minute).UTC(), Value: 94.5},
+		}, points)
+
+		points, step, err = h.Query(query(base, base.Add(time.Hour), 2*time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, 2*time.Minute, step)
+		require.Equal(t, []Point{
+			{Time: base.UTC(), Value: 91.5},
+			{Time: base.Add(2 * time.Minute).UTC(), Value: 94.5},
+		}, points)
+
+		// the coarse tier is used if the step fits it, its bucket is still pending
+		points, step, err = h.Query(query(base, base.Add(time.Hour), time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, time.Hour, step)
+		require.Equal(t, []Point{{Time: base.UTC(), Value: 92.5}}, points)
+
+		// ranges out of the retention of the fine tier are read from the coarse tier
+		_, step, err = h.Query(query(base.Add(-48*time.Hour), base.Add(time.Hour), 0))
+		require.NoError(t, err)
+		require.Equal(t, time.Hour, step)
+
+		points, _, err = h.Query(query(base.Add(time.Minute), base.Add(time.Minute), 0))
+		require.NoError(t, err)
+		require.Len(t, points, 1)
+	})
+	t.Run("persistence", func(t *testing.T) {
+		dir := t.TempDir()
+
+		h, err := New(true, dir, 0, tiers, snapshot.New())
+		require.NoError(t, err)
+
+		require.NoError(t, h.add(testSnapshot(base, 80)))
+		require.NoError(t, h.add(testSnapshot(base.Add(time.Minute), 90)))
+		require.NoError(t, h.Close())
+
+		h, err = New(true, dir, 0, tiers, snapshot.New())
+		require.NoError(t, err)
+
+		points, _, err := h.Query(query(base, base.Add(time.Hour), 0))
+		require.NoError(t, err)
+		require.Equal(t, []Point{
+			{Time: base.UTC(), Value: 80},
+			{Time: base.Add(time.Minute).UTC(), Value: 90},
+		}, points)
+
+		points, _, err = h.Query(query(base, base.Add(time.Hour), time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []Point{{Time: base.UTC(), Value: 85}}, points)
+	})
+	t.Run("retention", func(t *testing.T) {
+		dir := t.TempDir()
+
+		h, err := New(true, dir, 0, []Tier{{Resolution: "1m", Retention: "1h"}}, snapshot.New())
+		require.NoError(t, err)
+
+		old := time.Now().Add(-3 * time.Hour)
+		require.NoError(t, h.add(testSnapshot(old, 50)))
+		require.NoError(t, h.add(testSnapshot(old.Add(time.Minute), 50)))
+		require.NoError(t, h.add(testSnapshot(time.Now(), 60)))
+		require.NoError(t, h.add(testSnapshot(time.Now().Add(time.Minute), 60)))
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, "60"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		require.Equal(t, h.tiers[0].path(h.tiers[0].fileStart), filepath.Join(dir, "60", files[0].Name()))
+
+		points, _, err := h.Query(query(old.Add(-time.Minute), time.Now().Add(time.Hour), 0))
+		require.NoError(t, err)
+		require.Len(t, points, 2)
+		require.Equal(t, float64(60), points[0].Value)
+	})
+	t.Run("max size", func(t *testing.T) {
+		dir := t.TempDir()
+
+		h, err := New(true, dir, 100, []Tier{{Resolution: "1m", Retention: "10h"}}, snapshot.New())
+		require.NoError(t, err)
+
+		for i := 0; i < 5; i++ {
+			ts := base.Add(-4 * time.Hour).Add(time.Duration(i) * time.Hour)
+			require.NoError(t, h.add(testSnapshot(ts, 50)))
+			require.NoError(t, h.add(testSnapshot(ts.Add(time.Minute), 50)))
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, "60"))
+		require.NoError(t, err)
+
+		var size int64
+		for _, fi := range files {
+			size += fi.Size()
+		}
+		require.LessOrEqual(t, size, int64(100))
+		require.Less(t, len(files), 5)
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		h, err := New(true, t.TempDir(), 0, []Tier{{Resolution: "1m", Retention: "24h"}}, snapshot.New())
+		require.NoError(t, err)
+
+		start := time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+		done := make(chan error, 1)
+
+		// snapshots are added while the history is queried, points never have partially written values
+		go func() {
+			for i := 0; i < 240; i++ {
+				if err := h.add(testSnapshot(start.Add(time.Duration(i)*30*time.Second), 50)); err != nil {
+					done <- err
+
+					return
+				}
+			}
+
+			done <- nil
+		}()
+
+		for finished := false; !finished; {
+			select {
+			case err := <-done:
+				require.NoError(t, err)
+
+				finished = true
+			default:
+			}
+
+			points, _, err := h.Query(query(start, start.Add(3*time.Hour), 0))
+			require.NoError(t, err)
+
+			for _, p := range points {
+				require.Equal(t, float64(50), p.Value)
+			}
+		}
+
+		points, _, err := h.Query(query(start, start.Add(3*time.Hour), 0))
+		require.NoError(t, err)
+		require.Len(t, points, 120)
+	})
+	t.Run("pruned segment", func(t *testing.T) {
+		h, err := New(true, t.TempDir(), 0, []Tier{{Resolution: "1m", Retention: "1h"}}, snapshot.New())
+		require.NoError(t, err)
+
+		err = h.tiers[0].scan(base, -1, key{"main", "ups", "battery.charge"}, func(time.Time, float64) {})
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		h, err := New(false, "", 0, nil, snapshot.New())
+		require.NoError(t, err)
+
+		_, _, err = h.Query(query(base, base, 0))
+		require.ErrorIs(t, err, ErrDisabled)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, tiers := range [][]Tier{
+			nil,
+			{{Resolution: "500ms", Retention: "1h"}},
+			{{Resolution: "1h", Retention: "1m"}},
+			{{Resolution: "1m", Retention: "1h"}, {Resolution: "60s", Retention: "2h"}},
+		} {
+			_, err := New(true, t.TempDir(), 0, tiers, snapshot.New())
+			require.Error(t, err)
+		}
+	})
+}
@@ -2,140 +2,309 @@ package nut
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
+	"regexp"
+	"sync"
 	"time"
 
 	nut_client "github.com/andreyAKor/nut_client"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
 const timeout = 1
 
+// namePattern matches names of UPSes, variables and instant commands, they're NUT tokens.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var _ io.Closer = (*Client)(nil)
+
 type Client struct {
 	host     string
 	port     int
 	username string
 	password string
-}
 
-func New(host string, port int, username, password string) (*Client, error) {
-	return &Client{
-		host:     host,
-		port:     port,
-		username: username,
-		password: password,
-	}, nil
+	// STARTTLS is sent if tlsConfig is set
+	tlsConfig  *tls.Config
+	requireTLS bool
+
+	pool *pool
+
+	// UPS metadata is refreshed after this interval or when the set of UPS variables is changed
+	metadataRefreshInterval time.Duration
+
+	mu       sync.Mutex
+	metadata map[string]*metadata
 }
 
-// GetUPSList Returns a list of all UPSes provided by this NUT instance.
-func (c *Client) GetUPSList(ctx context.Context) ([]*nut_client.UPS, error) {
-	client, err := c.connect(ctx)
-	if err != nil {
-		return nil, errors.Wrap(err, "connect fail")
+func New(
+	host string,
+	port int,
+	username, password string,
+	poolSize int,
+	idleTimeout, healthCheckInterval, metadataRefreshInterval string,
+	tlsSettings TLS,
+) (*Client, error) {
+	if poolSize < 1 {
+		return nil, errors.Errorf("pool size must be positive (%d)", poolSize)
 	}
 
-	list, err := client.GetUPSList()
+	idleTimeoutDur, err := time.ParseDuration(idleTimeout)
 	if err != nil {
-		return nil, errors.Wrap(err, "get UPS list fail")
+		return nil, errors.Wrapf(err, "idle timeout parsing fail (%s)", idleTimeout)
 	}
 
-	if err := c.disconnect(client); err != nil {
-		return nil, errors.Wrap(err, "disconnect fail")
+	healthCheckIntervalDur, err := time.ParseDuration(healthCheckInterval)
+	if err != nil {
+		return nil, errors.Wrapf(err, "health check interval parsing fail (%s)", healthCheckInterval)
 	}
 
-	return list, nil
-}
-
-// SendCommand Sends a command to the UPS.
-func (c *Client) SendCommand(ctx context.Context, name, command string) error {
-	client, err := c.connect(ctx)
+	metadataRefreshIntervalDur, err := time.ParseDuration(metadataRefreshInterval)
 	if err != nil {
-		return errors.Wrap(err, "connect fail")
+		return nil, errors.Wrapf(err, "metadata refresh interval parsing fail (%s)", metadataRefreshInterval)
 	}
 
-	list, err := client.GetUPSList()
+	tlsConfig, err := tlsSettings.config(host)
 	if err != nil {
-		return errors.Wrap(err, "get UPS list fail")
+		return nil, errors.Wrap(err, "TLS init fail")
+	}
+
+	c := &Client{
+		host:                    host,
+		port:                    port,
+		username:                username,
+		password:                password,
+		tlsConfig:               tlsConfig,
+		requireTLS:              tlsSettings.Required,
+		metadataRefreshInterval: metadataRefreshIntervalDur,
+		metadata:                make(map[string]*metadata),
 	}
-	for _, ups := range list {
-		if ups.Name == name {
-			ok, err := ups.SendCommand(command)
+	c.pool = newPool(c.connect, poolSize, idleTimeoutDur, healthCheckIntervalDur)
+
+	return c, nil
+}
+
+// Close Logs out of all idle NUT sessions.
+func (c *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*timeout)
+	defer cancel()
+
+	c.pool.close(ctx)
+
+	return nil
+}
+
+// GetUPSList Returns a list of all UPSes provided by this NUT instance.
+//
+// Only variable values are read on every call, descriptions, types and commands are taken from
+// the metadata cache.
+func (c *Client) GetUPSList(ctx context.Context) ([]*nut_client.UPS, error) {
+	var list []*nut_client.UPS
+
+	err := c.do(ctx, true, func(s *session) error {
+		names, err := s.upsNames(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get UPS names fail")
+		}
+
+		list = make([]*nut_client.UPS, 0, len(names))
+		for _, name := range names {
+			vars, err := s.variables(ctx, name)
 			if err != nil {
-				return errors.Wrapf(err, `send command "%s" to UPS "%s" has failed`, name, command)
+				return errors.Wrapf(err, `get variables of UPS "%s" fail`, name)
 			}
-			if !ok {
-				return errors.Wrapf(err, `send command "%s" to UPS "%s" is error`, name, command)
+
+			meta := c.cachedMetadata(name, vars)
+			if meta == nil {
+				if meta, err = s.metadata(ctx, name, vars); err != nil {
+					return errors.Wrapf(err, `get metadata of UPS "%s" fail`, name)
+				}
+
+				c.setMetadata(name, meta)
 			}
+
+			list = append(list, buildUPS(name, meta, vars))
 		}
+
+		c.pruneMetadata(names)
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get UPS list fail")
 	}
 
-	if err := c.disconnect(client); err != nil {
-		return errors.Wrap(err, "disconnect fail")
+	return list, nil
+}
+
+// SendCommand Sends a command to the UPS.
+//
+// Names which aren't NUT tokens are rejected by ErrInvalidValue, otherwise the error is classified
+// by ErrUnknownUPS, ErrUnknownCommand, ErrAccessDenied etc.
+func (c *Client) SendCommand(ctx context.Context, name, command string) error {
+	if !ValidName(name) || !ValidName(command) {
+		return errors.Wrapf(ErrInvalidValue, `send command "%s" to UPS "%s" has failed`, command, name)
 	}
 
-	return nil
+	return c.do(ctx, false, func(s *session) error {
+		if _, err := s.get(ctx, "INSTCMD", name, command); err != nil {
+			return errors.Wrapf(err, `send command "%s" to UPS "%s" has failed`, command, name)
+		}
+
+		return nil
+	})
 }
 
 // SetVariable Sets the given variableName to the given value on the UPS.
+//
+// Names are checked to be NUT tokens and the value is validated by the cached constraint of the variable
+// before it's sent to upsd. The error is classified by ErrUnknownUPS, ErrUnknownVariable, ErrReadOnly, ErrInvalidValue etc.
 func (c *Client) SetVariable(ctx context.Context, name, variableName, value string) error {
-	client, err := c.connect(ctx)
-	if err != nil {
-		return errors.Wrap(err, "connect fail")
+	if !ValidName(name) || !ValidName(variableName) {
+		return errors.Wrapf(ErrInvalidValue, `set variable "%s" to UPS "%s" has failed`, variableName, name)
 	}
 
-	list, err := client.GetUPSList()
-	if err != nil {
-		return errors.Wrap(err, "get UPS list fail")
+	if constraint, ok := c.Constraint(name, variableName); ok {
+		if err := constraint.Validate(value); err != nil {
+			return errors.Wrapf(err, `set variable "%s" to UPS "%s" with value "%s" has failed`, variableName, name, value)
+		}
 	}
-	for _, ups := range list {
-		if ups.Name == name {
-			ok, err := ups.SetVariable(variableName, value)
-			if err != nil {
-				return errors.Wrapf(err, `set variable "%s" to UPS "%s" with value "%s" has failed`, variableName, name, value)
-			}
-			if !ok {
-				return errors.Wrapf(err, `set variable "%s" to UPS "%s" with value "%s" is error`, variableName, name, value)
-			}
+
+	return c.do(ctx, false, func(s *session) error {
+		if _, err := s.get(ctx, "SET", "VAR", name, variableName, quote(value)); err != nil {
+			return errors.Wrapf(err, `set variable "%s" to UPS "%s" with value "%s" has failed`, variableName, name, value)
 		}
+
+		return nil
+	})
+}
+
+// ForceShutdown Sets the forced shutdown flag on the UPS like nut_client.UPS.ForceShutdown does,
+// upsd allows it only to users with the FSD action or upsmon primary.
+func (c *Client) ForceShutdown(ctx context.Context, name string) error {
+	if !ValidName(name) {
+		return errors.Wrapf(ErrInvalidValue, `force shutdown of UPS "%s" has failed`, name)
 	}
 
-	if err := c.disconnect(client); err != nil {
-		return errors.Wrap(err, "disconnect fail")
+	return c.do(ctx, false, func(s *session) error {
+		if _, err := s.get(ctx, "FSD", name); err != nil {
+			return errors.Wrapf(err, `force shutdown of UPS "%s" has failed`, name)
+		}
+
+		return nil
+	})
+}
+
+// Constraint Returns the constraint of the UPS variable, it's known after the UPS metadata is read by GetUPSList.
+func (c *Client) Constraint(name, variableName string) (Constraint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, ok := c.metadata[name]
+	if !ok {
+		return Constraint{}, false
 	}
 
-	return nil
+	vm, ok := m.variables[variableName]
+
+	return vm.constraint, ok
 }
 
-// connect Connecting to NUT.
-func (c *Client) connect(ctx context.Context) (*nut_client.Client, error) {
-	ctx, _ = context.WithTimeout(ctx, time.Second*timeout)
+// cachedMetadata Returns the cached metadata of the UPS if it's still actual for the variables.
+func (c *Client) cachedMetadata(name string, vars []rawVariable) *metadata {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	client, err := nut_client.NewClient(ctx, c.host, c.port)
-	if err != nil {
-		return nil, errors.Wrap(err, "connect fail")
+	m, ok := c.metadata[name]
+	if !ok || time.Since(m.time) >= c.metadataRefreshInterval || !m.covers(vars) {
+		return nil
+	}
+
+	return m
+}
+
+// setMetadata Caches the metadata of the UPS.
+func (c *Client) setMetadata(name string, m *metadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.metadata[name] = m
+}
+
+// pruneMetadata Drops the cached metadata of UPSes which are gone.
+func (c *Client) pruneMetadata(names []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	actual := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		actual[name] = struct{}{}
 	}
 
-	if len(c.username) > 0 || len(c.password) > 0 {
-		ok, err := client.Authenticate(c.username, c.password)
+	for name := range c.metadata {
+		if _, ok := actual[name]; !ok {
+			delete(c.metadata, name)
+		}
+	}
+}
+
+// ValidName Checks that the name of the UPS, variable or instant command is the NUT token,
+// so it's sent as a single argument of the command.
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// do Runs fn with a pooled session.
+//
+// The idempotent fn is retried once with a new session if the pooled one turned out to be broken,
+// otherwise the session is checked by ping before running fn so a write isn't sent twice.
+// Errors which aren't returned by upsd are classified as ErrUnavailable, except invalid arguments which
+// aren't sent at all.
+func (c *Client) do(ctx context.Context, idempotent bool, fn func(s *session) error) error {
+	for attempt := 0; ; attempt++ {
+		s, err := c.pool.get(ctx)
 		if err != nil {
-			return nil, errors.Wrap(err, "authenticate fail")
+			return &unavailableError{errors.Wrap(err, "get session fail")}
 		}
-		if !ok {
-			return nil, errors.Wrap(err, "authenticate error")
+
+		if !idempotent {
+			if err := s.ping(ctx); err != nil {
+				c.pool.put(s, true)
+
+				if attempt == 0 {
+					continue
+				}
+
+				return &unavailableError{errors.Wrap(err, "ping fail")}
+			}
 		}
-	}
 
-	return client, nil
+		err = fn(s)
+
+		broken := err != nil && !isResponseError(err) && !errors.Is(err, ErrInvalidValue)
+		c.pool.put(s, broken)
+
+		if broken && idempotent && attempt == 0 {
+			log.Debug().Err(err).Msg("NUT session is broken, reconnecting")
+
+			continue
+		}
+		if broken {
+			return &unavailableError{err}
+		}
+
+		return err
+	}
 }
 
-// disconnect Gracefully disconnects from NUT by sending the LOGOUT command.
-func (c *Client) disconnect(client *nut_client.Client) error {
-	ok, err := client.Disconnect()
+// connect Connecting to NUT.
+func (c *Client) connect(ctx context.Context) (*session, error) {
+	s, err := dial(ctx, c.host, c.port, c.username, c.password, time.Second*timeout, c.tlsConfig, c.requireTLS)
 	if err != nil {
-		return errors.Wrap(err, "disconnect fail")
-	}
-	if !ok {
-		return errors.Wrap(err, "disconnect error")
+		return nil, errors.Wrap(err, "connect fail")
 	}
 
-	return nil
+	return s, nil
 }
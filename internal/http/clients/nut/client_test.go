@@ -0,0 +1,405 @@
+package nut
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUpsd is the minimal upsd serving a single UPS "ups".
+type fakeUpsd struct {
+	listener net.Listener
+
+	// STARTTLS is supported if it's set
+	tlsConfig *tls.Config
+
+	mu          sync.Mutex
+	connections int
+	commands    []string
+}
+
+func newFakeUpsd(t *testing.T) *fakeUpsd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f := &fakeUpsd{listener: l}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			f.mu.Lock()
+			f.connections++
+			f.mu.Unlock()
+
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeUpsd) port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeUpsd) count(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var n int
+
+	for _, cmd := range f.commands {
+		if strings.HasPrefix(cmd, prefix) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (f *fakeUpsd) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.TrimSuffix(line, "\n")
+
+		f.mu.Lock()
+		f.commands = append(f.commands, cmd)
+		f.mu.Unlock()
+
+		if cmd == "STARTTLS" && f.tlsConfig != nil {
+			if _, err := conn.Write([]byte("OK STARTTLS\n")); err != nil {
+				return
+			}
+
+			conn = tls.Server(conn, f.tlsConfig)
+			r = bufio.NewReader(conn)
+
+			continue
+		}
+
+		if _, err := conn.Write([]byte(strings.Join(f.respond(cmd), "\n") + "\n")); err != nil {
+			return
+		}
+		if cmd == "LOGOUT" {
+			return
+		}
+	}
+}
+
+//nolint:cyclop
+func (f *fakeUpsd) respond(cmd string) []string {
+	list := func(lines ...string) []string {
+		return append(append([]string{"BEGIN " + cmd}, lines...), "END "+cmd)
+	}
+
+	switch {
+	case cmd == "VER":
+		return []string{"Network UPS Tools upsd 2.7.4"}
+	case cmd == "LOGOUT":
+		return []string{"OK Goodbye"}
+	case cmd == "STARTTLS":
+		return []string{"ERR FEATURE-NOT-CONFIGURED"}
+	case strings.HasPrefix(cmd, "USERNAME "), strings.HasPrefix(cmd, "PASSWORD "):
+		return []string{"OK"}
+	case cmd == "LIST UPS":
+		return list(`UPS ups "Main UPS"`)
+	case cmd == "LIST CLIENT ups":
+		return list("CLIENT ups 127.0.0.1")
+	case cmd == "LIST CMD ups":
+		return list("CMD ups beeper.toggle")
+	case cmd == "LIST VAR ups":
+		return list(
+			`VAR ups battery.charge "100"`,
+			`VAR ups ups.status "OL CHRG"`,
+			`VAR ups ups.beeper.status "enabled"`,
+			`VAR ups ups.id "myups"`,
+			`VAR ups input.transfer.low "103"`,
+			`VAR ups ups.delay.shutdown "20"`,
+		)
+	case cmd == "LIST RW ups":
+		return list(`RW ups ups.id "myups"`, `RW ups input.transfer.low "103"`, `RW ups ups.delay.shutdown "20"`)
+	case cmd == "LIST ENUM ups input.transfer.low":
+		return list(`ENUM ups input.transfer.low "103"`, `ENUM ups input.transfer.low "106"`)
+	case cmd == "LIST RANGE ups ups.delay.shutdown":
+		return list(`RANGE ups ups.delay.shutdown "0" "120"`, `RANGE ups ups.delay.shutdown "300" "600"`)
+	case cmd == "GET UPSDESC ups":
+		return []string{`UPSDESC ups "Main UPS"`}
+	case cmd == "GET NUMLOGINS ups":
+		return []string{"NUMLOGINS ups 1"}
+	case strings.HasPrefix(cmd, "GET CMDDESC ups "):
+		return []string{strings.TrimPrefix(cmd, "GET ") + ` "Description"`}
+	case strings.HasPrefix(cmd, "GET DESC ups "):
+		return []string{strings.TrimPrefix(cmd, "GET ") + ` "Description"`}
+	case cmd == "GET TYPE ups ups.id":
+		return []string{"TYPE ups ups.id RW STRING:8"}
+	case cmd == "GET TYPE ups input.transfer.low":
+		return []string{"TYPE ups input.transfer.low RW ENUM"}
+	case cmd == "GET TYPE ups ups.delay.shutdown":
+		return []string{"TYPE ups ups.delay.shutdown RW RANGE"}
+	case strings.HasPrefix(cmd, "GET TYPE ups "):
+		return []string{strings.TrimPrefix(cmd, "GET ") + " NUMBER"}
+	case cmd == "INSTCMD ups beeper.toggle":
+		return []string{"OK"}
+	case strings.HasPrefix(cmd, "INSTCMD ups "):
+		return []string{"ERR CMD-NOT-SUPPORTED"}
+	case strings.HasPrefix(cmd, "SET VAR ups ups.id "),
+		strings.HasPrefix(cmd, "SET VAR ups input.transfer.low "),
+		strings.HasPrefix(cmd, "SET VAR ups ups.delay.shutdown "):
+		return []string{"OK"}
+	case strings.HasPrefix(cmd, "SET VAR ups "):
+		return []string{"ERR READONLY"}
+	case strings.HasPrefix(cmd, "INSTCMD "), strings.HasPrefix(cmd, "SET VAR "):
+		return []string{"ERR UNKNOWN-UPS"}
+	}
+
+	return []string{"ERR UNKNOWN-COMMAND"}
+}
+
+func TestGetUPSList(t *testing.T) {
+	f := newFakeUpsd(t)
+
+	c, err := New("127.0.0.1", f.port(), "user", "password", 1, "1m", "1m", "1h", TLS{})
+	require.NoError(t, err)
+
+	t.Run("variables", func(t *testing.T) {
+		list, err := c.GetUPSList(context.Background())
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+
+		ups := list[0]
+		require.Equal(t, "ups", ups.Name)
+		require.Equal(t, "Main UPS", ups.Description)
+		require.Equal(t, []string{"127.0.0.1"}, ups.Clients)
+		require.Len(t, ups.Commands, 1)
+		require.Len(t, ups.Variables, 6)
+		require.Equal(t, int64(100), ups.Variables[0].Value)
+		require.Equal(t, "INTEGER", ups.Variables[0].Type)
+		require.Equal(t, "OL CHRG", ups.Variables[1].Value)
+		require.Equal(t, "STRING", ups.Variables[1].Type)
+		require.Equal(t, true, ups.Variables[2].Value)
+		require.Equal(t, "BOOLEAN", ups.Variables[2].Type)
+	})
+
+	t.Run("session reused", func(t *testing.T) {
+		_, err := c.GetUPSList(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, c.SendCommand(context.Background(), "ups", "beeper.toggle"))
+
+		f.mu.Lock()
+		require.Equal(t, 1, f.connections)
+		f.mu.Unlock()
+		require.Equal(t, 1, f.count("USERNAME "))
+	})
+
+	t.Run("metadata cached", func(t *testing.T) {
+		_, err := c.GetUPSList(context.Background())
+		require.NoError(t, err)
+
+		require.Equal(t, 3, f.count("LIST VAR "))
+		require.Equal(t, 6, f.count("GET DESC "))
+		require.Equal(t, 6, f.count("GET TYPE "))
+		require.Equal(t, 1, f.count("LIST RW "))
+		require.Equal(t, 1, f.count("LIST ENUM "))
+		require.Equal(t, 1, f.count("LIST RANGE "))
+		require.Equal(t, 1, f.count("GET CMDDESC "))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		ctx := context.Background()
+
+		require.ErrorIs(t, c.SendCommand(ctx, "typo", "beeper.toggle"), ErrUnknownUPS)
+		require.ErrorIs(t, c.SendCommand(ctx, "ups", "typo"), ErrUnknownCommand)
+		require.ErrorIs(t, c.SetVariable(ctx, "typo", "ups.id", "1"), ErrUnknownUPS)
+		require.ErrorIs(t, c.SetVariable(ctx, "ups", "battery.charge", "1"), ErrReadOnly)
+
+		f.mu.Lock()
+		require.Equal(t, 1, f.connections)
+		f.mu.Unlock()
+	})
+
+	t.Run("injection", func(t *testing.T) {
+		ctx := context.Background()
+
+		require.ErrorIs(t, c.SendCommand(ctx, "ups", "beeper.toggle\nINSTCMD ups shutdown.return"), ErrInvalidValue)
+		require.ErrorIs(t, c.SendCommand(ctx, "ups shutdown.return", "beeper.toggle"), ErrInvalidValue)
+		require.ErrorIs(t, c.SetVariable(ctx, "ups", "ups.id", "rack\r\nFSD ups"), ErrInvalidValue)
+
+		// nothing is sent and the session isn't dropped
+		require.Equal(t, 0, f.count("INSTCMD ups shutdown.return"))
+		require.Equal(t, 0, f.count("FSD "))
+
+		f.mu.Lock()
+		require.Equal(t, 1, f.connections)
+		f.mu.Unlock()
+	})
+
+	t.Run("constraints", func(t *testing.T) {
+		ctx := context.Background()
+
+		constraint, ok := c.Constraint("ups", "input.transfer.low")
+		require.True(t, ok)
+		require.Equal(t, []string{"103", "106"}, constraint.Enum)
+
+		constraint, ok = c.Constraint("ups", "ups.delay.shutdown")
+		require.True(t, ok)
+		require.Equal(t, []Range{{Min: 0, Max: 120}, {Min: 300, Max: 600}}, constraint.Ranges)
+
+		sets := f.count("SET VAR ")
+
+		require.ErrorIs(t, c.SetVariable(ctx, "ups", "ups.id", "too long name"), ErrInvalidValue)
+		require.ErrorIs(t, c.SetVariable(ctx, "ups", "input.transfer.low", "104"), ErrInvalidValue)
+		require.ErrorIs(t, c.SetVariable(ctx, "ups", "ups.delay.shutdown", "200"), ErrInvalidValue)
+		require.ErrorIs(t, c.SetVariable(ctx, "ups", "ups.delay.shutdown", "soon"), ErrInvalidValue)
+		require.ErrorIs(t, c.SetVariable(ctx, "ups", "battery.charge", "1"), ErrReadOnly)
+
+		// invalid values aren't sent to upsd
+		require.Equal(t, sets, f.count("SET VAR "))
+
+		require.NoError(t, c.SetVariable(ctx, "ups", "ups.id", "rack"))
+		require.NoError(t, c.SetVariable(ctx, "ups", "input.transfer.low", "106"))
+		require.NoError(t, c.SetVariable(ctx, "ups", "ups.delay.shutdown", "300"))
+		require.Equal(t, sets+3, f.count("SET VAR "))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		require.NoError(t, c.Close())
+		require.Equal(t, 1, f.count("LOGOUT"))
+	})
+}
+
+func TestStartTLS(t *testing.T) {
+	t.Run("encrypted", func(t *testing.T) {
+		f := newFakeUpsd(t)
+		f.tlsConfig = &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+
+		c, err := New("127.0.0.1", f.port(), "user", "password", 1, "1m", "1m", "1h", TLS{Required: true, InsecureSkipVerify: true})
+		require.NoError(t, err)
+
+		_, err = c.GetUPSList(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, f.count("USERNAME "))
+	})
+
+	t.Run("plaintext fallback", func(t *testing.T) {
+		f := newFakeUpsd(t)
+
+		c, err := New("127.0.0.1", f.port(), "user", "password", 1, "1m", "1m", "1h", TLS{Enabled: true})
+		require.NoError(t, err)
+
+		_, err = c.GetUPSList(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, f.count("USERNAME "))
+	})
+
+	t.Run("required", func(t *testing.T) {
+		f := newFakeUpsd(t)
+
+		c, err := New("127.0.0.1", f.port(), "user", "password", 1, "1m", "1m", "1h", TLS{Required: true})
+		require.NoError(t, err)
+
+		_, err = c.GetUPSList(context.Background())
+		require.ErrorIs(t, err, ErrUnavailable)
+		require.Equal(t, 0, f.count("USERNAME "))
+	})
+}
+
+// selfSignedCert Returns the self-signed certificate of 127.0.0.1.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSplitFields(t *testing.T) {
+	require.Equal(t,
+		[]string{"VAR", "ups", "ups.status", "OL CHRG"},
+		splitFields(`VAR ups ups.status "OL CHRG"`),
+	)
+	require.Equal(t,
+		[]string{"VAR", "ups", "ups.id", `say "hi"`},
+		splitFields(`VAR ups ups.id "say \"hi\""`),
+	)
+	require.Equal(t,
+		[]string{"VAR", "ups", "ups.id", ""},
+		splitFields(`VAR ups ups.id ""`),
+	)
+}
+
+func TestResponseError(t *testing.T) {
+	require.NoError(t, responseError("OK"))
+	require.NoError(t, responseError(`VAR ups ups.id "ERR"`))
+
+	for line, code := range map[string]string{
+		"ERR UNKNOWN-UPS":         "UNKNOWN-UPS",
+		"ERR ACCESS-DENIED extra": "ACCESS-DENIED",
+		"ERR":                     unknownCode,
+		"ERR ":                    unknownCode,
+		"ERR\t":                   unknownCode,
+	} {
+		var e *Error
+
+		require.ErrorAs(t, responseError(line), &e, line)
+		require.Equal(t, code, e.Code, line)
+	}
+
+	require.ErrorIs(t, responseError("ERR"), ErrFailed)
+}
+
+func TestValidArg(t *testing.T) {
+	for _, arg := range []string{"ups", "beeper.toggle", "ups-1_a", `""`, quote(`say "hi" \ now`)} {
+		require.True(t, validArg(arg), arg)
+	}
+
+	for _, arg := range []string{
+		"", "beeper.enable\nINSTCMD", "ups shutdown", "ups\r", "a\tb", `say"`, `a\b`, "\x00",
+		quote("rack\nFSD ups"), `"open`, `"a"b"`, `"a\"`,
+	} {
+		require.False(t, validArg(arg), arg)
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for _, name := range []string{"ups", "beeper.toggle", "ups-1_A", "ups.delay.shutdown"} {
+		require.True(t, ValidName(name), name)
+	}
+
+	for _, name := range []string{"", "ups shutdown", "beeper.enable\nINSTCMD", "ups@main", `"ups"`, "ups\t"} {
+		require.False(t, ValidName(name), name)
+	}
+}
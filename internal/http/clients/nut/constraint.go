@@ -0,0 +1,72 @@
+package nut
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Range is the inclusive range of values of the RANGE variable.
+type Range struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// Constraint describes values accepted by the writable variable as upsd reports them by
+// GET TYPE, LIST ENUM and LIST RANGE.
+type Constraint struct {
+	Writeable bool
+
+	// Maximum length of STRING:n variables, zero if the length isn't limited
+	MaximumLength int
+
+	Numeric bool
+	Enum    []string
+	Ranges  []Range
+}
+
+// Validate Checks the value the way upsd would, the error is ErrReadOnly or ErrInvalidValue.
+func (c Constraint) Validate(value string) error {
+	if !c.Writeable {
+		return ErrReadOnly
+	}
+
+	if c.MaximumLength > 0 && len(value) > c.MaximumLength {
+		return errors.Wrapf(ErrInvalidValue, "value is longer than %d characters", c.MaximumLength)
+	}
+
+	if len(c.Enum) > 0 {
+		for _, e := range c.Enum {
+			if e == value {
+				return nil
+			}
+		}
+
+		return errors.Wrapf(ErrInvalidValue, "value %q isn't one of %s", value, strings.Join(c.Enum, ", "))
+	}
+
+	if !c.Numeric && len(c.Ranges) == 0 {
+		return nil
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidValue, "value %q isn't a number", value)
+	}
+
+	if len(c.Ranges) == 0 {
+		return nil
+	}
+
+	ranges := make([]string, 0, len(c.Ranges))
+	for _, r := range c.Ranges {
+		if number >= r.Min && number <= r.Max {
+			return nil
+		}
+
+		ranges = append(ranges, strconv.FormatFloat(r.Min, 'f', -1, 64)+".."+strconv.FormatFloat(r.Max, 'f', -1, 64))
+	}
+
+	return errors.Wrapf(ErrInvalidValue, "value %s is out of %s", value, strings.Join(ranges, ", "))
+}
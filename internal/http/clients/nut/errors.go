@@ -0,0 +1,109 @@
+package nut
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnknownUPS      = errors.New("unknown UPS")
+	ErrUnknownCommand  = errors.New("unknown command")
+	ErrUnknownVariable = errors.New("unknown variable")
+	ErrReadOnly        = errors.New("variable is not writable")
+	ErrAccessDenied    = errors.New("access denied")
+	ErrInvalidValue    = errors.New("value is invalid or out of range")
+	ErrFailed          = errors.New("upsd failed to execute the request")
+	ErrUnavailable     = errors.New("upsd is unavailable")
+)
+
+// unknownCode is the code of the error response without the code, e.g. "ERR" of a broken upsd.
+const unknownCode = "UNKNOWN"
+
+// errorKinds maps NUT error codes to errors they are classified as.
+var errorKinds = map[string]error{
+	"UNKNOWN-UPS":          ErrUnknownUPS,
+	"CMD-NOT-SUPPORTED":    ErrUnknownCommand,
+	"VAR-NOT-SUPPORTED":    ErrUnknownVariable,
+	"READONLY":             ErrReadOnly,
+	"ACCESS-DENIED":        ErrAccessDenied,
+	"USERNAME-REQUIRED":    ErrAccessDenied,
+	"PASSWORD-REQUIRED":    ErrAccessDenied,
+	"INVALID-USERNAME":     ErrAccessDenied,
+	"INVALID-PASSWORD":     ErrAccessDenied,
+	"INVALID-VALUE":        ErrInvalidValue,
+	"TOO-LONG":             ErrInvalidValue,
+	"INVALID-ARGUMENT":     ErrInvalidValue,
+	"INSTCMD-FAILED":       ErrFailed,
+	"SET-FAILED":           ErrFailed,
+	"DRIVER-NOT-CONNECTED": ErrFailed,
+	"DATA-STALE":           ErrFailed,
+}
+
+// errorDescriptions are short descriptions of NUT error codes, see nut_client/errors.go.
+var errorDescriptions = map[string]string{
+	"ACCESS-DENIED":          "the authentication details are not sufficient to execute the requested command",
+	"UNKNOWN-UPS":            "the UPS is not known to upsd",
+	"VAR-NOT-SUPPORTED":      "the UPS doesn't support the variable",
+	"CMD-NOT-SUPPORTED":      "the UPS doesn't support the instant command",
+	"INVALID-ARGUMENT":       "the argument is not recognized or is invalid in this context",
+	"INSTCMD-FAILED":         "upsd failed to deliver the instant command to the driver",
+	"SET-FAILED":             "upsd failed to deliver the set request to the driver",
+	"READONLY":               "the variable is not writable",
+	"TOO-LONG":               "the value is too long",
+	"FEATURE-NOT-SUPPORTED":  "upsd doesn't support the requested feature",
+	"FEATURE-NOT-CONFIGURED": "upsd isn't configured to allow the requested feature",
+	"ALREADY-SSL-MODE":       "TLS is already enabled on this connection",
+	"DRIVER-NOT-CONNECTED":   "the driver of the UPS is not connected",
+	"DATA-STALE":             "the driver isn't providing regular updates",
+	"ALREADY-LOGGED-IN":      "the client already logged in",
+	"INVALID-PASSWORD":       "the password is invalid",
+	"ALREADY-SET-PASSWORD":   "the password is already set",
+	"INVALID-USERNAME":       "the username is invalid",
+	"ALREADY-SET-USERNAME":   "the username is already set",
+	"USERNAME-REQUIRED":      "the command requires a username",
+	"PASSWORD-REQUIRED":      "the command requires a password",
+	"UNKNOWN-COMMAND":        "upsd doesn't recognize the command",
+	"INVALID-VALUE":          "the value is not valid",
+	unknownCode:              "upsd returned the error without the code",
+}
+
+// Error is the error returned by upsd, e.g. "ERR UNKNOWN-UPS", the session stays usable after it.
+type Error struct {
+	Code string
+}
+
+func (e *Error) Error() string {
+	if description, ok := errorDescriptions[e.Code]; ok {
+		return fmt.Sprintf("NUT error %s: %s", e.Code, description)
+	}
+
+	return fmt.Sprintf("NUT error %s", e.Code)
+}
+
+// Is Classifies the error by its code, so errors.Is(err, ErrUnknownUPS) is true for "ERR UNKNOWN-UPS".
+func (e *Error) Is(target error) bool {
+	kind, ok := errorKinds[e.Code]
+	if !ok {
+		kind = ErrFailed
+	}
+
+	return kind == target
+}
+
+// unavailableError is the error of the connection to upsd.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
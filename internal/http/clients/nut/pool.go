@@ -0,0 +1,123 @@
+package nut
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pool Keeps a limited number of authenticated sessions to upsd for reuse.
+type pool struct {
+	dial func(ctx context.Context) (*session, error)
+
+	idleTimeout         time.Duration
+	healthCheckInterval time.Duration
+
+	// slots limits the number of simultaneously opened sessions.
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*session
+	closed bool
+}
+
+func newPool(
+	dial func(ctx context.Context) (*session, error),
+	size int,
+	idleTimeout, healthCheckInterval time.Duration,
+) *pool {
+	return &pool{
+		dial:                dial,
+		idleTimeout:         idleTimeout,
+		healthCheckInterval: healthCheckInterval,
+		slots:               make(chan struct{}, size),
+	}
+}
+
+// get Returns an idle healthy session or dials a new one if there are no idle sessions.
+// Every session received by get must be returned by put.
+func (p *pool) get(ctx context.Context) (*session, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "waiting for a free session fail")
+	}
+
+	for {
+		s := p.pop()
+		if s == nil {
+			break
+		}
+
+		idle := time.Since(s.lastUsed)
+		if idle >= p.idleTimeout {
+			_ = s.logout(ctx)
+
+			continue
+		}
+		if idle >= p.healthCheckInterval {
+			if err := s.ping(ctx); err != nil {
+				s.close()
+
+				continue
+			}
+		}
+
+		return s, nil
+	}
+
+	s, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// put Returns the session to the pool, the broken session is closed.
+func (p *pool) put(s *session, broken bool) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if broken || p.closed {
+		s.close()
+
+		return
+	}
+
+	p.idle = append(p.idle, s)
+}
+
+// pop Takes the most recently used idle session.
+func (p *pool) pop() *session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) == 0 {
+		return nil
+	}
+
+	s := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+
+	return s
+}
+
+// close Logs out of all idle sessions, sessions in use are closed when returned.
+func (p *pool) close(ctx context.Context) {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, s := range idle {
+		_ = s.logout(ctx)
+	}
+}
@@ -0,0 +1,328 @@
+package nut
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// session is a single authenticated connection to upsd.
+//
+// Unlike nut_client.Client it keeps one buffered reader for the whole life of the connection
+// and sets a deadline for every command, so it's safe to keep it open between requests.
+type session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	timeout  time.Duration
+	lastUsed time.Time
+}
+
+// dial Connecting to NUT, negotiating TLS if tlsConfig is given and authenticating the session.
+func dial(
+	ctx context.Context,
+	host string,
+	port int,
+	username, password string,
+	timeout time.Duration,
+	tlsConfig *tls.Config,
+	requireTLS bool,
+) (*session, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	d := &net.Dialer{}
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, errors.Wrap(err, "dial fail")
+	}
+
+	s := &session{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		timeout:  timeout,
+		lastUsed: time.Now(),
+	}
+
+	if tlsConfig != nil {
+		if err := s.startTLS(ctx, tlsConfig); err != nil {
+			if !isResponseError(err) || requireTLS {
+				s.close()
+
+				return nil, errors.Wrap(err, "STARTTLS fail")
+			}
+
+			log.Warn().Err(err).Str("host", host).Msg("upsd doesn't support STARTTLS, the session isn't encrypted")
+		}
+	}
+
+	if len(username) > 0 || len(password) > 0 {
+		if err := s.authenticate(ctx, username, password); err != nil {
+			s.close()
+
+			return nil, errors.Wrap(err, "authenticate fail")
+		}
+	}
+
+	return s, nil
+}
+
+// startTLS Sends the STARTTLS command and makes the TLS handshake, the session is left in plaintext
+// if upsd responds with the error.
+func (s *session) startTLS(ctx context.Context, config *tls.Config) error {
+	line, err := s.get(ctx, "STARTTLS")
+	if err != nil {
+		return err
+	}
+	if line != "OK STARTTLS" {
+		return errors.Errorf(`unexpected response "%s" for "STARTTLS"`, line)
+	}
+
+	conn := tls.Client(s.conn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return errors.Wrap(err, "TLS handshake fail")
+	}
+
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	return nil
+}
+
+// authenticate Sends the USERNAME and PASSWORD commands.
+func (s *session) authenticate(ctx context.Context, username, password string) error {
+	if _, err := s.get(ctx, "USERNAME", quote(username)); err != nil {
+		return errors.Wrap(err, "send username fail")
+	}
+	if _, err := s.get(ctx, "PASSWORD", quote(password)); err != nil {
+		return errors.Wrap(err, "send password fail")
+	}
+
+	return nil
+}
+
+// ping Checks that the session is still alive by sending the VER command.
+func (s *session) ping(ctx context.Context) error {
+	if _, err := s.get(ctx, "VER"); err != nil {
+		return errors.Wrap(err, "send ver fail")
+	}
+
+	return nil
+}
+
+// logout Gracefully disconnects from NUT by sending the LOGOUT command and closes the connection.
+func (s *session) logout(ctx context.Context) error {
+	_, err := s.get(ctx, "LOGOUT")
+	s.close()
+
+	if err != nil {
+		return errors.Wrap(err, "send logout fail")
+	}
+
+	return nil
+}
+
+// close Closes the connection without notifying upsd.
+func (s *session) close() {
+	_ = s.conn.Close()
+}
+
+// get Sends a command with a single line response, e.g. GET, SET, INSTCMD.
+func (s *session) get(ctx context.Context, args ...string) (string, error) {
+	if err := s.write(ctx, args); err != nil {
+		return "", err
+	}
+
+	line, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+	if err := responseError(line); err != nil {
+		return "", err
+	}
+
+	return line, nil
+}
+
+// list Sends a LIST command and returns lines between "BEGIN LIST" and "END LIST".
+func (s *session) list(ctx context.Context, args ...string) ([]string, error) {
+	args = append([]string{"LIST"}, args...)
+	if err := s.write(ctx, args); err != nil {
+		return nil, err
+	}
+
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(line); err != nil {
+		return nil, err
+	}
+
+	cmd := strings.Join(args, " ")
+	if line != "BEGIN "+cmd {
+		return nil, errors.Errorf(`unexpected response "%s" for "%s"`, line, cmd)
+	}
+
+	var lines []string
+
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "END "+cmd {
+			break
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// write Writes the command line to the connection, arguments which would be split or start another command
+// are rejected by ErrInvalidValue.
+func (s *session) write(ctx context.Context, args []string) error {
+	for _, arg := range args {
+		if !validArg(arg) {
+			return errors.Wrapf(ErrInvalidValue, "argument %q", arg)
+		}
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if err := s.conn.SetDeadline(deadline); err != nil {
+		return errors.Wrap(err, "set deadline fail")
+	}
+
+	s.lastUsed = time.Now()
+
+	if _, err := fmt.Fprintf(s.conn, "%s\n", strings.Join(args, " ")); err != nil {
+		return errors.Wrap(err, "write fail")
+	}
+
+	return nil
+}
+
+// readLine Reads a single line of the response without the trailing newline.
+func (s *session) readLine() (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", errors.Wrap(err, "read fail")
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// responseError Returns an error if the line is the NUT error response, e.g. "ERR UNKNOWN-UPS",
+// the code is unknownCode if the response has no code.
+func responseError(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "ERR" {
+		return nil
+	}
+	if len(fields) < 2 {
+		return &Error{Code: unknownCode}
+	}
+
+	return &Error{Code: fields[1]}
+}
+
+// isResponseError Checks whether the error is returned by upsd rather than caused by the connection.
+func isResponseError(err error) bool {
+	var e *Error
+
+	return errors.As(err, &e)
+}
+
+// validArg Checks that the argument is sent as a single field of the command line: a word without whitespace,
+// quotes and backslashes or the value quoted by quote, control characters aren't allowed in both of them.
+func validArg(arg string) bool {
+	quoted := len(arg) >= 2 && arg[0] == '"' && arg[len(arg)-1] == '"'
+	if quoted {
+		arg = arg[1 : len(arg)-1]
+	} else if len(arg) == 0 {
+		return false
+	}
+
+	escaped := false
+
+	for _, r := range arg {
+		switch {
+		case unicode.IsControl(r):
+			return false
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			return false
+		case !quoted && (r == '\\' || unicode.IsSpace(r)):
+			return false
+		}
+	}
+
+	return !escaped
+}
+
+// quote Quotes the value to be sent as a single argument.
+func quote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+
+	return `"` + value + `"`
+}
+
+// splitFields Splits the response line to fields taking quoted values into account,
+// e.g. `VAR ups ups.status "OL CHRG"` is split to [VAR ups ups.status OL CHRG].
+func splitFields(line string) []string {
+	var (
+		fields  []string
+		field   strings.Builder
+		inField bool
+		quoted  bool
+		escaped bool
+	)
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inField = true
+		case r == ' ' && !quoted:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields
+}
@@ -0,0 +1,71 @@
+package nut
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// TLS is the STARTTLS settings of the connection to upsd.
+type TLS struct {
+	// STARTTLS is sent before authentication
+	Enabled bool
+
+	// Authentication over plaintext is refused if upsd doesn't support STARTTLS,
+	// otherwise the session falls back to plaintext, it implies Enabled
+	Required bool
+
+	// CA of the upsd certificate, the system pool is used if it's empty
+	CAFile string
+
+	// Name verified against the upsd certificate, the host is used if it's empty
+	ServerName string
+
+	// The upsd certificate isn't verified, it's only for testing
+	InsecureSkipVerify bool
+
+	// Client certificate, e.g. for upsd configured with CERTREQUEST
+	CertFile string
+	KeyFile  string
+}
+
+// config Returns the TLS configuration of the connection to the host, it's nil if STARTTLS is disabled.
+func (t TLS) config(host string) (*tls.Config, error) {
+	if !t.Enabled && !t.Required {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify, //nolint:gosec
+	}
+	if len(config.ServerName) == 0 {
+		config.ServerName = host
+	}
+
+	if len(t.CAFile) > 0 {
+		data, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "CA reading fail")
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates in CA file (%s)", t.CAFile)
+		}
+	}
+
+	if len(t.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "client certificate loading fail")
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,413 @@
+package nut
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/pkg/errors"
+)
+
+var numericValue = regexp.MustCompile(`^-?[0-9.]+$`)
+
+// metadata is the rarely changed part of the UPS which isn't worth querying on every poll.
+type metadata struct {
+	time           time.Time
+	description    string
+	clients        []string
+	numberOfLogins int
+	commands       []nut_client.Command
+	variables      map[string]variableMetadata
+}
+
+// variableMetadata is the description, the type and accepted values of the variable.
+type variableMetadata struct {
+	description string
+	varType     string
+	constraint  Constraint
+}
+
+// rawVariable is the variable as it's returned by LIST VAR.
+type rawVariable struct {
+	name  string
+	value string
+}
+
+// covers Checks whether the metadata is known for all of the variables.
+func (m *metadata) covers(vars []rawVariable) bool {
+	if len(vars) != len(m.variables) {
+		return false
+	}
+
+	for _, v := range vars {
+		if _, ok := m.variables[v.name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// buildUPS Combines the UPS metadata with the current values of variables.
+func buildUPS(name string, meta *metadata, vars []rawVariable) *nut_client.UPS {
+	u := &nut_client.UPS{
+		Name:           name,
+		Description:    meta.description,
+		NumberOfLogins: meta.numberOfLogins,
+		Clients:        meta.clients,
+		Commands:       meta.commands,
+		Variables:      make([]nut_client.Variable, 0, len(vars)),
+	}
+
+	for _, raw := range vars {
+		vm := meta.variables[raw.name]
+
+		v := nut_client.Variable{
+			Name:          raw.name,
+			Description:   vm.description,
+			Writeable:     vm.constraint.Writeable,
+			MaximumLength: vm.constraint.MaximumLength,
+			OriginalType:  vm.varType,
+		}
+		v.Value, v.Type = convertValue(raw.value)
+
+		u.Variables = append(u.Variables, v)
+	}
+
+	return u
+}
+
+// upsNames Returns names of all UPSes provided by this NUT instance.
+func (s *session) upsNames(ctx context.Context) ([]string, error) {
+	lines, err := s.list(ctx, "UPS")
+	if err != nil {
+		return nil, errors.Wrap(err, "list ups fail")
+	}
+
+	var names []string
+
+	for _, line := range lines {
+		fields := splitFields(line)
+		if len(fields) < 2 || fields[0] != "UPS" {
+			continue
+		}
+
+		names = append(names, fields[1])
+	}
+
+	return names, nil
+}
+
+// metadata Returns the metadata of the UPS and of the given variables.
+func (s *session) metadata(ctx context.Context, name string, vars []rawVariable) (*metadata, error) {
+	m := &metadata{
+		time:      time.Now(),
+		variables: make(map[string]variableMetadata, len(vars)),
+	}
+
+	var err error
+
+	if m.clients, err = s.clients(ctx, name); err != nil {
+		return nil, errors.Wrap(err, "get clients fail")
+	}
+	if m.commands, err = s.commands(ctx, name); err != nil {
+		return nil, errors.Wrap(err, "get commands fail")
+	}
+	if m.description, err = s.value(ctx, "GET", "UPSDESC", name); err != nil {
+		return nil, errors.Wrap(err, "get description fail")
+	}
+	if m.numberOfLogins, err = s.numberOfLogins(ctx, name); err != nil {
+		return nil, errors.Wrap(err, "get number of logins fail")
+	}
+
+	writeable, err := s.writeableVariables(ctx, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get writeable variables fail")
+	}
+
+	for _, v := range vars {
+		vm, enum, ranges, err := s.variableType(ctx, name, v.name)
+		if err != nil {
+			return nil, errors.Wrapf(err, `get type of variable "%s" fail`, v.name)
+		}
+		if _, ok := writeable[v.name]; ok {
+			vm.constraint.Writeable = true
+		}
+
+		if vm.description, err = s.value(ctx, "GET", "DESC", name, v.name); err != nil {
+			return nil, errors.Wrapf(err, `get description of variable "%s" fail`, v.name)
+		}
+		if enum {
+			if vm.constraint.Enum, err = s.enum(ctx, name, v.name); err != nil {
+				return nil, errors.Wrapf(err, `get enum of variable "%s" fail`, v.name)
+			}
+		}
+		if ranges {
+			if vm.constraint.Ranges, err = s.ranges(ctx, name, v.name); err != nil {
+				return nil, errors.Wrapf(err, `get ranges of variable "%s" fail`, v.name)
+			}
+		}
+
+		m.variables[v.name] = vm
+	}
+
+	return m, nil
+}
+
+// writeableVariables Returns names of variables listed by LIST RW, upsd errors are ignored since
+// writeability is reported by GET TYPE as well.
+func (s *session) writeableVariables(ctx context.Context, name string) (map[string]struct{}, error) {
+	lines, err := s.list(ctx, "RW", name)
+	if err != nil {
+		if isResponseError(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "list rw fail")
+	}
+
+	res := make(map[string]struct{}, len(lines))
+
+	for _, line := range lines {
+		if fields := splitFields(line); len(fields) >= 3 {
+			res[fields[2]] = struct{}{}
+		}
+	}
+
+	return res, nil
+}
+
+// enum Returns values of the ENUM variable, upsd errors are ignored so the value isn't validated locally.
+func (s *session) enum(ctx context.Context, name, variableName string) ([]string, error) {
+	lines, err := s.list(ctx, "ENUM", name, variableName)
+	if err != nil {
+		if isResponseError(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "list enum fail")
+	}
+
+	var res []string
+
+	// e.g.: ENUM ups input.transfer.low "103"
+	for _, line := range lines {
+		if fields := splitFields(line); len(fields) >= 4 {
+			res = append(res, fields[3])
+		}
+	}
+
+	return res, nil
+}
+
+// ranges Returns ranges of the RANGE variable, upsd errors are ignored so the value isn't validated locally.
+func (s *session) ranges(ctx context.Context, name, variableName string) ([]Range, error) {
+	lines, err := s.list(ctx, "RANGE", name, variableName)
+	if err != nil {
+		if isResponseError(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "list range fail")
+	}
+
+	var res []Range
+
+	// e.g.: RANGE ups input.transfer.low "90" "105"
+	for _, line := range lines {
+		fields := splitFields(line)
+		if len(fields) < 5 {
+			continue
+		}
+
+		var (
+			r   Range
+			err error
+		)
+
+		if r.Min, err = strconv.ParseFloat(fields[3], 64); err != nil {
+			return nil, errors.Wrap(err, "parse float fail")
+		}
+		if r.Max, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			return nil, errors.Wrap(err, "parse float fail")
+		}
+
+		res = append(res, r)
+	}
+
+	return res, nil
+}
+
+// clients Returns a list of NUT clients of the UPS.
+func (s *session) clients(ctx context.Context, name string) ([]string, error) {
+	lines, err := s.list(ctx, "CLIENT", name)
+	if err != nil {
+		return nil, errors.Wrap(err, "list client fail")
+	}
+
+	var res []string
+
+	for _, line := range lines {
+		if fields := splitFields(line); len(fields) >= 3 {
+			res = append(res, fields[2])
+		}
+	}
+
+	return res, nil
+}
+
+// numberOfLogins Returns the number of clients which have done LOGIN for the UPS.
+func (s *session) numberOfLogins(ctx context.Context, name string) (int, error) {
+	value, err := s.value(ctx, "GET", "NUMLOGINS", name)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse int fail")
+	}
+
+	return res, nil
+}
+
+// commands Returns a list of instant commands of the UPS with descriptions.
+func (s *session) commands(ctx context.Context, name string) ([]nut_client.Command, error) {
+	lines, err := s.list(ctx, "CMD", name)
+	if err != nil {
+		return nil, errors.Wrap(err, "list cmd fail")
+	}
+
+	var res []nut_client.Command
+
+	for _, line := range lines {
+		fields := splitFields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		description, err := s.value(ctx, "GET", "CMDDESC", name, fields[2])
+		if err != nil {
+			return nil, errors.Wrapf(err, `get description of command "%s" fail`, fields[2])
+		}
+
+		res = append(res, nut_client.Command{
+			Name:        fields[2],
+			Description: description,
+		})
+	}
+
+	return res, nil
+}
+
+// variables Returns names and values of variables of the UPS.
+func (s *session) variables(ctx context.Context, name string) ([]rawVariable, error) {
+	lines, err := s.list(ctx, "VAR", name)
+	if err != nil {
+		return nil, errors.Wrap(err, "list var fail")
+	}
+
+	var res []rawVariable
+
+	for _, line := range lines {
+		fields := splitFields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		res = append(res, rawVariable{
+			name:  fields[2],
+			value: fields[3],
+		})
+	}
+
+	return res, nil
+}
+
+// variableType Returns the variable type, writeability and maximum length of the variable,
+// enum and ranges report whether the values are listed by LIST ENUM and LIST RANGE.
+func (s *session) variableType(ctx context.Context, name, variableName string) (vm variableMetadata, enum, ranges bool, err error) {
+	line, err := s.get(ctx, "GET", "TYPE", name, variableName)
+	if err != nil {
+		return vm, false, false, err
+	}
+
+	fields := splitFields(line)
+	if len(fields) < 4 {
+		return vm, false, false, errors.Errorf(`unexpected response "%s"`, line)
+	}
+
+	vm.varType = "UNKNOWN"
+
+	// e.g.: TYPE ups input.transfer.low RW ENUM, TYPE ups ups.id RW STRING:16
+	for _, t := range fields[3:] {
+		switch {
+		case t == "RW":
+			vm.constraint.Writeable = true
+		case strings.HasPrefix(t, "STRING:"):
+			vm.varType = "STRING"
+
+			if vm.constraint.MaximumLength, err = strconv.Atoi(strings.TrimPrefix(t, "STRING:")); err != nil {
+				return vm, false, false, errors.Wrap(err, "parse int fail")
+			}
+		default:
+			vm.varType = t
+
+			switch t {
+			case "NUMBER":
+				vm.constraint.Numeric = true
+			case "ENUM":
+				enum = true
+			case "RANGE":
+				ranges = true
+			}
+		}
+	}
+
+	return vm, enum, ranges, nil
+}
+
+// value Sends the GET command and returns the last field of the response,
+// e.g. "Main UPS" for `UPSDESC ups "Main UPS"`.
+func (s *session) value(ctx context.Context, args ...string) (string, error) {
+	line, err := s.get(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+
+	fields := splitFields(line)
+	if len(fields) < len(args) {
+		return "", errors.Errorf(`unexpected response "%s"`, line)
+	}
+
+	return fields[len(fields)-1], nil
+}
+
+// convertValue Converts the raw variable value to the Go value the same way nut_client does:
+// "enabled"/"disabled" to BOOLEAN, numbers to INTEGER or FLOAT_64 and everything else to STRING.
+func convertValue(raw string) (interface{}, string) {
+	switch raw {
+	case "enabled":
+		return true, "BOOLEAN"
+	case "disabled":
+		return false, "BOOLEAN"
+	}
+
+	if numericValue.MatchString(raw) {
+		switch strings.Count(raw, ".") {
+		case 0:
+			if v, err := strconv.ParseInt(raw, 10, 64); err == nil {
+				return v, "INTEGER"
+			}
+		case 1:
+			if v, err := strconv.ParseFloat(raw, 64); err == nil {
+				return v, "FLOAT_64"
+			}
+		}
+	}
+
+	return raw, "STRING"
+}
@@ -0,0 +1,89 @@
+package nut
+
+import (
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnknownUpstream  = errors.New("unknown upstream")
+	ErrUpstreamRequired = errors.New("upstream is required when several upstreams are configured")
+
+	_ io.Closer = (*Upstreams)(nil)
+)
+
+// Upstreams is the set of NUT clients of named upstreams.
+type Upstreams struct {
+	clients map[string]*Client
+}
+
+func NewUpstreams() *Upstreams {
+	return &Upstreams{
+		clients: make(map[string]*Client),
+	}
+}
+
+// Add Adds the client of the upstream.
+func (u *Upstreams) Add(name string, client *Client) error {
+	if _, ok := u.clients[name]; ok {
+		return errors.Errorf("duplicated upstream %q", name)
+	}
+
+	u.clients[name] = client
+
+	return nil
+}
+
+// Get Returns the client of the upstream, the name may be omitted if there is the only upstream.
+func (u *Upstreams) Get(name string) (*Client, error) {
+	name, err := u.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.clients[name], nil
+}
+
+// Resolve Returns the name of the configured upstream, the name may be omitted if there is the only upstream.
+func (u *Upstreams) Resolve(name string) (string, error) {
+	if name == "" {
+		if len(u.clients) != 1 {
+			return "", ErrUpstreamRequired
+		}
+
+		for n := range u.clients {
+			return n, nil
+		}
+	}
+
+	if _, ok := u.clients[name]; !ok {
+		return "", errors.Wrapf(ErrUnknownUpstream, "upstream %q", name)
+	}
+
+	return name, nil
+}
+
+// Names Returns sorted names of upstreams.
+func (u *Upstreams) Names() []string {
+	names := make([]string, 0, len(u.clients))
+	for name := range u.clients {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Close Closes clients of all upstreams.
+func (u *Upstreams) Close() error {
+	for name, c := range u.clients {
+		if err := c.Close(); err != nil {
+			return errors.Wrapf(err, "closing upstream %q fail", name)
+		}
+	}
+
+	return nil
+}
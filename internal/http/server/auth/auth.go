@@ -0,0 +1,397 @@
+// Package auth authenticates HTTP API requests by static tokens or HTTP Basic and checks user permissions.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Permissions of users.
+const (
+	// PermissionRead allows reading UPS data and metrics.
+	PermissionRead = "read"
+	// PermissionWrite allows setting UPS variables.
+	PermissionWrite = "write"
+	// PermissionCommand allows sending instant commands allowed by the user's command list.
+	PermissionCommand = "command"
+	// PermissionDangerous allows dangerous commands and FSD beside the command permission.
+	PermissionDangerous = "dangerous"
+	// PermissionAudit allows reading the audit trail.
+	PermissionAudit = "audit"
+)
+
+// commandPattern matches names of NUT instant commands.
+var commandPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// hashScheme is the prefix of password hashes in the users file.
+const hashScheme = "pbkdf2-sha256"
+
+// keyLength is the length of the key derived from the password in bytes.
+const keyLength = sha256.Size
+
+var (
+	ErrUnauthenticated = errors.New("authentication is required")
+	ErrForbidden       = errors.New("permission denied")
+)
+
+type contextKey struct{}
+
+// User is the API user with its permissions.
+type User struct {
+	Name string
+
+	// Static bearer token or API key, the user can't authenticate by a token if it's empty
+	Token string
+
+	// Subject of the verified client certificate, e.g. "CN=grafana,O=Monitoring" or just the common name "grafana"
+	Subject string
+
+	Permissions []string
+
+	// Allowed instant commands as name patterns, e.g. "beeper.*", all commands are allowed if it's empty
+	Commands []string
+}
+
+// Auth authenticates requests, every request is allowed if it's disabled.
+type Auth struct {
+	enabled          bool
+	anonymousMetrics bool
+
+	users map[string]*User
+
+	// password hashes by user name read from the users file
+	passwords map[string]passwordHash
+
+	// SHA-256 of passwords verified by the slow hash by user name, so the hash isn't derived by every request
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// passwordHash is the PBKDF2-HMAC-SHA256 key of the password.
+type passwordHash struct {
+	iterations int
+	salt       string
+	key        []byte
+}
+
+func New(enabled, anonymousMetrics bool, users []User, usersFile string) (*Auth, error) {
+	a := &Auth{
+		enabled:          enabled,
+		anonymousMetrics: anonymousMetrics,
+		users:            make(map[string]*User, len(users)),
+		passwords:        make(map[string]passwordHash),
+		verified:         make(map[string][sha256.Size]byte),
+	}
+
+	for i := range users {
+		u := users[i]
+
+		for _, p := range u.Permissions {
+			if p != PermissionRead && p != PermissionWrite && p != PermissionCommand && p != PermissionDangerous && p != PermissionAudit {
+				return nil, errors.Errorf("unknown permission %q of user %q", p, u.Name)
+			}
+		}
+		for _, pattern := range u.Commands {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "command pattern %q of user %q parsing fail", pattern, u.Name)
+			}
+		}
+		if _, ok := a.users[u.Name]; ok {
+			return nil, errors.Errorf("duplicated user %q", u.Name)
+		}
+
+		a.users[u.Name] = &u
+	}
+
+	if len(usersFile) > 0 {
+		if err := a.readUsersFile(usersFile); err != nil {
+			return nil, errors.Wrapf(err, "users file reading fail (%s)", usersFile)
+		}
+	}
+
+	return a, nil
+}
+
+// AnonymousMetrics Checks whether metrics are readable without authentication.
+func (a *Auth) AnonymousMetrics() bool {
+	return !a.enabled || a.anonymousMetrics
+}
+
+// Authorize Authenticates the request and checks the user has the permission,
+// the returned request carries the user in its context.
+func (a *Auth) Authorize(r *http.Request, permission string) (*http.Request, error) {
+	if !a.enabled {
+		return r, nil
+	}
+
+	u, err := a.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.has(permission) {
+		return nil, errors.Wrapf(ErrForbidden, "user %q has no %s permission", u.Name, permission)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, u)), nil
+}
+
+// CheckCommand Checks the user of the context is allowed to send the instant command,
+// any command is allowed if the context has no user, i.e. authentication is disabled.
+//
+// Commands which aren't NUT tokens are always rejected, so a command allowed by the pattern
+// can't carry another command, e.g. "beeper.enable\nINSTCMD ups shutdown.return" matches "beeper.*".
+func CheckCommand(ctx context.Context, command string) error {
+	if !commandPattern.MatchString(command) {
+		return errors.Wrapf(ErrForbidden, "command %q isn't the NUT command name", command)
+	}
+
+	u, ok := ctx.Value(contextKey{}).(*User)
+	if !ok {
+		return nil
+	}
+
+	if !u.has(PermissionCommand) {
+		return errors.Wrapf(ErrForbidden, "user %q has no %s permission", u.Name, PermissionCommand)
+	}
+	if len(u.Commands) == 0 {
+		return nil
+	}
+
+	for _, pattern := range u.Commands {
+		if ok, _ := path.Match(pattern, command); ok {
+			return nil
+		}
+	}
+
+	return errors.Wrapf(ErrForbidden, "user %q isn't allowed to send command %q", u.Name, command)
+}
+
+// CheckPermission Checks the user of the context has the permission,
+// any permission is granted if the context has no user, i.e. authentication is disabled.
+func CheckPermission(ctx context.Context, permission string) error {
+	u, ok := ctx.Value(contextKey{}).(*User)
+	if !ok || u.has(permission) {
+		return nil
+	}
+
+	return errors.Wrapf(ErrForbidden, "user %q has no %s permission", u.Name, permission)
+}
+
+// UserName Returns the name of the user of the context, it's empty if authentication is disabled.
+func UserName(ctx context.Context) string {
+	if u, ok := ctx.Value(contextKey{}).(*User); ok {
+		return u.Name
+	}
+
+	return ""
+}
+
+// authenticate Finds the user by the client certificate, the bearer token, the API key or HTTP Basic credentials.
+func (a *Auth) authenticate(r *http.Request) (*User, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if u := a.userBySubject(r.TLS.VerifiedChains[0][0].Subject); u != nil {
+			return u, nil
+		}
+	}
+
+	token := r.Header.Get("X-API-Key")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+
+	if len(token) > 0 {
+		if u := a.userByToken(token); u != nil {
+			return u, nil
+		}
+
+		return nil, errors.Wrap(ErrUnauthenticated, "invalid token")
+	}
+
+	if name, password, ok := r.BasicAuth(); ok {
+		u, ok := a.users[name]
+		if ok && a.checkPassword(name, password) {
+			return u, nil
+		}
+
+		return nil, errors.Wrap(ErrUnauthenticated, "invalid username or password")
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+// userByToken Finds the user by the token comparing all tokens in constant time.
+func (a *Auth) userByToken(token string) *User {
+	var found *User
+
+	for _, u := range a.users {
+		if len(u.Token) > 0 && subtle.ConstantTimeCompare([]byte(u.Token), []byte(token)) == 1 {
+			found = u
+		}
+	}
+
+	return found
+}
+
+// userBySubject Finds the user by the subject of the client certificate.
+func (a *Auth) userBySubject(subject pkix.Name) *User {
+	for _, u := range a.users {
+		if len(u.Subject) > 0 && (u.Subject == subject.String() || u.Subject == subject.CommonName) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// checkPassword Checks the password against the hash from the users file.
+func (a *Auth) checkPassword(name, password string) bool {
+	hash, ok := a.passwords[name]
+	if !ok {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(password))
+
+	a.mu.Lock()
+	verified, ok := a.verified[name]
+	a.mu.Unlock()
+
+	if ok && subtle.ConstantTimeCompare(sum[:], verified[:]) == 1 {
+		return true
+	}
+
+	if subtle.ConstantTimeCompare(pbkdf2([]byte(password), []byte(hash.salt), hash.iterations, keyLength), hash.key) != 1 {
+		return false
+	}
+
+	a.mu.Lock()
+	a.verified[name] = sum
+	a.mu.Unlock()
+
+	return true
+}
+
+// readUsersFile Reads "name:pbkdf2-sha256$iterations$salt$hex" lines, empty lines and lines starting with # are skipped.
+func (a *Auth) readUsersFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "open fail")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return errors.Errorf("invalid line %d", n)
+		}
+
+		hash, err := parseHash(line[i+1:])
+		if err != nil {
+			return errors.Wrapf(err, "line %d", n)
+		}
+
+		a.passwords[line[:i]] = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "read fail")
+	}
+
+	return nil
+}
+
+func (u *User) has(permission string) bool {
+	for _, p := range u.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHash Parses "pbkdf2-sha256$iterations$salt$hex".
+func parseHash(s string) (passwordHash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return passwordHash{}, errors.Errorf("hash isn't %s$iterations$salt$hex", hashScheme)
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return passwordHash{}, errors.Errorf("invalid iterations %q", parts[1])
+	}
+
+	key, err := hex.DecodeString(parts[3])
+	if err != nil || len(key) != keyLength {
+		return passwordHash{}, errors.New("invalid key")
+	}
+
+	return passwordHash{iterations: iterations, salt: parts[2], key: key}, nil
+}
+
+// hashPassword Returns "pbkdf2-sha256$iterations$salt$hex" where hex is the PBKDF2-HMAC-SHA256 key of the password.
+func hashPassword(iterations int, salt, password string) string {
+	key := pbkdf2([]byte(password), []byte(salt), iterations, keyLength)
+
+	return hashScheme + "$" + strconv.Itoa(iterations) + "$" + salt + "$" + hex.EncodeToString(key)
+}
+
+// pbkdf2 Derives the key of the password by PBKDF2 with HMAC-SHA256 (RFC 8018).
+func pbkdf2(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	size := prf.Size()
+
+	var (
+		key   []byte
+		index [4]byte
+	)
+
+	u := make([]byte, 0, size)
+
+	for block := 1; len(key) < length; block++ {
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(index[:])
+		key = prf.Sum(key)
+
+		t := key[len(key)-size:]
+		u = append(u[:0], t...)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+	}
+
+	return key[:length]
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorize(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users")
+	require.NoError(t, ioutil.WriteFile(file, []byte("# comment\nadmin:"+hashPassword(1000, "0011", "secret")+"\n"), 0o600))
+
+	a, err := New(true, false, []User{
+		{Name: "grafana", Token: "token", Permissions: []string{PermissionRead}},
+		{Name: "admin", Permissions: []string{PermissionRead, PermissionCommand}, Commands: []string{"beeper.*"}},
+	}, file)
+	require.NoError(t, err)
+
+	t.Run("token", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/get", nil)
+		r.Header.Set("Authorization", "Bearer token")
+
+		r, err := a.Authorize(r, PermissionRead)
+		require.NoError(t, err)
+		require.Equal(t, "grafana", UserName(r.Context()))
+
+		_, err = a.Authorize(r, PermissionWrite)
+		require.True(t, errors.Is(err, ErrForbidden))
+	})
+
+	t.Run("basic", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/command", nil)
+		r.SetBasicAuth("admin", "secret")
+
+		r, err := a.Authorize(r, PermissionCommand)
+		require.NoError(t, err)
+		require.NoError(t, CheckCommand(r.Context(), "beeper.toggle"))
+		require.True(t, errors.Is(CheckCommand(r.Context(), "load.off"), ErrForbidden))
+		require.True(t, errors.Is(CheckCommand(r.Context(), "beeper.enable\nINSTCMD ups shutdown.return"), ErrForbidden))
+		require.True(t, errors.Is(CheckCommand(r.Context(), "beeper.enable load.off"), ErrForbidden))
+
+		r = httptest.NewRequest("POST", "/command", nil)
+		r.SetBasicAuth("admin", "wrong")
+
+		_, err = a.Authorize(r, PermissionCommand)
+		require.True(t, errors.Is(err, ErrUnauthenticated))
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		_, err := a.Authorize(httptest.NewRequest("GET", "/get", nil), PermissionRead)
+		require.True(t, errors.Is(err, ErrUnauthenticated))
+		require.False(t, a.AnonymousMetrics())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		a, err := New(false, false, nil, "")
+		require.NoError(t, err)
+
+		_, err = a.Authorize(httptest.NewRequest("GET", "/get", nil), PermissionCommand)
+		require.NoError(t, err)
+		require.NoError(t, CheckCommand(context.Background(), "load.off"))
+		require.True(t, errors.Is(CheckCommand(context.Background(), "load.off\nFSD ups"), ErrForbidden))
+	})
+}
+
+func TestPasswordHash(t *testing.T) {
+	t.Run("pbkdf2", func(t *testing.T) {
+		// test vectors of PBKDF2-HMAC-SHA256
+		require.Equal(t, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+			hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), 1, 32)))
+		require.Equal(t, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a",
+			hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), 4096, 32)))
+		require.Equal(t, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9",
+			hex.EncodeToString(pbkdf2([]byte("passwordPASSWORDpassword"), []byte("saltSALTsaltSALTsaltSALTsaltSALTsalt"), 4096, 40)))
+	})
+	t.Run("users file", func(t *testing.T) {
+		for _, line := range []string{
+			"admin:sha256$0011$" + strings.Repeat("0", 64),
+			"admin:pbkdf2-sha256$0$0011$" + strings.Repeat("0", 64),
+			"admin:pbkdf2-sha256$1000$0011$00",
+			"admin",
+		} {
+			file := filepath.Join(t.TempDir(), "users")
+			require.NoError(t, ioutil.WriteFile(file, []byte(line+"\n"), 0o600))
+
+			_, err := New(true, false, []User{{Name: "admin"}}, file)
+			require.Error(t, err, line)
+		}
+	})
+	t.Run("verified passwords", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "users")
+		require.NoError(t, ioutil.WriteFile(file, []byte("admin:"+hashPassword(1000, "0011", "secret")+"\n"), 0o600))
+
+		a, err := New(true, false, []User{{Name: "admin"}}, file)
+		require.NoError(t, err)
+
+		require.False(t, a.checkPassword("admin", "wrong"))
+		require.Empty(t, a.verified)
+
+		require.True(t, a.checkPassword("admin", "secret"))
+		require.Len(t, a.verified, 1)
+		require.True(t, a.checkPassword("admin", "secret"))
+		require.False(t, a.checkPassword("admin", "wrong"))
+	})
+}
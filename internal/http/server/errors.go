@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/andreyAKor/nut_client_service/internal/history"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/auth"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+	handlerUPS "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/ups"
+)
+
+// Machine-readable error codes of Response.
+const (
+	CodeUnauthenticated  = "unauthenticated"
+	CodeForbidden        = "forbidden"
+	CodeInvalidRequest   = "invalid_request"
+	CodeInvalidConfirm   = "invalid_confirmation"
+	CodeUpstreamRequired = "upstream_required"
+	CodeUnknownUpstream  = "unknown_upstream"
+	CodeUnknownUPS       = "unknown_ups"
+	CodeAmbiguousUPS     = "ambiguous_ups"
+	CodeUnknownCommand   = "unknown_command"
+	CodeUnknownVariable  = "unknown_variable"
+	CodeReadOnly         = "read_only"
+	CodeInvalidValue     = "invalid_value"
+	CodeAccessDenied     = "access_denied"
+	CodeUpstreamFailed   = "upstream_failed"
+	CodeHistoryDisabled  = "history_disabled"
+	CodeInternal         = "internal"
+)
+
+// errorStatuses maps errors returned by handlers to HTTP statuses and error codes, the first match wins.
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{auth.ErrUnauthenticated, http.StatusUnauthorized, CodeUnauthenticated},
+	{auth.ErrForbidden, http.StatusForbidden, CodeForbidden},
+	{handlers.ErrInvalidRequest, http.StatusBadRequest, CodeInvalidRequest},
+	{guard.ErrInvalidConfirmation, http.StatusUnprocessableEntity, CodeInvalidConfirm},
+	{nut.ErrUpstreamRequired, http.StatusBadRequest, CodeUpstreamRequired},
+	{nut.ErrUnknownUpstream, http.StatusNotFound, CodeUnknownUpstream},
+	// failures of the connection to upsd wrap its errors, e.g. ACCESS-DENIED of the service credentials,
+	// so they're matched before errors upsd returns on the request
+	{nut.ErrUnavailable, http.StatusBadGateway, CodeUpstreamFailed},
+	{nut.ErrUnknownUPS, http.StatusNotFound, CodeUnknownUPS},
+	{handlerUPS.ErrAmbiguousUPS, http.StatusConflict, CodeAmbiguousUPS},
+	{nut.ErrUnknownCommand, http.StatusNotFound, CodeUnknownCommand},
+	{nut.ErrUnknownVariable, http.StatusNotFound, CodeUnknownVariable},
+	{nut.ErrReadOnly, http.StatusUnprocessableEntity, CodeReadOnly},
+	{nut.ErrInvalidValue, http.StatusUnprocessableEntity, CodeInvalidValue},
+	{nut.ErrAccessDenied, http.StatusForbidden, CodeAccessDenied},
+	{nut.ErrFailed, http.StatusBadGateway, CodeUpstreamFailed},
+	{history.ErrDisabled, http.StatusNotFound, CodeHistoryDisabled},
+}
+
+// errorStatus Returns the HTTP status and the error code of the error.
+func errorStatus(err error) (int, string) {
+	for _, s := range errorStatuses {
+		if errors.Is(err, s.err) {
+			return s.status, s.code
+		}
+	}
+
+	return http.StatusInternalServerError, CodeInternal
+}
@@ -0,0 +1,226 @@
+// Package guard protects dangerous operations by the two-step confirmation and audits write operations.
+package guard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andreyAKor/nut_client_service/internal/audit"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/auth"
+)
+
+// ConfirmationHeader is the header the confirmation token is re-submitted in, the confirm parameter may be used instead.
+const ConfirmationHeader = "X-Confirmation-Token"
+
+// Kinds of actions.
+const (
+	ActionCommand  = "command"
+	ActionFSD      = "fsd"
+	ActionVariable = "variable"
+)
+
+var ErrInvalidConfirmation = errors.New("confirmation token is invalid or expired")
+
+// Action is the operation on the UPS.
+type Action struct {
+	Kind     string
+	Upstream string
+	UPS      string
+
+	// Instant command of ActionCommand
+	Command string
+
+	// Variable of ActionVariable, OldValue is the latest known value of the variable
+	Variable string
+	OldValue string
+	Value    string
+}
+
+// Confirmation is returned instead of running the dangerous action, the action runs when it's
+// requested again with the token.
+type Confirmation struct {
+	Token     string    `json:"confirmationToken"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type pending struct {
+	user    string
+	action  Action
+	expires time.Time
+}
+
+// Guard decides which actions are dangerous, issues confirmation tokens and audits actions.
+type Guard struct {
+	// Name patterns of dangerous commands, e.g. "shutdown.*", FSD is always dangerous
+	patterns []string
+	ttl      time.Duration
+	audit    *audit.Log
+
+	mu      sync.Mutex
+	pending map[string]pending
+}
+
+func New(patterns []string, ttl string, auditLog *audit.Log) (*Guard, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "dangerous command pattern %q parsing fail", p)
+		}
+	}
+
+	ttlDur, err := time.ParseDuration(ttl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "confirmation TTL parsing fail (%s)", ttl)
+	}
+
+	return &Guard{
+		patterns: patterns,
+		ttl:      ttlDur,
+		audit:    auditLog,
+		pending:  make(map[string]pending),
+	}, nil
+}
+
+// Dangerous Checks whether the action needs the dangerous permission and the confirmation,
+// commands which aren't NUT tokens are dangerous since patterns can't match what they carry.
+func (g *Guard) Dangerous(a Action) bool {
+	switch a.Kind {
+	case ActionFSD:
+		return true
+	case ActionVariable:
+		return false
+	}
+
+	if !nut.ValidName(a.Command) {
+		return true
+	}
+
+	for _, p := range g.patterns {
+		if ok, _ := path.Match(p, a.Command); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check Lets the action run, it returns the confirmation instead if the dangerous action
+// is requested without the token.
+func (g *Guard) Check(r *http.Request, a Action) (*Confirmation, error) {
+	if !g.Dangerous(a) {
+		return nil, nil
+	}
+
+	user := auth.UserName(r.Context())
+
+	if err := auth.CheckPermission(r.Context(), auth.PermissionDangerous); err != nil {
+		g.write(r, a, audit.ResultDenied, err)
+
+		return nil, err
+	}
+
+	token := r.Header.Get(ConfirmationHeader)
+	if len(token) == 0 {
+		token = r.URL.Query().Get("confirm")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prune()
+
+	if len(token) == 0 {
+		c, err := g.issue(user, a)
+		if err != nil {
+			return nil, err
+		}
+
+		g.write(r, a, audit.ResultConfirmationRequired, nil)
+
+		return c, nil
+	}
+
+	p, ok := g.pending[token]
+	if !ok || p.user != user || p.action != a {
+		g.write(r, a, audit.ResultInvalidConfirmation, ErrInvalidConfirmation)
+
+		return nil, ErrInvalidConfirmation
+	}
+
+	delete(g.pending, token)
+
+	return nil, nil
+}
+
+// Done Audits the result of the action.
+func (g *Guard) Done(r *http.Request, a Action, err error) {
+	if err != nil {
+		g.write(r, a, audit.ResultFailed, err)
+
+		return
+	}
+
+	g.write(r, a, audit.ResultDone, nil)
+}
+
+// issue Creates the token of the action, g.mu must be held.
+func (g *Guard) issue(user string, a Action) (*Confirmation, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "token generating fail")
+	}
+
+	c := &Confirmation{
+		Token:     hex.EncodeToString(b),
+		ExpiresAt: time.Now().Add(g.ttl),
+	}
+	g.pending[c.Token] = pending{
+		user:    user,
+		action:  a,
+		expires: c.ExpiresAt,
+	}
+
+	return c, nil
+}
+
+// prune Drops expired tokens, g.mu must be held.
+func (g *Guard) prune() {
+	now := time.Now()
+
+	for token, p := range g.pending {
+		if now.After(p.expires) {
+			delete(g.pending, token)
+		}
+	}
+}
+
+func (g *Guard) write(r *http.Request, a Action, result string, err error) {
+	rec := audit.Record{
+		User:     auth.UserName(r.Context()),
+		Action:   a.Kind,
+		Upstream: a.Upstream,
+		UPS:      a.UPS,
+		Target:   a.Command,
+		OldValue: a.OldValue,
+		Value:    a.Value,
+		Result:   result,
+	}
+	if a.Kind == ActionVariable {
+		rec.Target = a.Variable
+	}
+	if host, _, splitErr := net.SplitHostPort(r.RemoteAddr); splitErr == nil {
+		rec.IP = host
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	g.audit.Write(rec)
+}
@@ -0,0 +1,131 @@
+package guard
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/audit"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/auth"
+)
+
+func TestGuard(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.New(file, 0, 0, false)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	g, err := New([]string{"shutdown.*", "load.off"}, "1m", auditLog)
+	require.NoError(t, err)
+
+	a, err := auth.New(true, true, []auth.User{
+		{Name: "operator", Token: "operator", Permissions: []string{auth.PermissionCommand}},
+		{Name: "admin", Token: "admin", Permissions: []string{auth.PermissionCommand, auth.PermissionDangerous}},
+	}, "")
+	require.NoError(t, err)
+
+	request := func(t *testing.T, user, confirmation string) *http.Request {
+		r := httptest.NewRequest("POST", "/api/v1/ups/ups/commands/shutdown.return", nil)
+		r.Header.Set("Authorization", "Bearer "+user)
+		if len(confirmation) > 0 {
+			r.Header.Set(ConfirmationHeader, confirmation)
+		}
+
+		r, err := a.Authorize(r, auth.PermissionCommand)
+		require.NoError(t, err)
+
+		return r
+	}
+
+	shutdown := Action{Kind: ActionCommand, Upstream: "default", UPS: "ups", Command: "shutdown.return"}
+	beeper := Action{Kind: ActionCommand, Upstream: "default", UPS: "ups", Command: "beeper.enable"}
+
+	t.Run("dangerous", func(t *testing.T) {
+		require.True(t, g.Dangerous(shutdown))
+		require.True(t, g.Dangerous(Action{Kind: ActionFSD, UPS: "ups"}))
+		require.False(t, g.Dangerous(beeper))
+
+		// the command carrying another command isn't matched by patterns
+		injected := beeper
+		injected.Command = "beeper.enable\nINSTCMD ups shutdown.return"
+		require.True(t, g.Dangerous(injected))
+	})
+
+	t.Run("not dangerous", func(t *testing.T) {
+		c, err := g.Check(request(t, "operator", ""), beeper)
+		require.NoError(t, err)
+		require.Nil(t, c)
+	})
+
+	t.Run("no permission", func(t *testing.T) {
+		_, err := g.Check(request(t, "operator", ""), shutdown)
+		require.True(t, errors.Is(err, auth.ErrForbidden))
+	})
+
+	t.Run("confirmation", func(t *testing.T) {
+		c, err := g.Check(request(t, "admin", ""), shutdown)
+		require.NoError(t, err)
+		require.NotNil(t, c)
+		require.NotEmpty(t, c.Token)
+
+		// the token is bound to the action
+		_, err = g.Check(request(t, "admin", c.Token), Action{Kind: ActionFSD, Upstream: "default", UPS: "ups"})
+		require.True(t, errors.Is(err, ErrInvalidConfirmation))
+
+		r := request(t, "admin", c.Token)
+		confirmed, err := g.Check(r, shutdown)
+		require.NoError(t, err)
+		require.Nil(t, confirmed)
+		g.Done(r, shutdown, nil)
+
+		// the token is single-use
+		_, err = g.Check(request(t, "admin", c.Token), shutdown)
+		require.True(t, errors.Is(err, ErrInvalidConfirmation))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c, err := g.Check(request(t, "admin", ""), shutdown)
+		require.NoError(t, err)
+
+		g.mu.Lock()
+		p := g.pending[c.Token]
+		p.expires = p.expires.Add(-2 * g.ttl)
+		g.pending[c.Token] = p
+		g.mu.Unlock()
+
+		_, err = g.Check(request(t, "admin", c.Token), shutdown)
+		require.True(t, errors.Is(err, ErrInvalidConfirmation))
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		defer f.Close()
+
+		var results []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec audit.Record
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+			results = append(results, rec.User+" "+rec.Result)
+		}
+		require.NoError(t, scanner.Err())
+
+		require.Equal(t, []string{
+			"operator " + audit.ResultDenied,
+			"admin " + audit.ResultConfirmationRequired,
+			"admin " + audit.ResultInvalidConfirmation,
+			"admin " + audit.ResultDone,
+			"admin " + audit.ResultInvalidConfirmation,
+			"admin " + audit.ResultConfirmationRequired,
+			"admin " + audit.ResultInvalidConfirmation,
+		}, results)
+	})
+}
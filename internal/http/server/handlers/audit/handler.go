@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	auditLog "github.com/andreyAKor/nut_client_service/internal/audit"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+)
+
+// Handler serves the audit trail:
+//
+//	GET /api/v1/audit?user=&upstream=&ups=&action=&target=&result=&from=&to=&limit=
+//	GET /api/v1/audit/verify
+type Handler struct {
+	log *auditLog.Log
+}
+
+func New(log *auditLog.Log) *Handler {
+	return &Handler{
+		log: log,
+	}
+}
+
+// List Returns the latest audit records matching parameters, the newest is the first,
+// from and to are RFC 3339 times.
+func (h *Handler) List() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		f, err := prepareFilter(r)
+		if err != nil {
+			return nil, errors.Wrapf(handlers.ErrInvalidRequest, "prepare filter fail: %s", err)
+		}
+
+		records, err := h.log.Query(f)
+		if err != nil {
+			log.Error().Err(err).Msg("query audit log fail")
+
+			return nil, errors.Wrap(err, "query audit log fail")
+		}
+
+		return records, nil
+	}
+}
+
+// Verify Checks the hash chain of the audit trail.
+func (h *Handler) Verify() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		count, err := h.log.Verify()
+		switch {
+		case errors.Is(err, auditLog.ErrHashChainDisabled):
+			return nil, errors.Wrap(handlers.ErrInvalidRequest, err.Error())
+		case errors.Is(err, auditLog.ErrTampered):
+			log.Warn().Err(err).Msg("audit log is tampered")
+
+			return verification{Records: count, Error: err.Error()}, nil
+		case err != nil:
+			log.Error().Err(err).Msg("verify audit log fail")
+
+			return nil, errors.Wrap(err, "verify audit log fail")
+		}
+
+		return verification{Valid: true, Records: count}, nil
+	}
+}
+
+func prepareFilter(r *http.Request) (auditLog.Filter, error) {
+	q := r.URL.Query()
+
+	f := auditLog.Filter{
+		User:     q.Get("user"),
+		Upstream: q.Get("upstream"),
+		UPS:      q.Get("ups"),
+		Action:   q.Get("action"),
+		Target:   q.Get("target"),
+		Result:   q.Get("result"),
+	}
+
+	var err error
+
+	if v := q.Get("from"); len(v) > 0 {
+		if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, errors.Wrapf(err, "from %q", v)
+		}
+	}
+	if v := q.Get("to"); len(v) > 0 {
+		if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, errors.Wrapf(err, "to %q", v)
+		}
+	}
+	if v := q.Get("limit"); len(v) > 0 {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 {
+			return f, errors.Errorf("limit %q", v)
+		}
+	}
+
+	return f, nil
+}
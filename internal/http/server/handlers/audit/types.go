@@ -0,0 +1,9 @@
+package audit
+
+type verification struct {
+	Valid bool `json:"valid"`
+
+	// Number of records checked before the first broken one
+	Records int    `json:"records"`
+	Error   string `json:"error,omitempty"`
+}
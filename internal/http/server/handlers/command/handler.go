@@ -10,15 +10,23 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/auth"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
 )
 
 type Handler struct {
-	nutClient *nut.Client
+	upstreams *nut.Upstreams
+	store     *snapshot.Store
+	guard     *guard.Guard
 }
 
-func New(nutClient *nut.Client) *Handler {
+func New(upstreams *nut.Upstreams, store *snapshot.Store, g *guard.Guard) *Handler {
 	return &Handler{
-		nutClient: nutClient,
+		upstreams: upstreams,
+		store:     store,
+		guard:     g,
 	}
 }
 
@@ -26,14 +34,63 @@ func (h *Handler) Handle() func(http.ResponseWriter, *http.Request) (interface{}
 	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 		req, err := prepareCommand(r)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
 			log.Error().Err(err).Msg("prepare command struct from request body fail")
 
-			return nil, errors.Wrap(err, "prepare command struct from request body fail")
+			return nil, errors.Wrapf(handlers.ErrInvalidRequest, "prepare command struct from request body fail: %s", err)
 		}
 
-		if err := h.nutClient.SendCommand(r.Context(), req.Name, req.Command); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		upstream, err := h.upstreams.Resolve(req.Upstream)
+		if err != nil {
+			log.Error().Err(err).Msg("resolve upstream fail")
+
+			return nil, errors.Wrap(err, "resolve upstream fail")
+		}
+
+		// only the UPS and the command listed by upsd are sent to it
+		ups, err := handlers.FindUPS(r.Context(), h.upstreams, h.store, upstream, req.Name)
+		if err != nil {
+			log.Warn().Err(err).Msg("find UPS fail")
+
+			return nil, errors.Wrap(err, "find UPS fail")
+		}
+		if !handlers.HasCommand(ups, req.Command) {
+			return nil, errors.Wrapf(nut.ErrUnknownCommand, "command %q", req.Command)
+		}
+
+		if err := auth.CheckCommand(r.Context(), req.Command); err != nil {
+			log.Warn().Err(err).Msg("check command fail")
+
+			return nil, errors.Wrap(err, "check command fail")
+		}
+
+		action := guard.Action{
+			Kind:     guard.ActionCommand,
+			Upstream: upstream,
+			UPS:      req.Name,
+			Command:  req.Command,
+		}
+		confirmation, err := h.guard.Check(r, action)
+		if err != nil {
+			log.Warn().Err(err).Msg("check dangerous command fail")
+
+			return nil, errors.Wrap(err, "check dangerous command fail")
+		}
+		if confirmation != nil {
+			w.WriteHeader(http.StatusAccepted)
+
+			return confirmation, nil
+		}
+
+		nutClient, err := h.upstreams.Get(upstream)
+		if err != nil {
+			log.Error().Err(err).Msg("get upstream fail")
+
+			return nil, errors.Wrap(err, "get upstream fail")
+		}
+
+		err = nutClient.SendCommand(r.Context(), req.Name, req.Command)
+		h.guard.Done(r, action, err)
+		if err != nil {
 			log.Error().Err(err).Msg("send command fail")
 
 			return nil, errors.Wrap(err, "send command fail")
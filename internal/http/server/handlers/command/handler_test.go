@@ -0,0 +1,84 @@
+package command
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/audit"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// closedPort Returns the port which isn't listened, so connections to it are refused.
+func closedPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestHandle(t *testing.T) {
+	auditLog, err := audit.New(filepath.Join(t.TempDir(), "audit.log"), 0, 0, false)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	g, err := guard.New([]string{"shutdown.*"}, "1m", auditLog)
+	require.NoError(t, err)
+
+	c, err := nut.New("127.0.0.1", closedPort(t), "", "", 1, "1m", "1m", "1h", nut.TLS{})
+	require.NoError(t, err)
+
+	upstreams := nut.NewUpstreams()
+	require.NoError(t, upstreams.Add("main", c))
+
+	store := snapshot.New()
+	store.Set(snapshot.Snapshot{
+		Upstream: "main",
+		Time:     time.Now(),
+		List: []*nut_client.UPS{{
+			Name:     "ups",
+			Commands: []nut_client.Command{{Name: "beeper.enable"}, {Name: "shutdown.return"}},
+		}},
+	})
+
+	handle := New(upstreams, store, g).Handle()
+
+	send := func(body string) (int, interface{}, error) {
+		w := httptest.NewRecorder()
+		res, err := handle(w, httptest.NewRequest("POST", "/command", strings.NewReader(body)))
+
+		return w.Code, res, err
+	}
+
+	t.Run("not listed", func(t *testing.T) {
+		for _, command := range []string{`beeper.enable\nINSTCMD ups shutdown.return`, "shutdown.stayoff", "beeper.enable "} {
+			_, res, err := send(`{"name":"ups","command":"` + command + `"}`)
+			require.ErrorIs(t, err, nut.ErrUnknownCommand, command)
+			require.Nil(t, res)
+		}
+
+		_, _, err := send(`{"name":"typo","command":"beeper.enable"}`)
+		require.ErrorIs(t, err, nut.ErrUnknownUPS)
+	})
+	t.Run("dangerous", func(t *testing.T) {
+		status, res, err := send(`{"name":"ups","command":"shutdown.return"}`)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusAccepted, status)
+		require.IsType(t, &guard.Confirmation{}, res)
+	})
+	t.Run("sent", func(t *testing.T) {
+		// the listed command is sent to the upstream which is down
+		_, _, err := send(`{"name":"ups","command":"beeper.enable"}`)
+		require.ErrorIs(t, err, nut.ErrUnavailable)
+	})
+}
@@ -1,6 +1,7 @@
 package command
 
 type command struct {
-	Name    string `json:"name"`
-	Command string `json:"command"`
+	Upstream string `json:"upstream"`
+	Name     string `json:"name"`
+	Command  string `json:"command"`
 }
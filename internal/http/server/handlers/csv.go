@@ -0,0 +1,9 @@
+package handlers
+
+import "io"
+
+// CSVWriter is implemented by responses which can be exported as CSV, the server writes them as CSV
+// if the request has the format=csv parameter.
+type CSVWriter interface {
+	WriteCSV(w io.Writer) error
+}
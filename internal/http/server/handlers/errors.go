@@ -0,0 +1,8 @@
+// Package handlers contains errors and response interfaces shared by the API handlers, the server maps errors
+// to HTTP statuses.
+package handlers
+
+import "github.com/pkg/errors"
+
+// ErrInvalidRequest is the error of the request which can't be parsed, e.g. the malformed JSON body.
+var ErrInvalidRequest = errors.New("invalid request")
@@ -0,0 +1,276 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	powerEvents "github.com/andreyAKor/nut_client_service/internal/events"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// keepAliveInterval is the interval of comments sent to keep idle connections open.
+const keepAliveInterval = time.Second * 15
+
+// state is variable values by UPS name.
+type state map[string]map[string]interface{}
+
+// Handler serves UPS state changes and power events.
+type Handler struct {
+	store  *snapshot.Store
+	engine *powerEvents.Engine
+}
+
+func New(store *snapshot.Store, engine *powerEvents.Engine) *Handler {
+	return &Handler{
+		store:  store,
+		engine: engine,
+	}
+}
+
+// Recent Returns the latest power events, the newest is the first, e.g. /api/v1/events/recent?limit=10.
+func (h *Handler) Recent() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		var limit int
+
+		if l := r.URL.Query().Get("limit"); len(l) > 0 {
+			var err error
+
+			if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+				return nil, errors.Wrapf(handlers.ErrInvalidRequest, "limit %q", l)
+			}
+		}
+
+		return h.engine.Recent(limit), nil
+	}
+}
+
+// Stream Streams UPS state changes by Server-Sent Events, e.g. /api/v1/events?ups=ups@rack1&prefix=battery.
+//
+// The "snapshot" event with the full state is sent on connect, then "change" events are sent when variables
+// change in snapshots taken by the poller, so subscribers don't open NUT sessions. Both ups and prefix
+// parameters may be repeated, everything is streamed if they're absent.
+func (h *Handler) Stream() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+
+			return
+		}
+
+		f := filter{
+			ups:      r.URL.Query()["ups"],
+			prefixes: r.URL.Query()["prefix"],
+		}
+
+		// subscribe before reading the initial state, so no change is missed
+		snapshots, cancel := h.store.Subscribe()
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		states := make(map[string]state)
+
+		var initial []upsState
+
+		for _, s := range h.store.List() {
+			states[s.Upstream] = f.state(s)
+			initial = append(initial, toUPSStates(s.Upstream, states[s.Upstream])...)
+		}
+
+		if err := writeEvent(w, "snapshot", initial); err != nil {
+			log.Warn().Err(err).Msg("write snapshot event fail")
+
+			return
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case s := <-snapshots:
+				next := f.state(s)
+
+				for _, c := range diff(s.Upstream, s.Time, states[s.Upstream], next) {
+					if err := writeEvent(w, "change", c); err != nil {
+						log.Warn().Err(err).Msg("write change event fail")
+
+						return
+					}
+				}
+
+				states[s.Upstream] = next
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+// filter selects UPSes by name or "name@upstream" and variables by name prefix.
+type filter struct {
+	ups      []string
+	prefixes []string
+}
+
+// state Returns filtered variable values of the snapshot.
+func (f filter) state(s snapshot.Snapshot) state {
+	res := make(state)
+
+	for _, ups := range s.List {
+		if !f.upsAllowed(s.Upstream, ups) {
+			continue
+		}
+
+		vars := make(map[string]interface{})
+		for _, v := range ups.Variables {
+			if f.variableAllowed(v.Name) {
+				vars[v.Name] = v.Value
+			}
+		}
+
+		res[ups.Name] = vars
+	}
+
+	return res
+}
+
+func (f filter) upsAllowed(upstream string, ups *nut_client.UPS) bool {
+	if len(f.ups) == 0 {
+		return true
+	}
+
+	for _, name := range f.ups {
+		if name == ups.Name || name == ups.Name+"@"+upstream {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f filter) variableAllowed(name string) bool {
+	if len(f.prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diff Returns changes of UPSes between the previous and the next state of the upstream.
+func diff(upstream string, timestamp time.Time, prev, next state) []upsChange {
+	var res []upsChange
+
+	for _, name := range sortedNames(prev, next) {
+		prevVars, hadUPS := prev[name]
+		nextVars, hasUPS := next[name]
+
+		c := upsChange{
+			Timestamp: timestamp,
+			Upstream:  upstream,
+			UPS:       name,
+		}
+
+		if !hasUPS {
+			c.Gone = true
+			res = append(res, c)
+
+			continue
+		}
+
+		for variable, value := range nextVars {
+			if prevValue, ok := prevVars[variable]; !hadUPS || !ok || prevValue != value {
+				if c.Changed == nil {
+					c.Changed = make(map[string]interface{})
+				}
+
+				c.Changed[variable] = value
+			}
+		}
+		for variable := range prevVars {
+			if _, ok := nextVars[variable]; !ok {
+				c.Removed = append(c.Removed, variable)
+			}
+		}
+
+		if len(c.Changed) > 0 || len(c.Removed) > 0 {
+			sort.Strings(c.Removed)
+			res = append(res, c)
+		}
+	}
+
+	return res
+}
+
+// sortedNames Returns UPS names of both states sorted.
+func sortedNames(states ...state) []string {
+	seen := make(map[string]struct{})
+
+	var names []string
+
+	for _, s := range states {
+		for name := range s {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func toUPSStates(upstream string, s state) []upsState {
+	res := make([]upsState, 0, len(s))
+	for _, name := range sortedNames(s) {
+		res = append(res, upsState{
+			Upstream:  upstream,
+			UPS:       name,
+			Variables: s[name],
+		})
+	}
+
+	return res
+}
+
+// writeEvent Writes the event with the JSON data.
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	res, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "JSON-marshal fail")
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, res); err != nil {
+		return errors.Wrap(err, "write fail")
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	now := time.Now()
+
+	t.Run("changed and removed", func(t *testing.T) {
+		prev := state{"ups": {"battery.charge": int64(100), "ups.status": "OL", "ups.load": int64(20)}}
+		next := state{"ups": {"battery.charge": int64(99), "ups.status": "OL"}}
+
+		require.Equal(t, []upsChange{{
+			Timestamp: now,
+			Upstream:  "default",
+			UPS:       "ups",
+			Changed:   map[string]interface{}{"battery.charge": int64(99)},
+			Removed:   []string{"ups.load"},
+		}}, diff("default", now, prev, next))
+	})
+
+	t.Run("unchanged", func(t *testing.T) {
+		s := state{"ups": {"ups.status": "OL"}}
+
+		require.Empty(t, diff("default", now, s, s))
+	})
+
+	t.Run("appeared and gone", func(t *testing.T) {
+		prev := state{"old": {"ups.status": "OL"}}
+		next := state{"new": {"ups.status": "OB"}}
+
+		require.Equal(t, []upsChange{
+			{Timestamp: now, Upstream: "default", UPS: "new", Changed: map[string]interface{}{"ups.status": "OB"}},
+			{Timestamp: now, Upstream: "default", UPS: "old", Gone: true},
+		}, diff("default", now, prev, next))
+	})
+}
@@ -0,0 +1,22 @@
+package events
+
+import "time"
+
+// upsState is the state of the UPS sent by the snapshot event.
+type upsState struct {
+	Upstream  string                 `json:"upstream"`
+	UPS       string                 `json:"ups"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// upsChange is the change of the UPS sent by the change event.
+type upsChange struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Upstream  string                 `json:"upstream"`
+	UPS       string                 `json:"ups"`
+	Changed   map[string]interface{} `json:"changed,omitempty"`
+	Removed   []string               `json:"removed,omitempty"`
+
+	// The UPS isn't provided by the upstream anymore
+	Gone bool `json:"gone,omitempty"`
+}
@@ -0,0 +1,73 @@
+package outages
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+	"github.com/andreyAKor/nut_client_service/internal/outages"
+)
+
+// Handler serves the outage journal:
+//
+//	GET /api/v1/outages?upstream=&ups=&endReason=&from=&to=&minDuration=&limit=
+type Handler struct {
+	journal *outages.Journal
+}
+
+func New(journal *outages.Journal) *Handler {
+	return &Handler{
+		journal: journal,
+	}
+}
+
+// List Returns the latest outages matching parameters, the newest is the first, from and to are
+// RFC 3339 times of the start of outages, minDuration is the duration, e.g. "5m".
+func (h *Handler) List() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		f, err := prepareFilter(r)
+		if err != nil {
+			return nil, errors.Wrapf(handlers.ErrInvalidRequest, "prepare filter fail: %s", err)
+		}
+
+		return h.journal.List(f), nil
+	}
+}
+
+func prepareFilter(r *http.Request) (outages.Filter, error) {
+	q := r.URL.Query()
+
+	f := outages.Filter{
+		Upstream:  q.Get("upstream"),
+		UPS:       q.Get("ups"),
+		EndReason: q.Get("endReason"),
+	}
+
+	var err error
+
+	if v := q.Get("from"); len(v) > 0 {
+		if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, errors.Wrapf(err, "from %q", v)
+		}
+	}
+	if v := q.Get("to"); len(v) > 0 {
+		if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, errors.Wrapf(err, "to %q", v)
+		}
+	}
+	if v := q.Get("minDuration"); len(v) > 0 {
+		if f.MinDuration, err = time.ParseDuration(v); err != nil {
+			return f, errors.Wrapf(err, "minDuration %q", v)
+		}
+	}
+	if v := q.Get("limit"); len(v) > 0 {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 {
+			return f, errors.Errorf("limit %q", v)
+		}
+	}
+
+	return f, nil
+}
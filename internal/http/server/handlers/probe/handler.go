@@ -0,0 +1,137 @@
+package probe
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	metricsNut "github.com/andreyAKor/nut_client_service/internal/metrics/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+const (
+	defaultPort   = 3493
+	defaultModule = "default"
+)
+
+var (
+	ErrTargetRequired   = errors.New("target parameter is required")
+	ErrUnknownModule    = errors.New("unknown module")
+	ErrTargetNotAllowed = errors.New("target isn't allowed by the module")
+)
+
+// Handler probes the NUT server given by the target parameter and responds with its UPS metrics,
+// e.g. /probe?target=192.168.0.10:3493&module=default.
+type Handler struct {
+	modules map[string]Module
+}
+
+func New(modules map[string]Module) *Handler {
+	return &Handler{
+		modules: modules,
+	}
+}
+
+func (h *Handler) Handle() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registry, closer, err := h.registry(r)
+		if err != nil {
+			log.Warn().Err(err).Msg("probe fail")
+
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrTargetNotAllowed) {
+				status = http.StatusForbidden
+			}
+
+			http.Error(w, err.Error(), status)
+
+			return
+		}
+		defer func() {
+			if err := closer(); err != nil {
+				log.Warn().Err(err).Msg("NUT client closing fail")
+			}
+		}()
+
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// registry Returns the registry with metrics of the target NUT server and the closer of its client.
+func (h *Handler) registry(r *http.Request) (*prometheus.Registry, func() error, error) {
+	target := r.URL.Query().Get("target")
+
+	host, port, err := parseTarget(target)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "target parsing fail")
+	}
+
+	name := r.URL.Query().Get("module")
+	if name == "" {
+		name = defaultModule
+	}
+
+	module, ok := h.modules[name]
+	if !ok && name != defaultModule {
+		return nil, nil, errors.Wrapf(ErrUnknownModule, "module %q", name)
+	}
+
+	// credentials of the module are sent to the target, so it mustn't be chosen by the caller freely
+	if !module.allowed(host) {
+		return nil, nil, errors.Wrapf(ErrTargetNotAllowed, "module %q, target %q", name, target)
+	}
+
+	nutClient, err := nut.New(host, port, module.Username, module.Password, 1, "1m", "1m", "1h", module.TLS)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "NUT client init fail")
+	}
+
+	metrics, err := metricsNut.New(
+		metricsNut.ModeScrape,
+		module.InfoAllow,
+		module.InfoDeny,
+		[]metricsNut.Upstream{{Name: target, Client: nutClient}},
+		snapshot.New(),
+	)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "NUT metrics init fail")
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(metrics); err != nil {
+		return nil, nil, errors.Wrap(err, "NUT metrics registering fail")
+	}
+
+	return registry, nutClient.Close, nil
+}
+
+// parseTarget Splits the target to host and port, the default NUT port is used if it's absent.
+func parseTarget(target string) (string, int, error) {
+	if target == "" {
+		return "", 0, ErrTargetRequired
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		// the target without port, e.g. "[::1]"
+		if strings.HasPrefix(target, "[") && strings.HasSuffix(target, "]") {
+			target = target[1 : len(target)-1]
+		}
+
+		return target, defaultPort, nil
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "port parsing fail (%s)", portStr)
+	}
+
+	return host, port, nil
+}
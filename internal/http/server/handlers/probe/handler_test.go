@@ -0,0 +1,61 @@
+package probe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	for target, want := range map[string]struct {
+		host string
+		port int
+	}{
+		"192.168.0.10":      {"192.168.0.10", defaultPort},
+		"192.168.0.10:3494": {"192.168.0.10", 3494},
+		"[::1]":             {"::1", defaultPort},
+		"[::1]:3494":        {"::1", 3494},
+		"::1":               {"::1", defaultPort},
+	} {
+		host, port, err := parseTarget(target)
+		require.NoError(t, err, target)
+		require.Equal(t, want.host, host, target)
+		require.Equal(t, want.port, port, target)
+	}
+
+	_, _, err := parseTarget("")
+	require.ErrorIs(t, err, ErrTargetRequired)
+}
+
+func TestHandle(t *testing.T) {
+	h := New(map[string]Module{
+		"default": {Username: "monitor", Password: "secret", Targets: []string{"192.168.0.*", "::1"}},
+		"open":    {},
+	})
+
+	probe := func(query string) int {
+		w := httptest.NewRecorder()
+		h.Handle()(w, httptest.NewRequest("GET", "/probe?"+query, nil))
+
+		return w.Code
+	}
+
+	t.Run("not allowed", func(t *testing.T) {
+		// credentials of the module aren't sent to the target chosen by the caller
+		require.Equal(t, http.StatusForbidden, probe("target=attacker.example:3493"))
+		require.Equal(t, http.StatusForbidden, probe("target=192.168.1.10"))
+	})
+	t.Run("without credentials", func(t *testing.T) {
+		require.NotEqual(t, http.StatusForbidden, probe("target=127.0.0.1:1&module=open"))
+	})
+	t.Run("allowed", func(t *testing.T) {
+		require.True(t, h.modules["default"].allowed("192.168.0.10"))
+		require.True(t, h.modules["default"].allowed("::1"))
+		require.False(t, Module{Username: "monitor"}.allowed("192.168.0.10"))
+	})
+	t.Run("unknown module", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, probe("target=192.168.0.10&module=other"))
+	})
+}
@@ -0,0 +1,39 @@
+package probe
+
+import (
+	"path"
+
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+)
+
+// Module is the named set of settings used to probe NUT servers.
+type Module struct {
+	Username string
+	Password string
+
+	// Name patterns of string variables exported as info metrics
+	InfoAllow []string
+	InfoDeny  []string
+
+	// STARTTLS settings, the server name is the target host if it's empty
+	TLS nut.TLS
+
+	// Host patterns of targets the module probes, e.g. "192.168.0.*". The module with credentials
+	// probes no target if it's empty, the module without credentials probes any target.
+	Targets []string
+}
+
+// allowed Checks whether the module probes the target host.
+func (m Module) allowed(host string) bool {
+	if len(m.Targets) == 0 {
+		return len(m.Username) == 0 && len(m.Password) == 0
+	}
+
+	for _, p := range m.Targets {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
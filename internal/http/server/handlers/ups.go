@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/pkg/errors"
+
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// FindUPS Returns the UPS of the upstream from the latest snapshot, the UPS list is read from NUT
+// if the poller hasn't got the snapshot yet. The error is nut.ErrUnknownUPS if the UPS isn't listed.
+func FindUPS(
+	ctx context.Context,
+	upstreams *nut.Upstreams,
+	store *snapshot.Store,
+	upstream, name string,
+) (*nut_client.UPS, error) {
+	s, ok := store.Get(upstream)
+	if !ok {
+		nutClient, err := upstreams.Get(upstream)
+		if err != nil {
+			return nil, errors.Wrap(err, "get upstream fail")
+		}
+
+		list, err := nutClient.GetUPSList(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "get UPS list fail")
+		}
+
+		s = snapshot.Snapshot{
+			Upstream: upstream,
+			Time:     time.Now(),
+			List:     list,
+		}
+		store.Set(s)
+	}
+
+	ups, ok := s.UPS(name)
+	if !ok {
+		return nil, errors.Wrapf(nut.ErrUnknownUPS, "UPS %q", name)
+	}
+
+	return ups, nil
+}
+
+// FindVariable Returns the variable of the UPS, the error is nut.ErrUnknownVariable if it isn't listed.
+func FindVariable(ups *nut_client.UPS, name string) (nut_client.Variable, error) {
+	for _, v := range ups.Variables {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+
+	return nut_client.Variable{}, errors.Wrapf(nut.ErrUnknownVariable, "variable %q", name)
+}
+
+// HasCommand Checks whether the instant command is listed by the UPS.
+func HasCommand(ups *nut_client.UPS, name string) bool {
+	for _, c := range ups.Commands {
+		if c.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package ups
+
+import (
+	"github.com/andreyAKor/nut_client"
+
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// constraintFunc Returns the constraint of the variable of the UPS of the upstream if it's known.
+type constraintFunc func(upstream, ups, variable string) (nut.Constraint, bool)
+
+// convertSnapshotsToSnapshot Merges snapshots of upstreams, the time of the oldest one is used.
+func convertSnapshotsToSnapshot(l []snapshot.Snapshot, constraint constraintFunc) Snapshot {
+	res := Snapshot{
+		List: []UPS{},
+	}
+	for _, s := range l {
+		if res.Timestamp.IsZero() || s.Time.Before(res.Timestamp) {
+			res.Timestamp = s.Time
+			res.Age = s.Age().Seconds()
+		}
+
+		res.List = append(res.List, convertListToList(s.Upstream, s.List, constraint)...)
+	}
+	return res
+}
+
+func convertListToList(upstream string, l []*nut_client.UPS, constraint constraintFunc) []UPS {
+	var res []UPS
+	for _, v := range l {
+		res = append(res, convertUPSToUPS(upstream, v, constraint))
+	}
+	return res
+}
+
+func convertUPSToUPS(upstream string, v *nut_client.UPS, constraint constraintFunc) UPS {
+	return UPS{
+		Upstream:       upstream,
+		Name:           v.Name,
+		Description:    v.Description,
+		Master:         v.Master,
+		NumberOfLogins: v.NumberOfLogins,
+		Clients:        v.Clients,
+		Variables:      convertVariableToVariable(upstream, v.Name, v.Variables, constraint),
+		Commands:       convertCommandsToCommands(v.Commands),
+	}
+}
+
+func convertVariableToVariable(upstream, ups string, l []nut_client.Variable, constraint constraintFunc) []Variable {
+	var res []Variable
+	for _, v := range l {
+		variable := Variable{
+			Name:          v.Name,
+			Value:         v.Value,
+			Type:          v.Type,
+			Description:   v.Description,
+			Writeable:     v.Writeable,
+			MaximumLength: v.MaximumLength,
+			OriginalType:  v.OriginalType,
+		}
+		if c, ok := constraint(upstream, ups, v.Name); ok {
+			variable.Enum = c.Enum
+			variable.Range = c.Ranges
+		}
+
+		res = append(res, variable)
+	}
+	return res
+}
+
+func convertCommandsToCommands(l []nut_client.Command) []Command {
+	var res []Command
+	for _, v := range l {
+		res = append(res, Command{
+			Name:        v.Name,
+			Description: v.Description,
+		})
+	}
+	return res
+}
@@ -0,0 +1,489 @@
+package ups
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/andreyAKor/nut_client_service/internal/history"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/auth"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/router"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+var ErrAmbiguousUPS = errors.New("UPS name is ambiguous, use name@upstream")
+
+// Handler serves the UPS resources:
+//
+//	GET /api/v1/ups
+//	GET /api/v1/ups/{name}
+//	GET /api/v1/ups/{name}/variables
+//	GET /api/v1/ups/{name}/variables/{var}
+//	PUT /api/v1/ups/{name}/variables/{var}
+//	GET /api/v1/ups/{name}/commands
+//	POST /api/v1/ups/{name}/commands/{cmd}
+//	POST /api/v1/ups/{name}/fsd
+//	GET /api/v1/ups/{name}/history?variable=&from=&to=&step=&format=csv
+//
+// Dangerous commands and FSD need the confirmation, see guard.Guard.
+// The name is "ups@upstream" or just "ups" if the UPS name is unique among upstreams.
+type Handler struct {
+	upstreams *nut.Upstreams
+	store     *snapshot.Store
+	guard     *guard.Guard
+	history   *history.Store
+}
+
+func New(upstreams *nut.Upstreams, store *snapshot.Store, g *guard.Guard, historyStore *history.Store) *Handler {
+	return &Handler{
+		upstreams: upstreams,
+		store:     store,
+		guard:     g,
+		history:   historyStore,
+	}
+}
+
+// List Returns all UPSes of all upstreams.
+func (h *Handler) List() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		snapshots, failures, err := h.snapshots(r)
+		if err != nil {
+			log.Error().Err(err).Msg("get snapshots fail")
+
+			return nil, errors.Wrap(err, "get snapshots fail")
+		}
+
+		res := convertSnapshotsToSnapshot(snapshots, h.constraint)
+		for _, f := range failures {
+			res.Errors = append(res.Errors, UpstreamError{Upstream: f.upstream, Error: f.err.Error()})
+		}
+
+		return res, nil
+	}
+}
+
+// Get Returns the UPS.
+func (h *Handler) Get() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return h.withUPS(func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error) {
+		return convertUPSToUPS(upstream, ups, h.constraint), nil
+	})
+}
+
+// Variables Returns variables of the UPS.
+func (h *Handler) Variables() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return h.withUPS(func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error) {
+		return convertVariableToVariable(upstream, ups.Name, ups.Variables, h.constraint), nil
+	})
+}
+
+// Variable Returns the variable of the UPS.
+func (h *Handler) Variable() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return h.withUPS(func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error) {
+		v, err := handlers.FindVariable(ups, router.Param(r, "var"))
+		if err != nil {
+			return nil, err
+		}
+
+		return convertVariableToVariable(upstream, ups.Name, []nut_client.Variable{v}, h.constraint)[0], nil
+	})
+}
+
+// SetVariable Sets the value of the variable of the UPS.
+func (h *Handler) SetVariable() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return h.withUPS(func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error) {
+		v, err := handlers.FindVariable(ups, router.Param(r, "var"))
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := prepareValue(r)
+		if err != nil {
+			log.Error().Err(err).Msg("prepare value struct from request body fail")
+
+			return nil, errors.Wrapf(handlers.ErrInvalidRequest, "prepare value struct from request body fail: %s", err)
+		}
+
+		nutClient, err := h.upstreams.Get(upstream)
+		if err != nil {
+			return nil, errors.Wrap(err, "get upstream fail")
+		}
+
+		action := guard.Action{
+			Kind:     guard.ActionVariable,
+			Upstream: upstream,
+			UPS:      ups.Name,
+			Variable: v.Name,
+			OldValue: fmt.Sprint(v.Value),
+			Value:    req.Value,
+		}
+		err = nutClient.SetVariable(r.Context(), ups.Name, v.Name, req.Value)
+		h.guard.Done(r, action, err)
+		if err != nil {
+			log.Error().Err(err).Msg("set variable fail")
+
+			return nil, errors.Wrap(err, "set variable fail")
+		}
+
+		return nil, nil
+	})
+}
+
+// Commands Returns instant commands of the UPS.
+func (h *Handler) Commands() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return h.withUPS(func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error) {
+		return convertCommandsToCommands(ups.Commands), nil
+	})
+}
+
+// SendCommand Sends the instant command to the UPS.
+func (h *Handler) SendCommand() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return h.withUPS(func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error) {
+		command := router.Param(r, "cmd")
+		if !handlers.HasCommand(ups, command) {
+			return nil, errors.Wrapf(nut.ErrUnknownCommand, "command %q", command)
+		}
+		if err := auth.CheckCommand(r.Context(), command); err != nil {
+			log.Warn().Err(err).Msg("check command fail")
+
+			return nil, errors.Wrap(err, "check command fail")
+		}
+
+		action := guard.Action{
+			Kind:     guard.ActionCommand,
+			Upstream: upstream,
+			UPS:      ups.Name,
+			Command:  command,
+		}
+		confirmation, err := h.guard.Check(r, action)
+		if err != nil {
+			log.Warn().Err(err).Msg("check dangerous command fail")
+
+			return nil, errors.Wrap(err, "check dangerous command fail")
+		}
+		if confirmation != nil {
+			w.WriteHeader(http.StatusAccepted)
+
+			return confirmation, nil
+		}
+
+		nutClient, err := h.upstreams.Get(upstream)
+		if err != nil {
+			return nil, errors.Wrap(err, "get upstream fail")
+		}
+
+		err = nutClient.SendCommand(r.Context(), ups.Name, command)
+		h.guard.Done(r, action, err)
+		if err != nil {
+			log.Error().Err(err).Msg("send command fail")
+
+			return nil, errors.Wrap(err, "send command fail")
+		}
+
+		return nil, nil
+	})
+}
+
+// ForceShutdown Sets the forced shutdown flag on the UPS, it always needs the confirmation.
+func (h *Handler) ForceShutdown() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return h.withUPS(func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error) {
+		action := guard.Action{
+			Kind:     guard.ActionFSD,
+			Upstream: upstream,
+			UPS:      ups.Name,
+		}
+		confirmation, err := h.guard.Check(r, action)
+		if err != nil {
+			log.Warn().Err(err).Msg("check FSD fail")
+
+			return nil, errors.Wrap(err, "check FSD fail")
+		}
+		if confirmation != nil {
+			w.WriteHeader(http.StatusAccepted)
+
+			return confirmation, nil
+		}
+
+		nutClient, err := h.upstreams.Get(upstream)
+		if err != nil {
+			return nil, errors.Wrap(err, "get upstream fail")
+		}
+
+		err = nutClient.ForceShutdown(r.Context(), ups.Name)
+		h.guard.Done(r, action, err)
+		if err != nil {
+			log.Error().Err(err).Msg("force shutdown fail")
+
+			return nil, errors.Wrap(err, "force shutdown fail")
+		}
+
+		return nil, nil
+	})
+}
+
+// History Returns the time series of variables of the UPS, variable is a comma-separated list of variables,
+// from and to are RFC 3339 times, the last hour by default, and step is the duration, e.g. "5m".
+// Series are exported as CSV by format=csv.
+func (h *Handler) History() func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return h.withUPS(func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error) {
+		q, variables, err := prepareHistoryQuery(r)
+		if err != nil {
+			return nil, errors.Wrapf(handlers.ErrInvalidRequest, "prepare history query fail: %s", err)
+		}
+
+		q.Upstream, q.UPS = upstream, ups.Name
+
+		res := History{
+			Upstream: upstream,
+			UPS:      ups.Name,
+			From:     q.From,
+			To:       q.To,
+			Series:   make([]Series, 0, len(variables)),
+		}
+
+		for _, v := range variables {
+			q.Variable = v
+
+			points, step, err := h.history.Query(q)
+			if err != nil {
+				log.Error().Err(err).Msg("query history fail")
+
+				return nil, errors.Wrap(err, "query history fail")
+			}
+
+			res.Step = step.Seconds()
+			res.Series = append(res.Series, Series{Variable: v, Points: points})
+		}
+
+		return res, nil
+	})
+}
+
+// constraint Returns the constraint of the variable cached by the upstream client.
+func (h *Handler) constraint(upstream, ups, variable string) (nut.Constraint, bool) {
+	nutClient, err := h.upstreams.Get(upstream)
+	if err != nil {
+		return nut.Constraint{}, false
+	}
+
+	return nutClient.Constraint(ups, variable)
+}
+
+// withUPS Finds the UPS given by the name parameter and passes it to the handler.
+func (h *Handler) withUPS(
+	handler func(w http.ResponseWriter, r *http.Request, upstream string, ups *nut_client.UPS) (interface{}, error),
+) func(http.ResponseWriter, *http.Request) (interface{}, error) {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		snapshots, failures, err := h.snapshots(r)
+		if err != nil {
+			log.Error().Err(err).Msg("get snapshots fail")
+
+			return nil, errors.Wrap(err, "get snapshots fail")
+		}
+
+		name := router.Param(r, "name")
+
+		upstream, ups, err := findUPS(snapshots, name)
+		if errors.Is(err, nut.ErrUnknownUPS) {
+			// the UPS may be of the upstream which isn't read
+			if f, ok := findFailure(failures, name); ok {
+				return nil, errors.Wrapf(f.err, "get UPS list of upstream %q fail", f.upstream)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(w, r, upstream, ups)
+	}
+}
+
+// failure is the error of reading the upstream.
+type failure struct {
+	upstream string
+	err      error
+}
+
+// snapshots Returns the latest snapshots of all upstreams, they are read from NUT
+// if it's requested by the fresh parameter or the poller hasn't got the snapshot yet.
+//
+// Upstreams which can't be read are returned as failures, the snapshot of the poller is used
+// if it's there. The error is returned only if no upstream is read.
+func (h *Handler) snapshots(r *http.Request) ([]snapshot.Snapshot, []failure, error) {
+	fresh := r.URL.Query().Get("fresh") == "true"
+
+	var (
+		snapshots []snapshot.Snapshot
+		failures  []failure
+	)
+
+	for _, name := range h.upstreams.Names() {
+		s, ok := h.store.Get(name)
+		if !ok || fresh {
+			read, err := h.read(r.Context(), name)
+			if err != nil {
+				log.Warn().Err(err).Str("upstream", name).Msg("get UPS list fail")
+
+				failures = append(failures, failure{upstream: name, err: err})
+				if !ok {
+					continue
+				}
+			} else {
+				s = read
+			}
+		}
+
+		snapshots = append(snapshots, s)
+	}
+
+	if len(snapshots) == 0 && len(failures) > 0 {
+		return nil, nil, errors.Wrapf(failures[0].err, "get UPS list of upstream %q fail", failures[0].upstream)
+	}
+
+	return snapshots, failures, nil
+}
+
+// read Reads the snapshot of the upstream from NUT and shares it with the poller.
+func (h *Handler) read(ctx context.Context, name string) (snapshot.Snapshot, error) {
+	nutClient, err := h.upstreams.Get(name)
+	if err != nil {
+		return snapshot.Snapshot{}, errors.Wrap(err, "get upstream fail")
+	}
+
+	list, err := nutClient.GetUPSList(ctx)
+	if err != nil {
+		return snapshot.Snapshot{}, errors.Wrap(err, "get UPS list fail")
+	}
+
+	s := snapshot.Snapshot{
+		Upstream: name,
+		Time:     time.Now(),
+		List:     list,
+	}
+	h.store.Set(s)
+
+	return s, nil
+}
+
+// findUPS Finds the UPS by "ups@upstream" or by the UPS name only if it's unique among upstreams.
+func findUPS(snapshots []snapshot.Snapshot, name string) (string, *nut_client.UPS, error) {
+	upsName, upstream := name, ""
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		upsName, upstream = name[:i], name[i+1:]
+	}
+
+	var (
+		foundUpstream string
+		found         *nut_client.UPS
+	)
+
+	for _, s := range snapshots {
+		if upstream != "" && s.Upstream != upstream {
+			continue
+		}
+
+		for _, ups := range s.List {
+			if ups.Name != upsName {
+				continue
+			}
+			if found != nil {
+				return "", nil, errors.Wrapf(ErrAmbiguousUPS, "UPS %q", name)
+			}
+
+			foundUpstream, found = s.Upstream, ups
+		}
+	}
+
+	if found == nil {
+		return "", nil, errors.Wrapf(nut.ErrUnknownUPS, "UPS %q", name)
+	}
+
+	return foundUpstream, found, nil
+}
+
+// findFailure Returns the failure of the upstream the UPS given by the name may be of.
+func findFailure(failures []failure, name string) (failure, bool) {
+	upstream := ""
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		upstream = name[i+1:]
+	}
+
+	for _, f := range failures {
+		if upstream == "" || f.upstream == upstream {
+			return f, true
+		}
+	}
+
+	return failure{}, false
+}
+
+func prepareValue(r *http.Request) (*value, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading from body fail")
+	}
+	if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+		return nil, errors.Wrap(err, "copying from response body fail")
+	}
+
+	req := &value{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, errors.Wrap(err, "json unmarshal fail")
+	}
+
+	return req, err
+}
+
+// prepareHistoryQuery Parses the range and the step of the query and names of variables.
+func prepareHistoryQuery(r *http.Request) (history.Query, []string, error) {
+	values := r.URL.Query()
+
+	var variables []string
+	for _, v := range strings.Split(values.Get("variable"), ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			variables = append(variables, v)
+		}
+	}
+	if len(variables) == 0 {
+		return history.Query{}, nil, errors.New("variable is required")
+	}
+
+	q := history.Query{To: time.Now()}
+
+	var err error
+
+	if v := values.Get("to"); len(v) > 0 {
+		if q.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, nil, errors.Wrapf(err, "to %q", v)
+		}
+	}
+
+	q.From = q.To.Add(-time.Hour)
+	if v := values.Get("from"); len(v) > 0 {
+		if q.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, nil, errors.Wrapf(err, "from %q", v)
+		}
+	}
+	if q.From.After(q.To) {
+		return q, nil, errors.New("from is after to")
+	}
+
+	if v := values.Get("step"); len(v) > 0 {
+		if q.Step, err = time.ParseDuration(v); err != nil || q.Step < 0 {
+			return q, nil, errors.Errorf("step %q", v)
+		}
+	}
+
+	return q, variables, nil
+}
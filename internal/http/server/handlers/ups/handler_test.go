@@ -0,0 +1,97 @@
+package ups
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/router"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// closedPort Returns the port which isn't listened, so connections to it are refused.
+func closedPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestSnapshots(t *testing.T) {
+	upstreams := nut.NewUpstreams()
+
+	for _, name := range []string{"main", "lost"} {
+		c, err := nut.New("127.0.0.1", closedPort(t), "", "", 1, "1m", "1m", "1h", nut.TLS{})
+		require.NoError(t, err)
+		require.NoError(t, upstreams.Add(name, c))
+	}
+
+	// the poller has read only the main upstream
+	store := snapshot.New()
+	store.Set(snapshot.Snapshot{
+		Upstream: "main",
+		Time:     time.Now(),
+		List:     []*nut_client.UPS{{Name: "ups", Variables: []nut_client.Variable{{Name: "ups.status", Value: "OL"}}}},
+	})
+
+	h := New(upstreams, store, nil, nil)
+
+	serve := func(pattern string, handler func(http.ResponseWriter, *http.Request) (interface{}, error), path string) (interface{}, error) {
+		var (
+			res interface{}
+			err error
+		)
+
+		rt := router.New()
+		rt.HandleFunc("GET", pattern, func(w http.ResponseWriter, r *http.Request) {
+			res, err = handler(w, r)
+		})
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+
+		return res, err
+	}
+
+	t.Run("list", func(t *testing.T) {
+		res, err := serve("/ups", h.List(), "/ups")
+		require.NoError(t, err)
+
+		s := res.(Snapshot)
+		require.Len(t, s.List, 1)
+		require.Equal(t, "main", s.List[0].Upstream)
+		require.Len(t, s.Errors, 1)
+		require.Equal(t, "lost", s.Errors[0].Upstream)
+	})
+	t.Run("fresh", func(t *testing.T) {
+		// the snapshot of the poller is used if the upstream can't be read
+		res, err := serve("/ups", h.List(), "/ups?fresh=true")
+		require.NoError(t, err)
+
+		s := res.(Snapshot)
+		require.Len(t, s.List, 1)
+		require.Len(t, s.Errors, 2)
+	})
+	t.Run("get", func(t *testing.T) {
+		res, err := serve("/ups/{name}", h.Get(), "/ups/ups@main")
+		require.NoError(t, err)
+		require.Equal(t, "ups", res.(UPS).Name)
+
+		_, err = serve("/ups/{name}", h.Get(), "/ups/other@lost")
+		require.Error(t, err)
+		require.False(t, errors.Is(err, nut.ErrUnknownUPS))
+
+		_, err = serve("/ups/{name}", h.Get(), "/ups/other@main")
+		require.ErrorIs(t, err, nut.ErrUnknownUPS)
+	})
+	t.Run("all upstreams lost", func(t *testing.T) {
+		_, err := serve("/ups", New(upstreams, snapshot.New(), nil, nil).List(), "/ups")
+		require.Error(t, err)
+	})
+}
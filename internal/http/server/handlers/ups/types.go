@@ -0,0 +1,112 @@
+package ups
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andreyAKor/nut_client_service/internal/history"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+)
+
+var _ handlers.CSVWriter = History{}
+
+// Snapshot is the UPS list read from NUT upstreams, Timestamp is the time of the oldest upstream snapshot.
+// Upstreams which can't be read are listed in Errors, UPSes of them are missing unless the poller has read them.
+type Snapshot struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Age       float64         `json:"age"`
+	List      []UPS           `json:"list"`
+	Errors    []UpstreamError `json:"errors,omitempty"`
+}
+
+// UpstreamError is the error of reading the upstream.
+type UpstreamError struct {
+	Upstream string `json:"upstream"`
+	Error    string `json:"error"`
+}
+
+// UPS contains information about a specific UPS provided by the NUT instance.
+type UPS struct {
+	Upstream       string     `json:"upstream"`
+	Name           string     `json:"name"`
+	Description    string     `json:"description"`
+	Master         bool       `json:"master"`
+	NumberOfLogins int        `json:"numberOfLogins"`
+	Clients        []string   `json:"clients"`
+	Variables      []Variable `json:"variables"`
+	Commands       []Command  `json:"commands"`
+}
+
+// Variable describes a single variable related to a UPS.
+type Variable struct {
+	Name          string      `json:"name"`
+	Value         interface{} `json:"value"`
+	Type          string      `json:"type"`
+	Description   string      `json:"description"`
+	Writeable     bool        `json:"writeable"`
+	MaximumLength int         `json:"maximumLength"`
+	OriginalType  string      `json:"originalType"`
+
+	// Values accepted by ENUM and RANGE variables
+	Enum  []string    `json:"enum,omitempty"`
+	Range []nut.Range `json:"range,omitempty"`
+}
+
+// Command describes an available command for a UPS.
+type Command struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// History is the time series of variables of the UPS, Step is the duration of points in seconds.
+type History struct {
+	Upstream string    `json:"upstream"`
+	UPS      string    `json:"ups"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Step     float64   `json:"step"`
+	Series   []Series  `json:"series"`
+}
+
+// Series is the time series of the variable.
+type Series struct {
+	Variable string          `json:"variable"`
+	Points   []history.Point `json:"points"`
+}
+
+// WriteCSV Writes points as "time,upstream,ups,variable,value" rows.
+func (h History) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"time", "upstream", "ups", "variable", "value"}); err != nil {
+		return errors.Wrap(err, "write header fail")
+	}
+
+	for _, s := range h.Series {
+		for _, p := range s.Points {
+			row := []string{
+				p.Time.Format(time.RFC3339),
+				h.Upstream,
+				h.UPS,
+				s.Variable,
+				strconv.FormatFloat(p.Value, 'f', -1, 64),
+			}
+			if err := cw.Write(row); err != nil {
+				return errors.Wrap(err, "write row fail")
+			}
+		}
+	}
+
+	cw.Flush()
+
+	return errors.Wrap(cw.Error(), "flush fail")
+}
+
+type value struct {
+	Value string `json:"value"`
+}
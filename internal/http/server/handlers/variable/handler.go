@@ -2,6 +2,7 @@ package variable
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -10,15 +11,22 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
 )
 
 type Handler struct {
-	nutClient *nut.Client
+	upstreams *nut.Upstreams
+	store     *snapshot.Store
+	guard     *guard.Guard
 }
 
-func New(nutClient *nut.Client) *Handler {
+func New(upstreams *nut.Upstreams, store *snapshot.Store, g *guard.Guard) *Handler {
 	return &Handler{
-		nutClient: nutClient,
+		upstreams: upstreams,
+		store:     store,
+		guard:     g,
 	}
 }
 
@@ -26,14 +34,51 @@ func (h *Handler) Handle() func(http.ResponseWriter, *http.Request) (interface{}
 	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 		req, err := prepareCommand(r)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
 			log.Error().Err(err).Msg("prepare command struct from request body fail")
 
-			return nil, errors.Wrap(err, "prepare command struct from request body fail")
+			return nil, errors.Wrapf(handlers.ErrInvalidRequest, "prepare command struct from request body fail: %s", err)
 		}
 
-		if err := h.nutClient.SetVariable(r.Context(), req.Name, req.VariableName, req.Value); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		upstream, err := h.upstreams.Resolve(req.Upstream)
+		if err != nil {
+			log.Error().Err(err).Msg("resolve upstream fail")
+
+			return nil, errors.Wrap(err, "resolve upstream fail")
+		}
+
+		// only the UPS and the variable listed by upsd are sent to it
+		ups, err := handlers.FindUPS(r.Context(), h.upstreams, h.store, upstream, req.Name)
+		if err != nil {
+			log.Warn().Err(err).Msg("find UPS fail")
+
+			return nil, errors.Wrap(err, "find UPS fail")
+		}
+
+		v, err := handlers.FindVariable(ups, req.VariableName)
+		if err != nil {
+			log.Warn().Err(err).Msg("find variable fail")
+
+			return nil, errors.Wrap(err, "find variable fail")
+		}
+
+		nutClient, err := h.upstreams.Get(upstream)
+		if err != nil {
+			log.Error().Err(err).Msg("get upstream fail")
+
+			return nil, errors.Wrap(err, "get upstream fail")
+		}
+
+		action := guard.Action{
+			Kind:     guard.ActionVariable,
+			Upstream: upstream,
+			UPS:      ups.Name,
+			Variable: v.Name,
+			OldValue: fmt.Sprint(v.Value),
+			Value:    req.Value,
+		}
+		err = nutClient.SetVariable(r.Context(), ups.Name, v.Name, req.Value)
+		h.guard.Done(r, action, err)
+		if err != nil {
 			log.Error().Err(err).Msg("set variable fail")
 
 			return nil, errors.Wrap(err, "set variable fail")
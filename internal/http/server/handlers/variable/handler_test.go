@@ -0,0 +1,65 @@
+package variable
+
+import (
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/audit"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// closedPort Returns the port which isn't listened, so connections to it are refused.
+func closedPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestHandle(t *testing.T) {
+	auditLog, err := audit.New(filepath.Join(t.TempDir(), "audit.log"), 0, 0, false)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	g, err := guard.New(nil, "1m", auditLog)
+	require.NoError(t, err)
+
+	c, err := nut.New("127.0.0.1", closedPort(t), "", "", 1, "1m", "1m", "1h", nut.TLS{})
+	require.NoError(t, err)
+
+	upstreams := nut.NewUpstreams()
+	require.NoError(t, upstreams.Add("main", c))
+
+	store := snapshot.New()
+	store.Set(snapshot.Snapshot{
+		Upstream: "main",
+		Time:     time.Now(),
+		List:     []*nut_client.UPS{{Name: "ups", Variables: []nut_client.Variable{{Name: "ups.id", Value: "myups"}}}},
+	})
+
+	handle := New(upstreams, store, g).Handle()
+
+	set := func(body string) error {
+		_, err := handle(httptest.NewRecorder(), httptest.NewRequest("POST", "/variable", strings.NewReader(body)))
+
+		return err
+	}
+
+	// names which aren't listed by upsd aren't sent to it
+	require.ErrorIs(t, set(`{"name":"typo","variable":"ups.id","value":"rack"}`), nut.ErrUnknownUPS)
+	require.ErrorIs(t, set(`{"name":"ups","variable":"ups.typo","value":"rack"}`), nut.ErrUnknownVariable)
+	require.ErrorIs(t, set(`{"name":"ups","variable":"ups.id \"rack\"\nFSD ups","value":"rack"}`), nut.ErrUnknownVariable)
+
+	// the listed variable is sent to the upstream which is down
+	require.ErrorIs(t, set(`{"name":"ups","variable":"ups.id","value":"rack"}`), nut.ErrUnavailable)
+}
@@ -1,6 +1,7 @@
 package variable
 
 type variable struct {
+	Upstream     string `json:"upstream"`
 	Name         string `json:"name"`
 	VariableName string `json:"variable"`
 	Value        string `json:"value"`
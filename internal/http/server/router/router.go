@@ -0,0 +1,123 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type paramsKey struct{}
+
+var _ http.Handler = (*Router)(nil)
+
+// Router dispatches requests by method and path pattern with parameters, e.g. "/ups/{name}".
+type Router struct {
+	routes []route
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.Handler
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle Registers the handler for the method and the path pattern.
+func (rt *Router) Handle(method, pattern string, handler http.Handler) {
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		pattern:  pattern,
+		segments: split(pattern),
+		handler:  handler,
+	})
+}
+
+// HandleFunc Registers the handler function for the method and the path pattern.
+func (rt *Router) HandleFunc(method, pattern string, handler http.HandlerFunc) {
+	rt.Handle(method, pattern, handler)
+}
+
+// ServeHTTP Dispatches the request to the matched route, responds 404 if no pattern is matched and
+// 405 if the pattern is matched for another method.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := split(r.URL.Path)
+
+	var allowed []string
+
+	for _, rte := range rt.routes {
+		params, ok := match(rte.segments, segments)
+		if !ok {
+			continue
+		}
+		if rte.method != r.Method {
+			allowed = append(allowed, rte.method)
+			continue
+		}
+
+		rte.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), paramsKey{}, params)))
+
+		return
+	}
+
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// Pattern Returns the path pattern the request is dispatched by, it's empty if no pattern is matched.
+func (rt *Router) Pattern(r *http.Request) string {
+	segments := split(r.URL.Path)
+
+	for _, rte := range rt.routes {
+		if _, ok := match(rte.segments, segments); ok {
+			return rte.pattern
+		}
+	}
+
+	return ""
+}
+
+// Param Returns the path parameter of the matched route.
+func Param(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+
+	return params[name]
+}
+
+func match(pattern, segments []string) (map[string]string, bool) {
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+
+			params[strings.Trim(p, "{}")] = segments[i]
+
+			continue
+		}
+		if p != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+func split(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	rt := New()
+	rt.HandleFunc("GET", "/ups/{name}/variables/{var}", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(Param(r, "name") + " " + Param(r, "var")))
+	})
+	rt.HandleFunc("PUT", "/ups/{name}/variables/{var}", func(w http.ResponseWriter, r *http.Request) {})
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+
+		return w
+	}
+
+	t.Run("params", func(t *testing.T) {
+		w := serve("GET", "/ups/myups/variables/battery.charge")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "myups battery.charge", w.Body.String())
+	})
+	t.Run("not found", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound, serve("GET", "/ups/myups").Code)
+		require.Equal(t, http.StatusNotFound, serve("GET", "/ups//variables/battery.charge").Code)
+	})
+	t.Run("pattern", func(t *testing.T) {
+		require.Equal(t, "/ups/{name}/variables/{var}", rt.Pattern(httptest.NewRequest("GET", "/ups/myups/variables/battery.charge", nil)))
+		require.Equal(t, "/ups/{name}/variables/{var}", rt.Pattern(httptest.NewRequest("POST", "/ups/myups/variables/battery.charge", nil)))
+		require.Empty(t, rt.Pattern(httptest.NewRequest("GET", "/ups/myups", nil)))
+	})
+	t.Run("method not allowed", func(t *testing.T) {
+		w := serve("POST", "/ups/myups/variables/battery.charge")
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		require.Equal(t, "GET, PUT", w.Header().Get("Allow"))
+	})
+}
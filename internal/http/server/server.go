@@ -17,10 +17,23 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 
+	"github.com/andreyAKor/nut_client_service/internal/audit"
+	powerEvents "github.com/andreyAKor/nut_client_service/internal/events"
+	"github.com/andreyAKor/nut_client_service/internal/history"
 	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/auth"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/handlers"
+	handlerAudit "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/audit"
 	handlerCommand "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/command"
-	handlerGet "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/get"
+	handlerEvents "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/events"
+	handlerOutages "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/outages"
+	handlerProbe "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/probe"
+	handlerUPS "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/ups"
 	handlerVariable "github.com/andreyAKor/nut_client_service/internal/http/server/handlers/variable"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/router"
+	"github.com/andreyAKor/nut_client_service/internal/outages"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
 )
 
 var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
@@ -30,6 +43,25 @@ var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Buckets:   []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
 }, []string{"method", "path"})
 
+// shutdownTimeout is the time requests in progress are waited for on Close.
+const shutdownTimeout = 10 * time.Second
+
+// apiPrefix is the path the router of the API is mounted to.
+const apiPrefix = "/api/v1/"
+
+// labelOther is the metric label of requests by unknown methods and paths.
+const labelOther = "other"
+
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
 var (
 	ErrServerNotInit  = errors.New("server not init")
 	ErrInvalidRequest = errors.New("the request body can’t be parsed as valid data")
@@ -42,41 +74,157 @@ type Server struct {
 	port      int
 	bodyLimit int
 
-	nutClient *nut.Client
+	upstreams *nut.Upstreams
+	store     *snapshot.Store
+	events    *powerEvents.Engine
+
+	probeModules map[string]handlerProbe.Module
+
+	// auth is nil if authentication isn't configured
+	auth *auth.Auth
+
+	// guard confirms and audits dangerous commands and FSD
+	guard *guard.Guard
+	audit *audit.Log
+
+	history *history.Store
+	outages *outages.Journal
+
+	tls TLS
 
-	server *http.Server
-	ctx    context.Context
+	// plain HTTP listener serving only /metrics, it's disabled if the port is zero
+	metricsHost string
+	metricsPort int
+
+	server        *http.Server
+	metricsServer *http.Server
 }
 
-func New(host string, port int, bodyLimit int, nutClient *nut.Client) (*Server, error) {
+func New(
+	host string,
+	port int,
+	bodyLimit int,
+	upstreams *nut.Upstreams,
+	store *snapshot.Store,
+	eventsEngine *powerEvents.Engine,
+	probeModules map[string]handlerProbe.Module,
+	authenticator *auth.Auth,
+	dangerGuard *guard.Guard,
+	auditTrail *audit.Log,
+	historyStore *history.Store,
+	outageJournal *outages.Journal,
+	tlsSettings TLS,
+	metricsHost string,
+	metricsPort int,
+) (*Server, error) {
 	return &Server{
-		host:      host,
-		port:      port,
-		bodyLimit: bodyLimit,
-		nutClient: nutClient,
+		host:         host,
+		port:         port,
+		bodyLimit:    bodyLimit,
+		upstreams:    upstreams,
+		store:        store,
+		events:       eventsEngine,
+		probeModules: probeModules,
+		auth:         authenticator,
+		guard:        dangerGuard,
+		audit:        auditTrail,
+		history:      historyStore,
+		outages:      outageJournal,
+		tls:          tlsSettings,
+		metricsHost:  metricsHost,
+		metricsPort:  metricsPort,
 	}, nil
 }
 
 // Run Running http-server.
 func (s *Server) Run(ctx context.Context) error {
-	s.ctx = ctx
+	ups := handlerUPS.New(s.upstreams, s.store, s.guard, s.history)
+
+	api := router.New()
+	api.HandleFunc("GET", "/api/v1/ups", s.authorize(s.toJSON(ups.List()), auth.PermissionRead))
+	api.HandleFunc("GET", "/api/v1/ups/{name}", s.authorize(s.toJSON(ups.Get()), auth.PermissionRead))
+	api.HandleFunc("GET", "/api/v1/ups/{name}/variables", s.authorize(s.toJSON(ups.Variables()), auth.PermissionRead))
+	api.HandleFunc("GET", "/api/v1/ups/{name}/variables/{var}", s.authorize(s.toJSON(ups.Variable()), auth.PermissionRead))
+	api.HandleFunc("PUT", "/api/v1/ups/{name}/variables/{var}", s.authorize(s.toJSON(ups.SetVariable()), auth.PermissionWrite))
+	api.HandleFunc("GET", "/api/v1/ups/{name}/commands", s.authorize(s.toJSON(ups.Commands()), auth.PermissionRead))
+	api.HandleFunc("POST", "/api/v1/ups/{name}/commands/{cmd}", s.authorize(s.toJSON(ups.SendCommand()), auth.PermissionCommand))
+	api.HandleFunc("POST", "/api/v1/ups/{name}/fsd", s.authorize(s.toJSON(ups.ForceShutdown()), auth.PermissionCommand))
+	api.HandleFunc("GET", "/api/v1/ups/{name}/history", s.authorize(s.toJSON(ups.History()), auth.PermissionRead))
+
+	events := handlerEvents.New(s.store, s.events)
+
+	api.HandleFunc("GET", "/api/v1/events", s.authorize(events.Stream(), auth.PermissionRead))
+	api.HandleFunc("GET", "/api/v1/events/recent", s.authorize(s.toJSON(events.Recent()), auth.PermissionRead))
+
+	api.HandleFunc("GET", "/api/v1/outages", s.authorize(s.toJSON(handlerOutages.New(s.outages).List()), auth.PermissionRead))
+
+	auditTrail := handlerAudit.New(s.audit)
+
+	api.HandleFunc("GET", "/api/v1/audit", s.authorize(s.toJSON(auditTrail.List()), auth.PermissionAudit))
+	api.HandleFunc("GET", "/api/v1/audit/verify", s.authorize(s.toJSON(auditTrail.Verify()), auth.PermissionAudit))
+
+	metricsHandler := promhttp.Handler().ServeHTTP
+	if s.auth != nil && !s.auth.AnonymousMetrics() {
+		metricsHandler = s.authorize(metricsHandler, auth.PermissionRead)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/get", s.method(s.toJSON(handlerGet.New(s.nutClient).Handle()), "GET"))
-	mux.HandleFunc("/command", s.method(s.toJSON(handlerCommand.New(s.nutClient).Handle()), "POST"))
-	mux.HandleFunc("/variable", s.method(s.toJSON(handlerVariable.New(s.nutClient).Handle()), "POST"))
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/probe", s.method(s.authorize(handlerProbe.New(s.probeModules).Handle(), auth.PermissionRead), "GET"))
+	mux.Handle(apiPrefix, api)
+
+	// legacy endpoints
+	mux.HandleFunc("/get", s.method(s.authorize(s.toJSON(ups.List()), auth.PermissionRead), "GET"))
+	mux.HandleFunc("/command", s.method(s.authorize(s.toJSON(handlerCommand.New(s.upstreams, s.store, s.guard).Handle()), auth.PermissionCommand), "POST"))
+	mux.HandleFunc("/variable", s.method(s.authorize(s.toJSON(handlerVariable.New(s.upstreams, s.store, s.guard).Handle()), auth.PermissionWrite), "POST"))
 
 	// middlewares
-	handler := s.metrics(mux)
+	handler := s.metrics(mux, api)
 	handler = s.headers(handler)
 	handler = s.body(handler)
 	handler = s.logger(handler)
 
+	// contexts of requests are canceled on shutdown, so event streams are ended and don't block it
+	baseCtx, cancel := context.WithCancel(ctx)
+
 	s.server = &http.Server{
-		Addr:    net.JoinHostPort(s.host, strconv.Itoa(s.port)),
-		Handler: handler,
+		Addr:        net.JoinHostPort(s.host, strconv.Itoa(s.port)),
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	s.server.RegisterOnShutdown(cancel)
+
+	if s.metricsPort > 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", metricsHandler)
+
+		s.metricsServer = &http.Server{
+			Addr:    net.JoinHostPort(s.metricsHost, strconv.Itoa(s.metricsPort)),
+			Handler: s.logger(metricsMux),
+		}
+
+		go func() {
+			if err := s.metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Err(err).Msg("metrics http-server listen fail")
+			}
+		}()
 	}
+
+	if s.tls.enabled() {
+		reloader, err := newCertReloader(s.tls)
+		if err != nil {
+			return errors.Wrap(err, "TLS init fail")
+		}
+
+		s.server.TLSConfig = reloader.tlsConfig()
+
+		if err := s.server.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+			return errors.Wrap(err, "https-server listen fail")
+		}
+
+		return nil
+	}
+
 	if err := s.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		return errors.Wrap(err, "http-server listen fail")
 	}
@@ -90,16 +238,39 @@ func (s *Server) Close() error {
 		return ErrServerNotInit
 	}
 
-	return s.server.Shutdown(s.ctx)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			return errors.Wrap(err, "metrics http-server shutdown fail")
+		}
+	}
+
+	return s.server.Shutdown(ctx)
 }
 
-// metrics Middleware sets metrics to prometheus.
-func (s Server) metrics(handler http.Handler) http.Handler {
+// metrics Middleware sets metrics to prometheus, requests are labeled by the matched pattern
+// and unknown methods and paths by "other", so clients can't create series.
+func (s Server) metrics(mux *http.ServeMux, api *router.Router) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		timer := prometheus.NewTimer(httpDuration.WithLabelValues(r.Method, r.URL.Path))
+		method := r.Method
+		if !knownMethods[method] {
+			method = labelOther
+		}
+
+		_, path := mux.Handler(r)
+		if path == apiPrefix {
+			path = api.Pattern(r)
+		}
+		if len(path) == 0 {
+			path = labelOther
+		}
+
+		timer := prometheus.NewTimer(httpDuration.WithLabelValues(method, path))
 		defer timer.ObserveDuration()
 
-		handler.ServeHTTP(w, r)
+		mux.ServeHTTP(w, r)
 	})
 }
 
@@ -109,8 +280,8 @@ func (s Server) headers(handler http.Handler) http.Handler {
 		// CORS headers
 		if origin := r.Header.Get("Origin"); origin != "" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
-			w.Header().Set("Access-Control-Allow-Methods", "OPTIONS,GET,POST")
+			w.Header().Add("Access-Control-Allow-Headers", "Content-Type,Authorization,X-API-Key,"+guard.ConfirmationHeader)
+			w.Header().Set("Access-Control-Allow-Methods", "OPTIONS,GET,POST,PUT")
 		}
 
 		// For OPTIONS requests
@@ -204,14 +375,56 @@ func (s Server) method(handler http.HandlerFunc, method string) http.HandlerFunc
 	}
 }
 
-// toJSON Converting Response from endpoint to json-response.
+// authorize Checking the request is authenticated and the user has the permission.
+func (s Server) authorize(handler http.HandlerFunc, permission string) http.HandlerFunc {
+	if s.auth == nil {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorized, err := s.auth.Authorize(r, permission)
+		if err != nil {
+			log.Warn().Err(err).Str("path", r.URL.Path).Msg("authorization fail")
+
+			status, code := errorStatus(err)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="nut_client_service"`)
+			}
+			w.WriteHeader(status)
+
+			if err := s.writeJSON(Response{Error: err.Error(), Code: code}, w); err != nil {
+				log.Error().Err(err).Msg("writeJSON fail")
+			}
+
+			return
+		}
+
+		handler(w, authorized)
+	}
+}
+
+// toJSON Converting Response from endpoint to json-response, the error is mapped to the HTTP status and the error code.
+// Responses implementing handlers.CSVWriter are written as CSV if it's requested by format=csv.
 func (s Server) toJSON(h func(w http.ResponseWriter, r *http.Request) (interface{}, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var rs Response
 
 		data, err := h(w, r)
+		if c, ok := data.(handlers.CSVWriter); ok && err == nil && r.URL.Query().Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+
+			if err := c.WriteCSV(w); err != nil {
+				log.Error().Err(err).Msg("writeCSV fail")
+			}
+
+			return
+		}
 		if err != nil {
+			status, code := errorStatus(err)
+			w.WriteHeader(status)
+
 			rs.Error = err.Error()
+			rs.Code = code
 		} else {
 			rs.Data = data
 		}
@@ -239,7 +452,10 @@ func (s Server) writeJSON(rs Response, w io.Writer) error {
 	return nil
 }
 
-var _ http.ResponseWriter = (*appResponseWriter)(nil)
+var (
+	_ http.ResponseWriter = (*appResponseWriter)(nil)
+	_ http.Flusher        = (*appResponseWriter)(nil)
+)
 
 // appResponseWriter App wrapper over http.ResponseWriter.
 type appResponseWriter struct {
@@ -255,3 +471,10 @@ func (a *appResponseWriter) WriteHeader(code int) {
 	a.statusCode = code
 	a.ResponseWriter.WriteHeader(code)
 }
+
+// Flush Flushes the response if the wrapped writer supports it, it's needed for streaming responses.
+func (a *appResponseWriter) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
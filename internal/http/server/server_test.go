@@ -1,18 +1,180 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/router"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
 )
 
+// freePort Returns the port which isn't listened.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
 func TestClose(t *testing.T) {
 	t.Run("server not init", func(t *testing.T) {
-		srv, err := New(nil, nil, nil, "", 0, 0)
+		srv, err := New("", 0, 0, nil, nil, nil, nil, nil, nil, nil, nil, nil, TLS{}, "", 0)
 		require.NoError(t, err)
 
 		err = srv.Close()
 		require.Equal(t, err, errors.Cause(ErrServerNotInit))
 	})
+	t.Run("event streams", func(t *testing.T) {
+		port := freePort(t)
+
+		srv, err := New("127.0.0.1", port, 1024, nil, snapshot.New(), nil, nil, nil, nil, nil, nil, nil, TLS{}, "", 0)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() { done <- srv.Run(ctx) }()
+
+		url := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/api/v1/events"
+
+		var res *http.Response
+		require.Eventually(t, func() bool {
+			res, err = http.Get(url) //nolint:noctx
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		defer res.Body.Close()
+
+		// the stream is open when the initial snapshot is received
+		line, err := bufio.NewReader(res.Body).ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "event: snapshot\n", line)
+
+		closed := make(chan error, 1)
+		go func() { closed <- srv.Close() }()
+
+		select {
+		case err := <-closed:
+			require.NoError(t, err)
+		case <-time.After(shutdownTimeout / 2):
+			t.Fatal("close is blocked by the event stream")
+		}
+
+		require.NoError(t, <-done)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	httpDuration.Reset()
+
+	api := router.New()
+	api.HandleFunc("GET", "/api/v1/ups/{name}/variables/{var}", func(w http.ResponseWriter, r *http.Request) {})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle(apiPrefix, api)
+
+	handler := Server{}.metrics(mux, api)
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/api/v1/ups/myups/variables/battery.charge", nil),
+		httptest.NewRequest("GET", "/api/v1/ups/other/variables/input.voltage", nil),
+		httptest.NewRequest("GET", "/api/v1/unknown/path", nil),
+		httptest.NewRequest("GET", "/probe?target=127.0.0.1", nil),
+		httptest.NewRequest("BREW", "/random/path", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	labels := make(map[string]bool)
+
+	for _, f := range families {
+		if f.GetName() != "nut_client_service_http_response_time_seconds" {
+			continue
+		}
+
+		for _, m := range f.GetMetric() {
+			var method, path string
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case "method":
+					method = l.GetValue()
+				case "path":
+					path = l.GetValue()
+				}
+			}
+
+			labels[method+" "+path] = true
+		}
+	}
+
+	require.Equal(t, map[string]bool{
+		"GET /api/v1/ups/{name}/variables/{var}": true,
+		"GET other":                              true,
+		"GET /probe":                             true,
+		"other other":                            true,
+	}, labels)
+}
+
+func TestErrorStatus(t *testing.T) {
+	t.Run("NUT error", func(t *testing.T) {
+		status, code := errorStatus(errors.Wrap(&nut.Error{Code: "UNKNOWN-UPS"}, "send command fail"))
+		require.Equal(t, http.StatusNotFound, status)
+		require.Equal(t, CodeUnknownUPS, code)
+	})
+
+	t.Run("upstream credentials", func(t *testing.T) {
+		// upsd rejecting the credentials of the service
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			for {
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte("ERR INVALID-PASSWORD\n")); err != nil {
+					return
+				}
+			}
+		}()
+
+		c, err := nut.New("127.0.0.1", l.Addr().(*net.TCPAddr).Port, "user", "wrong", 1, "1m", "1m", "1h", nut.TLS{})
+		require.NoError(t, err)
+
+		_, err = c.GetUPSList(context.Background())
+		require.ErrorIs(t, err, nut.ErrAccessDenied)
+
+		status, code := errorStatus(err)
+		require.Equal(t, http.StatusBadGateway, status)
+		require.Equal(t, CodeUpstreamFailed, code)
+	})
+
+	t.Run("unclassified", func(t *testing.T) {
+		status, code := errorStatus(errors.New("fail"))
+		require.Equal(t, http.StatusInternalServerError, status)
+		require.Equal(t, CodeInternal, code)
+	})
 }
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// TLS is the TLS settings of the API listener, TLS is disabled if CertFile is empty.
+type TLS struct {
+	CertFile string
+	KeyFile  string
+
+	// CA of client certificates, mutual TLS is enabled if it's set
+	ClientCAFile string
+
+	// Client certificates are required, otherwise they're verified only if they're given
+	RequireClientCert bool
+
+	// Files are checked for modification after this interval, e.g. "1m"
+	ReloadInterval string
+}
+
+func (t TLS) enabled() bool {
+	return len(t.CertFile) > 0
+}
+
+// certReloader Serves the TLS configuration re-reading the certificate, the key and the client CA
+// when their files are modified, so rotated certificates are used without restart.
+type certReloader struct {
+	settings TLS
+	interval time.Duration
+
+	mu      sync.Mutex
+	config  *tls.Config
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(settings TLS) (*certReloader, error) {
+	interval, err := time.ParseDuration(settings.ReloadInterval)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reload interval parsing fail (%s)", settings.ReloadInterval)
+	}
+
+	c := &certReloader{
+		settings: settings,
+		interval: interval,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// tlsConfig Returns the configuration of the listener which delegates to the actual configuration.
+//
+// The configuration returned by GetConfigForClient replaces the listener's one, so it gets ALPN protocols
+// of the listener, otherwise HTTP/2 isn't negotiated.
+func (c *certReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &c.actual().Certificates[0], nil
+		},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config := c.actual().Clone()
+		config.NextProtos = base.NextProtos
+
+		return config, nil
+	}
+
+	return base
+}
+
+// actual Returns the configuration reloading it if files are modified, the previous one is kept if reloading fails.
+func (c *certReloader) actual() *tls.Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < c.interval {
+		return c.config
+	}
+	c.checked = time.Now()
+
+	modTime, err := c.latestModTime()
+	if err != nil {
+		log.Error().Err(err).Msg("TLS files checking fail")
+
+		return c.config
+	}
+	if !modTime.After(c.modTime) {
+		return c.config
+	}
+
+	if err := c.loadLocked(); err != nil {
+		log.Error().Err(err).Msg("TLS files reloading fail, the previous certificate is used")
+
+		return c.config
+	}
+
+	log.Info().Msg("TLS certificate is reloaded")
+
+	return c.config
+}
+
+func (c *certReloader) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.loadLocked()
+}
+
+// loadLocked Reads the certificate, the key and the client CA, c.mu must be held.
+func (c *certReloader) loadLocked() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.settings.CertFile, c.settings.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "certificate loading fail")
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if len(c.settings.ClientCAFile) > 0 {
+		data, err := ioutil.ReadFile(c.settings.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "client CA reading fail")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.Errorf("no certificates in client CA file (%s)", c.settings.ClientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.settings.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	c.config = config
+	c.modTime = modTime
+
+	return nil
+}
+
+// latestModTime Returns the latest modification time of TLS files.
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range []string{c.settings.CertFile, c.settings.KeyFile, c.settings.ClientCAFile} {
+		if len(file) == 0 {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "stat fail")
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert Writes the self-signed certificate with the common name and its key.
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	writeCert(t, certFile, keyFile, "first")
+
+	c, err := newCertReloader(TLS{CertFile: certFile, KeyFile: keyFile, ReloadInterval: "0s"})
+	require.NoError(t, err)
+
+	commonName := func() string {
+		cert, err := x509.ParseCertificate(c.actual().Certificates[0].Certificate[0])
+		require.NoError(t, err)
+
+		return cert.Subject.CommonName
+	}
+
+	t.Run("loaded", func(t *testing.T) {
+		require.Equal(t, "first", commonName())
+	})
+
+	t.Run("reloaded", func(t *testing.T) {
+		writeCert(t, certFile, keyFile, "second")
+
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, later, later))
+
+		require.Equal(t, "second", commonName())
+	})
+
+	t.Run("broken file", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(keyFile, []byte("broken"), 0o600))
+
+		later := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(keyFile, later, later))
+
+		require.Equal(t, "second", commonName())
+	})
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	writeCert(t, certFile, keyFile, "server")
+
+	c, err := newCertReloader(TLS{CertFile: certFile, KeyFile: keyFile, ReloadInterval: "1m"})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: c.tlsConfig(),
+	}
+	defer srv.Close()
+
+	go func() { _ = srv.ServeTLS(l, "", "") }()
+
+	for _, proto := range []string{"h2", "http/1.1"} {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+			NextProtos:         []string{proto},
+		})
+		require.NoError(t, err)
+		require.Equal(t, proto, conn.ConnectionState().NegotiatedProtocol)
+		require.NoError(t, conn.Close())
+	}
+}
@@ -4,4 +4,6 @@ package server
 type Response struct {
 	Data  interface{} `json:"data,omitempty"`
 	Error string      `json:"error,omitempty"`
+	// Machine-readable error code, e.g. "unknown_ups"
+	Code string `json:"code,omitempty"`
 }
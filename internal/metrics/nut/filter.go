@@ -0,0 +1,46 @@
+package nut
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// filter Decides which variables are exported by allow and deny lists of name patterns, e.g. "ups.*".
+// An empty allow list allows everything which isn't denied.
+type filter struct {
+	allow []string
+	deny  []string
+}
+
+func newFilter(allow, deny []string) (*filter, error) {
+	for _, pattern := range append(append([]string{}, allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "pattern parsing fail (%s)", pattern)
+		}
+	}
+
+	return &filter{
+		allow: allow,
+		deny:  deny,
+	}, nil
+}
+
+// allowed Checks whether the variable must be exported.
+func (f *filter) allowed(name string) bool {
+	if matchAny(f.deny, name) {
+		return false
+	}
+
+	return len(f.allow) == 0 || matchAny(f.allow, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
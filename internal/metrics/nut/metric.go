@@ -2,112 +2,259 @@ package nut
 
 import (
 	"context"
-	"fmt"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/log"
 
 	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
 )
 
-var metrics = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Namespace: "nut_client_service",
-	Name:      "ups_variables",
-	Help:      "Variables of UPS list",
-}, []string{"ups", "variable"})
-
-var mappingUPSStatuses = map[string]int{
-	"CAL":     0,
-	"TRIM":    1,
-	"BOOST":   2,
-	"OL":      3,
-	"OB":      4,
-	"OVER":    5,
-	"LB":      6,
-	"RB":      7,
-	"BYPASS":  8,
-	"OFF":     9,
-	"CHRG":    10,
-	"DISCHRG": 11,
+const namespace = "nut_client_service"
+
+const (
+	// ModePoll is the mode the UPS list is polled on the interval and metrics are collected from the snapshot.
+	ModePoll = "poll"
+	// ModeScrape is the mode the UPS list is read from NUT on every scrape.
+	ModeScrape = "scrape"
+)
+
+// scrapeTimeout is the timeout of reading the UPS list on scrape in the scrape mode.
+const scrapeTimeout = time.Second * 10
+
+var (
+	_ prometheus.Collector = (*Metric)(nil)
+
+	lastPollDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_poll_timestamp_seconds"),
+		"Time of the last successful poll of NUT",
+		[]string{"server"}, nil,
+	)
+	pollDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "poll_duration_seconds"),
+		"Duration of the last poll of NUT",
+		[]string{"server"}, nil,
+	)
+	pollErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "poll_errors_total"),
+		"Number of failed polls of NUT",
+		[]string{"server"}, nil,
+	)
+	upDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "up"),
+		"Whether the last poll of NUT was successful",
+		[]string{"server"}, nil,
+	)
+)
+
+// Upstream is the NUT server polled on its own interval.
+type Upstream struct {
+	Name string
+
+	// Poll interval, e.g. "1s", it's not used in the scrape mode
+	Interval string
+
+	Client *nut.Client
 }
 
-type Metric struct {
+// upstream is the polled NUT server with its poll stats.
+type upstream struct {
+	name      string
 	interval  time.Duration
 	nutClient *nut.Client
+
+	mu           sync.Mutex
+	lastPoll     time.Time
+	pollDuration time.Duration
+	pollErrors   int
+	up           bool
 }
 
-func New(interval string, nutClient *nut.Client) (*Metric, error) {
-	intervalDur, err := time.ParseDuration(interval)
+// Metric polls NUT upstreams and exports their latest UPS snapshots as prometheus metrics.
+type Metric struct {
+	mode      string
+	upstreams []*upstream
+	store     *snapshot.Store
+
+	// info decides which string variables are exported as info metrics
+	info *filter
+}
+
+func New(
+	mode string,
+	infoAllow, infoDeny []string,
+	upstreams []Upstream,
+	store *snapshot.Store,
+) (*Metric, error) {
+	if mode != ModePoll && mode != ModeScrape {
+		return nil, errors.Errorf("unknown mode (%s)", mode)
+	}
+
+	info, err := newFilter(infoAllow, infoDeny)
 	if err != nil {
-		return nil, errors.Wrapf(err, "interval parsing fail (%s)", interval)
+		return nil, errors.Wrap(err, "info filter init fail")
+	}
+
+	m := &Metric{
+		mode:  mode,
+		store: store,
+		info:  info,
 	}
 
-	return &Metric{
-		interval:  intervalDur,
-		nutClient: nutClient,
-	}, nil
+	for _, u := range upstreams {
+		up := &upstream{
+			name:      u.Name,
+			nutClient: u.Client,
+		}
+
+		// the interval is needed only for polling
+		if mode == ModePoll {
+			if up.interval, err = time.ParseDuration(u.Interval); err != nil {
+				return nil, errors.Wrapf(err, "interval of upstream %q parsing fail (%s)", u.Name, u.Interval)
+			}
+		}
+
+		m.upstreams = append(m.upstreams, up)
+	}
+
+	return m, nil
 }
 
+// Run Polling every upstream on its interval concurrently, does nothing in the scrape mode.
 func (m *Metric) Run(ctx context.Context) error {
-	ticker := time.NewTicker(m.interval)
+	if m.mode == ModeScrape {
+		return nil
+	}
 
-	go func() {
-		select {
-		case <-ctx.Done():
-			ticker.Stop()
-		}
-	}()
+	var wg sync.WaitGroup
 
-	for _ = range ticker.C {
-		list, err := m.nutClient.GetUPSList(ctx)
-		if err != nil {
-			log.Warn().Err(err).Msg("get UPS list fail")
-			continue
-		}
+	for _, u := range m.upstreams {
+		wg.Add(1)
+
+		go func(u *upstream) {
+			defer wg.Done()
+
+			m.runUpstream(ctx, u)
+		}(u)
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+// Describe Sends descriptors of all metrics.
+func (m *Metric) Describe(ch chan<- *prometheus.Desc) {
+	ch <- variablesDesc
+	ch <- statusDesc
+	ch <- infoDesc
+	ch <- lastPollDesc
+	ch <- pollDurationDesc
+	ch <- pollErrorsDesc
+	ch <- upDesc
+}
+
+// Collect Sends metrics of the latest snapshots, the snapshots are read from NUT first in the scrape mode.
+func (m *Metric) Collect(ch chan<- prometheus.Metric) {
+	if m.mode == ModeScrape {
+		ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+		defer cancel()
 
-		for _, ups := range list {
-			for _, v := range ups.Variables {
-				if v.Type == "INTEGER" || v.Type == "FLOAT_64" {
-					value, err := strconv.ParseFloat(fmt.Sprintf("%v", v.Value), 64)
-					if err != nil {
-						log.Warn().Err(err).Msg("parse float64 of value fail")
-						continue
-					}
-
-					metrics.WithLabelValues(ups.Name, v.Name).Set(value)
-				} else {
-					if v.Type == "STRING" {
-						str, ok := v.Value.(string)
-						if !ok {
-							log.Warn().Err(err).Msg("type cast to string fail")
-							continue
-						}
-
-						if v.Name == "ups.status" {
-							metrics.WithLabelValues(ups.Name, v.Name).Set(float64(mapUpsStatus(str)))
-						} else {
-							// TODO: Parser another string values to float metrics representations
-							//metrics.WithLabelValues(ups.Name, v.Name).Set(str)
-						}
-					}
+		var wg sync.WaitGroup
+
+		for _, u := range m.upstreams {
+			wg.Add(1)
+
+			go func(u *upstream) {
+				defer wg.Done()
+
+				if err := m.poll(ctx, u); err != nil {
+					log.Warn().Err(err).Str("upstream", u.name).Msg("poll fail")
 				}
+			}(u)
+		}
+
+		wg.Wait()
+	}
+
+	for _, u := range m.upstreams {
+		// UPS metrics are collected only if the last poll was successful, so vanished UPSes and variables are dropped
+		if s, ok := m.store.Get(u.name); ok && u.isUp() {
+			for _, ups := range s.List {
+				m.collectUPS(ch, u.name, ups)
 			}
 		}
+
+		u.collect(ch)
+	}
+}
+
+// runUpstream Polling the upstream on its interval.
+func (m *Metric) runUpstream(ctx context.Context, u *upstream) {
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.poll(ctx, u); err != nil {
+			log.Warn().Err(err).Str("upstream", u.name).Msg("poll fail")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll Reads the UPS list of the upstream to the snapshot store.
+func (m *Metric) poll(ctx context.Context, u *upstream) error {
+	start := time.Now()
+
+	list, err := u.nutClient.GetUPSList(ctx)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.pollDuration = time.Since(start)
+	u.up = err == nil
+
+	if err != nil {
+		u.pollErrors++
+
+		return errors.Wrap(err, "get UPS list fail")
 	}
 
+	u.lastPoll = time.Now()
+	m.store.Set(snapshot.Snapshot{
+		Upstream: u.name,
+		Time:     u.lastPoll,
+		List:     list,
+	})
+
 	return nil
 }
 
-// mapUpsStatus Mapping string value of UPS status to int constants
-func mapUpsStatus(value string) int {
-	res, ok := mappingUPSStatuses[value]
-	if !ok {
-		return -1
+func (u *upstream) isUp() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.up
+}
+
+// collect Sends metrics of polling the upstream.
+func (u *upstream) collect(ch chan<- prometheus.Metric) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.lastPoll.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastPollDesc, prometheus.GaugeValue, float64(u.lastPoll.UnixNano())/1e9, u.name)
 	}
 
-	return res
+	ch <- prometheus.MustNewConstMetric(pollDurationDesc, prometheus.GaugeValue, u.pollDuration.Seconds(), u.name)
+	ch <- prometheus.MustNewConstMetric(pollErrorsDesc, prometheus.CounterValue, float64(u.pollErrors), u.name)
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, boolToFloat(u.up), u.name)
 }
@@ -0,0 +1,59 @@
+package nut
+
+import "strings"
+
+// statusFlags is the full set of flags NUT may report in ups.status.
+var statusFlags = []string{
+	"OL",      // on line
+	"OB",      // on battery
+	"LB",      // low battery
+	"HB",      // high battery
+	"RB",      // the battery needs to be replaced
+	"CHRG",    // the battery is charging
+	"DISCHRG", // the battery is discharging
+	"BYPASS",  // UPS bypass circuit is active
+	"CAL",     // UPS is currently performing runtime calibration
+	"OFF",     // UPS is offline
+	"OVER",    // UPS is overloaded
+	"TRIM",    // UPS is trimming incoming voltage
+	"BOOST",   // UPS is boosting incoming voltage
+	"FSD",     // forced shutdown
+	"ALARM",   // UPS has an active alarm
+	"TEST",    // UPS is under test
+}
+
+// primaryStatusPriority is the order the primary state is chosen from the flags of ups.status,
+// e.g. "OB DISCHRG LB" is low battery, "OL CHRG" is online.
+var primaryStatusPriority = []string{"LB", "OB", "OFF", "BYPASS", "OVER", "RB", "CAL", "TRIM", "BOOST", "OL", "CHRG", "DISCHRG"}
+
+// parseStatus Splits the ups.status value to flags.
+func parseStatus(value string) map[string]bool {
+	flags := make(map[string]bool)
+	for _, f := range strings.Fields(value) {
+		flags[strings.ToUpper(f)] = true
+	}
+
+	return flags
+}
+
+// isKnownStatusFlag Checks whether the flag is in the NUT flag set.
+func isKnownStatusFlag(flag string) bool {
+	for _, f := range statusFlags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// primaryStatus Returns the primary state of ups.status mapped to the int constant.
+func primaryStatus(flags map[string]bool) int {
+	for _, f := range primaryStatusPriority {
+		if flags[f] {
+			return mapUpsStatus(f)
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,24 @@
+package nut
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrimaryStatus(t *testing.T) {
+	t.Run("single flag", func(t *testing.T) {
+		require.Equal(t, 3, primaryStatus(parseStatus("OL")))
+		require.Equal(t, 4, primaryStatus(parseStatus("OB")))
+	})
+	t.Run("multiple flags", func(t *testing.T) {
+		require.Equal(t, 3, primaryStatus(parseStatus("OL CHRG")))
+		require.Equal(t, 6, primaryStatus(parseStatus("OB DISCHRG LB")))
+		require.Equal(t, 1, primaryStatus(parseStatus("OL TRIM")))
+	})
+	t.Run("unknown flags", func(t *testing.T) {
+		require.Equal(t, -1, primaryStatus(parseStatus("")))
+		require.Equal(t, -1, primaryStatus(parseStatus("FOO")))
+		require.Equal(t, 4, primaryStatus(parseStatus("OB FOO")))
+	})
+}
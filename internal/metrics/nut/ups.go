@@ -0,0 +1,158 @@
+package nut
+
+import (
+	"fmt"
+	"strconv"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	variablesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ups_variables"),
+		"Variables of UPS list",
+		[]string{"server", "ups", "variable"}, nil,
+	)
+	statusDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ups_status"),
+		"Flags of UPS status, 1 if the flag is set",
+		[]string{"server", "ups", "flag"}, nil,
+	)
+	infoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ups_variable_info"),
+		"String variables of UPS list, the value is in the label",
+		[]string{"server", "ups", "variable", "value"}, nil,
+	)
+)
+
+var mappingUPSStatuses = map[string]int{
+	"CAL":     0,
+	"TRIM":    1,
+	"BOOST":   2,
+	"OL":      3,
+	"OB":      4,
+	"OVER":    5,
+	"LB":      6,
+	"RB":      7,
+	"BYPASS":  8,
+	"OFF":     9,
+	"CHRG":    10,
+	"DISCHRG": 11,
+}
+
+// Sample is the numeric value of the UPS variable.
+type Sample struct {
+	Variable string
+	Value    float64
+}
+
+// Samples Returns numeric and boolean variables of the UPS the way they're exported as metrics:
+// booleans are 1 or 0 and ups.status is its primary state. Push outputs use it to export the same values.
+func Samples(ups *nut_client.UPS) []Sample {
+	res := make([]Sample, 0, len(ups.Variables))
+
+	for _, v := range ups.Variables {
+		switch v.Type {
+		case "INTEGER", "FLOAT_64":
+			value, err := strconv.ParseFloat(fmt.Sprintf("%v", v.Value), 64)
+			if err != nil {
+				log.Warn().Err(err).Msg("parse float64 of value fail")
+				continue
+			}
+
+			res = append(res, Sample{v.Name, value})
+		case "BOOLEAN":
+			b, ok := v.Value.(bool)
+			if !ok {
+				log.Warn().Str("variable", v.Name).Msg("type cast to bool fail")
+				continue
+			}
+
+			res = append(res, Sample{v.Name, boolToFloat(b)})
+		case "STRING":
+			if str, ok := v.Value.(string); ok && v.Name == "ups.status" {
+				res = append(res, Sample{v.Name, float64(primaryStatus(parseStatus(str)))})
+			}
+		}
+	}
+
+	return res
+}
+
+// StatusFlags Returns flags of ups.status the way they're exported as metrics: every known flag is 1 or 0,
+// unknown flags are only returned while they're present, Variable of the sample is the flag.
+// It's nil if the UPS doesn't report its status.
+func StatusFlags(ups *nut_client.UPS) []Sample {
+	for _, v := range ups.Variables {
+		str, ok := v.Value.(string)
+		if !ok || v.Name != "ups.status" {
+			continue
+		}
+
+		flags := parseStatus(str)
+		res := make([]Sample, 0, len(statusFlags)+len(flags))
+
+		for _, f := range statusFlags {
+			res = append(res, Sample{f, boolToFloat(flags[f])})
+		}
+		for f := range flags {
+			if !isKnownStatusFlag(f) {
+				res = append(res, Sample{f, 1})
+			}
+		}
+
+		return res
+	}
+
+	return nil
+}
+
+// collectUPS Sends metrics of UPS variables according to their types.
+func (m *Metric) collectUPS(ch chan<- prometheus.Metric, server string, ups *nut_client.UPS) {
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+
+	for _, s := range Samples(ups) {
+		gauge(variablesDesc, s.Value, server, ups.Name, s.Variable)
+	}
+	for _, f := range StatusFlags(ups) {
+		gauge(statusDesc, f.Value, server, ups.Name, f.Variable)
+	}
+
+	for _, v := range ups.Variables {
+		if v.Type != "STRING" {
+			continue
+		}
+
+		str, ok := v.Value.(string)
+		if !ok {
+			log.Warn().Str("variable", v.Name).Msg("type cast to string fail")
+			continue
+		}
+
+		if v.Name != "ups.status" && m.info.allowed(v.Name) {
+			gauge(infoDesc, 1, server, ups.Name, v.Name, str)
+		}
+	}
+}
+
+// mapUpsStatus Mapping string value of UPS status to int constants
+func mapUpsStatus(value string) int {
+	res, ok := mappingUPSStatuses[value]
+	if !ok {
+		return -1
+	}
+
+	return res
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
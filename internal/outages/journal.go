@@ -0,0 +1,515 @@
+// Package outages keeps the journal of power outages of UPSes.
+package outages
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/andreyAKor/nut_client_service/internal/events"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// How outages ended.
+const (
+	// The UPS is back on line power
+	EndPowerRestored = "power_restored"
+
+	// The UPS is lost after the battery was low or FSD was set, so it has most likely shut down
+	EndShutdown = "shutdown"
+
+	// The UPS is lost while the battery wasn't low
+	EndCommLost = "comm_lost"
+
+	// The service was stopped during the outage
+	EndInterrupted = "interrupted"
+)
+
+// defaultLimit is the number of outages returned by List if the filter has no limit.
+const defaultLimit = 100
+
+// Counters start from zero on every start, they don't depend on outages kept by the journal.
+var (
+	outagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nut_client_service",
+		Name:      "outages_total",
+		Help:      "Number of power outages.",
+	}, []string{"server", "ups"})
+	onBatterySecondsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nut_client_service",
+		Name:      "on_battery_seconds_total",
+		Help:      "Time spent on battery during power outages.",
+	}, []string{"server", "ups"})
+
+	_ events.Sink = (*Journal)(nil)
+	_ io.Closer   = (*Journal)(nil)
+)
+
+// Outage is the power outage of the UPS, End and Duration of the active outage are of its latest update.
+//
+// Statistics are omitted if the UPS doesn't report variables they're calculated of. Energy drawn from
+// the battery is calculated of ups.realpower or of ups.load and ups.realpower.nominal.
+type Outage struct {
+	Upstream string    `json:"upstream"`
+	UPS      string    `json:"ups"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Active   bool      `json:"active,omitempty"`
+
+	// Seconds
+	Duration float64 `json:"duration"`
+
+	// Percents, seconds, percents and watt-hours
+	MinCharge   *float64 `json:"minCharge,omitempty"`
+	MinRuntime  *float64 `json:"minRuntime,omitempty"`
+	AverageLoad *float64 `json:"averageLoad,omitempty"`
+	Energy      *float64 `json:"energy,omitempty"`
+
+	LowBattery     bool `json:"lowBattery"`
+	ForcedShutdown bool `json:"forcedShutdown"`
+
+	// How the outage ended, e.g. EndPowerRestored, it's empty for the active outage
+	EndReason string `json:"endReason,omitempty"`
+}
+
+// Filter selects outages, empty fields match any outage.
+type Filter struct {
+	Upstream  string
+	UPS       string
+	EndReason string
+
+	// Range of the start of outages
+	From time.Time
+	To   time.Time
+
+	MinDuration time.Duration
+
+	// Maximum number of the latest outages
+	Limit int
+}
+
+func (f Filter) match(o Outage) bool {
+	switch {
+	case len(f.Upstream) > 0 && f.Upstream != o.Upstream,
+		len(f.UPS) > 0 && f.UPS != o.UPS,
+		len(f.EndReason) > 0 && f.EndReason != o.EndReason,
+		!f.From.IsZero() && o.Start.Before(f.From),
+		!f.To.IsZero() && o.Start.After(f.To),
+		o.Duration < f.MinDuration.Seconds():
+		return false
+	}
+
+	return true
+}
+
+// active is the outage in progress with accumulators of its statistics.
+type active struct {
+	Outage
+
+	loadSum   float64
+	loadCount int
+
+	// power drawn at the latest update in watts
+	power    float64
+	hasPower bool
+}
+
+// Journal records outages started by ONBATT events and ended by ONLINE or NOCOMM events, statistics
+// are updated by snapshots taken by the poller while the outage is active.
+//
+// Ended outages are appended to the JSON lines file, they're kept only in memory if the file isn't set.
+// Outages ended before maxAge and the oldest outages above maxRecords are dropped, the file is rewritten then.
+type Journal struct {
+	file       string
+	maxAge     time.Duration
+	maxRecords int
+	store      *snapshot.Store
+
+	mu      sync.Mutex
+	outages []Outage
+	active  map[string]*active
+}
+
+func New(file, maxAge string, maxRecords int, store *snapshot.Store) (*Journal, error) {
+	maxAgeDur, err := time.ParseDuration(maxAge)
+	if err != nil {
+		return nil, errors.Wrapf(err, "max age parsing fail (%s)", maxAge)
+	}
+
+	j := &Journal{
+		file:       file,
+		maxAge:     maxAgeDur,
+		maxRecords: maxRecords,
+		store:      store,
+		active:     make(map[string]*active),
+	}
+
+	if err := j.load(); err != nil {
+		return nil, errors.Wrapf(err, "journal loading fail (%s)", file)
+	}
+
+	if j.prune(time.Now()) {
+		if err := j.rewrite(); err != nil {
+			return nil, errors.Wrapf(err, "journal rewriting fail (%s)", file)
+		}
+	}
+
+	return j, nil
+}
+
+// Notify Starts the outage on ONBATT, marks it by LOWBATT and FSD and ends it on ONLINE and NOCOMM.
+func (j *Journal) Notify(ctx context.Context, e events.Event) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := e.UPS + "@" + e.Upstream
+	a, ok := j.active[key]
+
+	switch {
+	case e.Type == events.TypeOnBatt && !ok:
+		a = &active{Outage: Outage{
+			Upstream: e.Upstream,
+			UPS:      e.UPS,
+			Start:    e.Time,
+			End:      e.Time,
+			Active:   true,
+		}}
+		a.observe(e.Variables)
+		j.active[key] = a
+
+		outagesTotal.WithLabelValues(e.Upstream, e.UPS).Inc()
+	case !ok:
+		return nil
+	case e.Type == events.TypeLowBatt:
+		a.LowBattery = true
+	case e.Type == events.TypeFSD:
+		a.ForcedShutdown = true
+	case e.Type == events.TypeOnline:
+		return j.end(key, a, e.Time, EndPowerRestored)
+	case e.Type == events.TypeNoComm:
+		// the UPS isn't seen since the latest update, so the outage is ended by it
+		if a.LowBattery || a.ForcedShutdown {
+			return j.end(key, a, a.End, EndShutdown)
+		}
+
+		return j.end(key, a, a.End, EndCommLost)
+	}
+
+	return nil
+}
+
+// Run Updating statistics of active outages by snapshots until the context is done.
+func (j *Journal) Run(ctx context.Context) error {
+	snapshots, cancel := j.store.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case s := <-snapshots:
+			j.update(s)
+		}
+	}
+}
+
+// Close Records active outages as interrupted.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for key, a := range j.active {
+		if err := j.end(key, a, a.End, EndInterrupted); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List Returns active and recorded outages matching the filter, the latest is the first.
+func (j *Journal) List(f Filter) []Outage {
+	if f.Limit <= 0 {
+		f.Limit = defaultLimit
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	res := make([]Outage, 0)
+
+	for _, a := range j.active {
+		if o := a.snapshot(); f.match(o) {
+			res = append(res, o)
+		}
+	}
+
+	sort.Slice(res, func(i, k int) bool {
+		return res[i].Start.After(res[k].Start)
+	})
+
+	for i := len(j.outages) - 1; i >= 0 && len(res) < f.Limit; i-- {
+		if f.match(j.outages[i]) {
+			res = append(res, j.outages[i])
+		}
+	}
+
+	if len(res) > f.Limit {
+		res = res[:f.Limit]
+	}
+
+	return res
+}
+
+// update Updates statistics of active outages of UPSes of the snapshot.
+func (j *Journal) update(s snapshot.Snapshot) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, ups := range s.List {
+		a, ok := j.active[ups.Name+"@"+s.Upstream]
+		if !ok || !s.Time.After(a.End) {
+			continue
+		}
+
+		a.advance(s.Time)
+		a.observe(variables(ups))
+	}
+}
+
+// end Records the outage ended at the time, j.mu must be held.
+func (j *Journal) end(key string, a *active, t time.Time, reason string) error {
+	delete(j.active, key)
+
+	a.advance(t)
+	o := a.snapshot()
+	o.Active = false
+	o.EndReason = reason
+
+	j.outages = append(j.outages, o)
+	pruned := j.prune(time.Now())
+
+	log.Info().
+		Str("upstream", o.Upstream).
+		Str("ups", o.UPS).
+		Float64("duration", o.Duration).
+		Str("endReason", reason).
+		Msg("outage is ended")
+
+	if pruned {
+		if err := j.rewrite(); err != nil {
+			return errors.Wrap(err, "rewrite outages fail")
+		}
+
+		return nil
+	}
+
+	if err := j.write(o); err != nil {
+		return errors.Wrap(err, "write outage fail")
+	}
+
+	return nil
+}
+
+// prune Drops outages ended before maxAge and the oldest outages above maxRecords, it reports whether
+// any outage is dropped, j.mu must be held.
+func (j *Journal) prune(now time.Time) bool {
+	n := 0
+
+	if j.maxAge > 0 {
+		for n < len(j.outages) && now.Sub(j.outages[n].End) > j.maxAge {
+			n++
+		}
+	}
+	if j.maxRecords > 0 && len(j.outages)-n > j.maxRecords {
+		n = len(j.outages) - j.maxRecords
+	}
+
+	if n == 0 {
+		return false
+	}
+
+	j.outages = append(j.outages[:0], j.outages[n:]...)
+
+	return true
+}
+
+// rewrite Replaces the file by the kept outages.
+func (j *Journal) rewrite() error {
+	if len(j.file) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	for _, o := range j.outages {
+		data, err := json.Marshal(o)
+		if err != nil {
+			return errors.Wrap(err, "JSON-marshal fail")
+		}
+
+		buf.Write(append(data, '\n'))
+	}
+
+	tmp := j.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return errors.Wrap(err, "write fail")
+	}
+	if err := os.Rename(tmp, j.file); err != nil {
+		return errors.Wrap(err, "rename fail")
+	}
+
+	return nil
+}
+
+// write Appends the outage to the file.
+func (j *Journal) write(o Outage) error {
+	if len(j.file) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(o)
+	if err != nil {
+		return errors.Wrap(err, "JSON-marshal fail")
+	}
+
+	f, err := os.OpenFile(j.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "open fail")
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "write fail")
+	}
+
+	return nil
+}
+
+// load Reads outages recorded before restart.
+func (j *Journal) load() error {
+	if len(j.file) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.file), 0o755); err != nil {
+		return errors.Wrap(err, "create directory fail")
+	}
+
+	f, err := os.Open(j.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "open fail")
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		var o Outage
+		if err := json.Unmarshal(s.Bytes(), &o); err != nil {
+			return errors.Wrapf(err, "line %d: JSON-unmarshal fail", line)
+		}
+
+		j.outages = append(j.outages, o)
+	}
+
+	if err := s.Err(); err != nil {
+		return errors.Wrap(err, "scan fail")
+	}
+
+	return nil
+}
+
+// advance Accounts the time on battery and the energy drawn since the latest update.
+func (a *active) advance(t time.Time) {
+	if !t.After(a.End) {
+		return
+	}
+
+	dt := t.Sub(a.End)
+
+	onBatterySecondsTotal.WithLabelValues(a.Upstream, a.UPS).Add(dt.Seconds())
+
+	if a.hasPower {
+		energy := a.power * dt.Hours()
+		if a.Energy != nil {
+			energy += *a.Energy
+		}
+
+		a.Energy = &energy
+	}
+
+	a.End = t
+}
+
+// observe Updates statistics by variables of the UPS.
+func (a *active) observe(vars map[string]interface{}) {
+	if v, ok := floatValue(vars["battery.charge"]); ok && (a.MinCharge == nil || v < *a.MinCharge) {
+		a.MinCharge = &v
+	}
+	if v, ok := floatValue(vars["battery.runtime"]); ok && (a.MinRuntime == nil || v < *a.MinRuntime) {
+		a.MinRuntime = &v
+	}
+
+	load, hasLoad := floatValue(vars["ups.load"])
+	if hasLoad {
+		a.loadSum += load
+		a.loadCount++
+	}
+
+	a.hasPower = false
+	if v, ok := floatValue(vars["ups.realpower"]); ok {
+		a.power, a.hasPower = v, true
+	} else if nominal, ok := floatValue(vars["ups.realpower.nominal"]); ok && hasLoad {
+		a.power, a.hasPower = load*nominal/100, true
+	}
+}
+
+// snapshot Returns the outage with statistics of the latest update.
+func (a *active) snapshot() Outage {
+	o := a.Outage
+	o.Duration = o.End.Sub(o.Start).Seconds()
+
+	if a.loadCount > 0 {
+		avg := a.loadSum / float64(a.loadCount)
+		o.AverageLoad = &avg
+	}
+
+	return o
+}
+
+func variables(ups *nut_client.UPS) map[string]interface{} {
+	res := make(map[string]interface{}, len(ups.Variables))
+	for _, v := range ups.Variables {
+		res[v.Name] = v.Value
+	}
+
+	return res
+}
+
+func floatValue(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+
+	return 0, false
+}
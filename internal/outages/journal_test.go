@@ -0,0 +1,245 @@
+package outages
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/events"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+func testEvent(typ string, t time.Time) events.Event {
+	return events.Event{
+		Type:     typ,
+		Upstream: "main",
+		UPS:      "ups",
+		Time:     t,
+		Variables: map[string]interface{}{
+			"battery.charge":        int64(100),
+			"battery.runtime":       int64(1800),
+			"ups.load":              int64(40),
+			"ups.realpower.nominal": int64(500),
+		},
+	}
+}
+
+func testSnapshot(t time.Time, charge, runtime, load int64) snapshot.Snapshot {
+	return snapshot.Snapshot{
+		Upstream: "main",
+		Time:     t,
+		List: []*nut_client.UPS{{
+			Name: "ups",
+			Variables: []nut_client.Variable{
+				{Name: "battery.charge", Value: charge, Type: "INTEGER"},
+				{Name: "battery.runtime", Value: runtime, Type: "INTEGER"},
+				{Name: "ups.load", Value: load, Type: "INTEGER"},
+				{Name: "ups.realpower.nominal", Value: int64(500), Type: "INTEGER"},
+			},
+		}},
+	}
+}
+
+// counter Returns the value of the counter of the upstream, it's zero if the counter isn't exported.
+func counter(t *testing.T, name, upstream string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "server" && l.GetValue() == upstream {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("outage", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "outages", "outages.jsonl")
+
+		j, err := New(file, "0s", 0, snapshot.New())
+		require.NoError(t, err)
+
+		// events of UPSes on line power are ignored
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeLowBatt, base)))
+		require.Empty(t, j.List(Filter{}))
+
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnBatt, base)))
+		j.update(testSnapshot(base.Add(30*time.Minute), 60, 900, 80))
+
+		list := j.List(Filter{})
+		require.Len(t, list, 1)
+		require.True(t, list[0].Active)
+		require.Equal(t, float64(1800), list[0].Duration)
+
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeLowBatt, base.Add(30*time.Minute))))
+		j.update(testSnapshot(base.Add(time.Hour), 20, 300, 60))
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnline, base.Add(90*time.Minute))))
+
+		list = j.List(Filter{})
+		require.Len(t, list, 1)
+
+		o := list[0]
+		require.False(t, o.Active)
+		require.Equal(t, EndPowerRestored, o.EndReason)
+		require.Equal(t, base, o.Start)
+		require.Equal(t, base.Add(90*time.Minute), o.End)
+		require.Equal(t, float64(5400), o.Duration)
+		require.True(t, o.LowBattery)
+		require.False(t, o.ForcedShutdown)
+		require.Equal(t, float64(20), *o.MinCharge)
+		require.Equal(t, float64(300), *o.MinRuntime)
+		require.Equal(t, float64(60), *o.AverageLoad)
+
+		// 200W for 30m, 400W for 30m and 300W for 30m
+		require.InDelta(t, 450, *o.Energy, 1e-9)
+
+		// the outage is read on restart
+		j, err = New(file, "0s", 0, snapshot.New())
+		require.NoError(t, err)
+		require.Equal(t, list, j.List(Filter{}))
+	})
+	t.Run("end reasons", func(t *testing.T) {
+		j, err := New("", "0s", 0, snapshot.New())
+		require.NoError(t, err)
+
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnBatt, base)))
+		j.update(testSnapshot(base.Add(time.Minute), 10, 60, 40))
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeFSD, base.Add(time.Minute))))
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeNoComm, base.Add(5*time.Minute))))
+
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnBatt, base.Add(time.Hour))))
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeNoComm, base.Add(2*time.Hour))))
+
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnBatt, base.Add(3*time.Hour))))
+		j.update(testSnapshot(base.Add(3*time.Hour+time.Minute), 90, 1500, 40))
+		require.NoError(t, j.Close())
+
+		list := j.List(Filter{})
+		require.Len(t, list, 3)
+
+		// the UPS lost is ended at its latest update
+		require.Equal(t, EndShutdown, list[2].EndReason)
+		require.Equal(t, base.Add(time.Minute), list[2].End)
+		require.True(t, list[2].ForcedShutdown)
+
+		require.Equal(t, EndCommLost, list[1].EndReason)
+		require.Zero(t, list[1].Duration)
+
+		require.Equal(t, EndInterrupted, list[0].EndReason)
+		require.Equal(t, float64(60), list[0].Duration)
+	})
+	t.Run("filter", func(t *testing.T) {
+		j, err := New("", "0s", 0, snapshot.New())
+		require.NoError(t, err)
+
+		for i := 0; i < 5; i++ {
+			start := base.Add(time.Duration(i) * time.Hour)
+
+			require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnBatt, start)))
+			require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnline, start.Add(time.Duration(i)*time.Minute))))
+		}
+
+		require.Len(t, j.List(Filter{}), 5)
+		require.Len(t, j.List(Filter{Limit: 2}), 2)
+		require.Len(t, j.List(Filter{UPS: "other"}), 0)
+		require.Len(t, j.List(Filter{Upstream: "main", EndReason: EndPowerRestored}), 5)
+		require.Len(t, j.List(Filter{EndReason: EndShutdown}), 0)
+		require.Len(t, j.List(Filter{MinDuration: 3 * time.Minute}), 2)
+
+		list := j.List(Filter{From: base.Add(time.Hour), To: base.Add(3 * time.Hour)})
+		require.Len(t, list, 3)
+		require.Equal(t, base.Add(3*time.Hour), list[0].Start)
+		require.Equal(t, base.Add(time.Hour), list[2].Start)
+	})
+	t.Run("retention", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "outages.jsonl")
+
+		j, err := New(file, "0s", 0, snapshot.New())
+		require.NoError(t, err)
+
+		now := time.Now().UTC().Round(0)
+
+		// an outage a day for 5 days, the latest is an hour ago
+		for i := 4; i >= 0; i-- {
+			start := now.Add(-time.Duration(i)*24*time.Hour - 2*time.Hour)
+
+			require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnBatt, start)))
+			require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnline, start.Add(time.Hour))))
+		}
+		require.Len(t, j.List(Filter{}), 5)
+
+		// outages older than the max age are dropped from the file on start
+		j, err = New(file, "60h", 0, snapshot.New())
+		require.NoError(t, err)
+		require.Len(t, j.List(Filter{}), 3)
+
+		data, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		require.Equal(t, 3, bytes.Count(data, []byte("\n")))
+
+		// the oldest outages above the max number are dropped when the outage is ended
+		j, err = New(file, "60h", 3, snapshot.New())
+		require.NoError(t, err)
+
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnBatt, now.Add(-time.Minute))))
+		require.NoError(t, j.Notify(ctx, testEvent(events.TypeOnline, now)))
+
+		list := j.List(Filter{})
+		require.Len(t, list, 3)
+		require.Equal(t, now, list[0].End)
+		require.Equal(t, now.Add(-26*time.Hour), list[2].Start)
+
+		j, err = New(file, "60h", 3, snapshot.New())
+		require.NoError(t, err)
+		require.Len(t, j.List(Filter{}), 3)
+		require.True(t, j.List(Filter{})[0].End.Equal(now))
+	})
+	t.Run("counters", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "outages.jsonl")
+
+		ev := func(typ string, t time.Time) events.Event {
+			e := testEvent(typ, t)
+			e.Upstream = "counted"
+
+			return e
+		}
+
+		j, err := New(file, "0s", 0, snapshot.New())
+		require.NoError(t, err)
+
+		require.NoError(t, j.Notify(ctx, ev(events.TypeOnBatt, base)))
+		require.NoError(t, j.Notify(ctx, ev(events.TypeOnline, base.Add(time.Minute))))
+		require.Equal(t, float64(1), counter(t, "nut_client_service_outages_total", "counted"))
+		require.Equal(t, float64(60), counter(t, "nut_client_service_on_battery_seconds_total", "counted"))
+
+		// outages read on restart aren't counted again
+		_, err = New(file, "0s", 0, snapshot.New())
+		require.NoError(t, err)
+		require.Equal(t, float64(1), counter(t, "nut_client_service_outages_total", "counted"))
+		require.Equal(t, float64(60), counter(t, "nut_client_service_on_battery_seconds_total", "counted"))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New("", "month", 0, snapshot.New())
+		require.Error(t, err)
+	})
+}
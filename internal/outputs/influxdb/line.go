@@ -0,0 +1,58 @@
+package influxdb
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	metricsNut "github.com/andreyAKor/nut_client_service/internal/metrics/nut"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// encodeLine Encodes samples of the UPS as the line of the line protocol, e.g.
+// `ups,ups=myups,upstream=default battery.charge=100,ups.status=3 1620000000000000000`.
+// It returns false if there isn't any field to write.
+func encodeLine(measurement, upstream, ups string, samples []metricsNut.Sample, t time.Time) (string, bool) {
+	var b strings.Builder
+
+	b.WriteString(measurementEscaper.Replace(measurement))
+	b.WriteString(",ups=")
+	b.WriteString(keyEscaper.Replace(ups))
+	b.WriteString(",upstream=")
+	b.WriteString(keyEscaper.Replace(upstream))
+
+	fields := 0
+
+	for _, s := range samples {
+		// InfluxDB rejects NaN and infinite values
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+
+		if fields == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(keyEscaper.Replace(s.Variable))
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(s.Value, 'f', -1, 64))
+
+		fields++
+	}
+
+	if fields == 0 {
+		return "", false
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+
+	return b.String(), true
+}
@@ -0,0 +1,344 @@
+// Package influxdb writes numeric and boolean UPS variables to InfluxDB by the line protocol.
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	metricsNut "github.com/andreyAKor/nut_client_service/internal/metrics/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// maxRetryBackoff limits the delay of retries doubled after every failed flush.
+const maxRetryBackoff = 5 * time.Minute
+
+var _ io.Closer = (*Writer)(nil)
+
+// Writer writes a line per UPS of every snapshot taken by the poller, lines are tagged by "upstream" and "ups"
+// and fields are variables exported as Prometheus metrics.
+//
+// Lines are sent in batches, failed batches are kept in the buffer and retried after the backoff starting
+// from the flush interval, the oldest lines are dropped when the buffer is full.
+type Writer struct {
+	enabled bool
+
+	// writeURL is "/api/v2/write" of InfluxDB 2.x or "/write" of InfluxDB 1.x with the query
+	writeURL string
+	token    string
+	username string
+	password string
+	gzip     bool
+
+	measurement   string
+	batchSize     int
+	bufferSize    int
+	flushInterval time.Duration
+	timeout       time.Duration
+
+	client *http.Client
+	store  *snapshot.Store
+
+	buffer []string
+
+	// flushes are postponed until retryAt after failures, backoff is the latest delay
+	retryAt time.Time
+	backoff time.Duration
+
+	// started is closed by Run, stop is closed by Close, stopped is closed when Run has flushed the buffer
+	started  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func New(
+	enabled bool,
+	version int,
+	baseURL string,
+	org, bucket, token string,
+	database, retentionPolicy, username, password string,
+	measurement string,
+	batchSize, bufferSize int,
+	flushInterval, timeout string,
+	gzipEnabled bool,
+	store *snapshot.Store,
+) (*Writer, error) {
+	w := &Writer{
+		enabled:     enabled,
+		token:       token,
+		username:    username,
+		password:    password,
+		gzip:        gzipEnabled,
+		measurement: measurement,
+		batchSize:   batchSize,
+		bufferSize:  bufferSize,
+		store:       store,
+		started:     make(chan struct{}),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	if !enabled {
+		return w, nil
+	}
+
+	if batchSize < 1 {
+		return nil, errors.Errorf("batch size must be positive (%d)", batchSize)
+	}
+	if bufferSize < batchSize {
+		return nil, errors.Errorf("buffer size must not be less than batch size (%d)", bufferSize)
+	}
+	if len(measurement) == 0 {
+		return nil, errors.New("empty measurement")
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "URL parsing fail (%s)", baseURL)
+	}
+
+	query := url.Values{"precision": {"ns"}}
+
+	switch version {
+	case 1:
+		if len(database) == 0 {
+			return nil, errors.New("empty database")
+		}
+
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		query.Set("db", database)
+		if len(retentionPolicy) > 0 {
+			query.Set("rp", retentionPolicy)
+		}
+	case 2:
+		if len(org) == 0 || len(bucket) == 0 {
+			return nil, errors.New("empty org or bucket")
+		}
+
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		query.Set("org", org)
+		query.Set("bucket", bucket)
+	default:
+		return nil, errors.Errorf("InfluxDB version %d isn't supported", version)
+	}
+
+	u.RawQuery = query.Encode()
+	w.writeURL = u.String()
+
+	if w.flushInterval, err = time.ParseDuration(flushInterval); err != nil {
+		return nil, errors.Wrapf(err, "flush interval parsing fail (%s)", flushInterval)
+	}
+	if w.timeout, err = time.ParseDuration(timeout); err != nil {
+		return nil, errors.Wrapf(err, "timeout parsing fail (%s)", timeout)
+	}
+
+	w.client = &http.Client{Timeout: w.timeout}
+
+	return w, nil
+}
+
+// Run Buffering snapshots and writing them to InfluxDB until the context is done.
+func (w *Writer) Run(ctx context.Context) error {
+	if !w.enabled {
+		return nil
+	}
+
+	close(w.started)
+	defer close(w.stopped)
+
+	snapshots, cancel := w.store.Subscribe()
+	defer cancel()
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.stop:
+			flushCtx, cancelFlush := context.WithTimeout(context.Background(), w.timeout)
+			defer cancelFlush()
+
+			if err := w.flush(flushCtx); err != nil {
+				log.Error().Err(err).Int("lines", len(w.buffer)).Msg("InfluxDB final write fail, lines are lost")
+			}
+
+			return nil
+		case s := <-snapshots:
+			w.add(s)
+
+			if len(w.buffer) >= w.batchSize {
+				w.tryFlush(ctx, time.Now())
+			}
+		case now := <-ticker.C:
+			w.tryFlush(ctx, now)
+		}
+	}
+}
+
+// Close Writes buffered lines, the final flush is limited by the timeout.
+func (w *Writer) Close() error {
+	if !w.enabled {
+		return nil
+	}
+
+	w.stopOnce.Do(func() { close(w.stop) })
+
+	// nothing is buffered if Run hasn't been started
+	select {
+	case <-w.started:
+		<-w.stopped
+	default:
+	}
+
+	return nil
+}
+
+// add Appends lines of UPSes of the snapshot to the buffer dropping the oldest lines if it's full.
+func (w *Writer) add(s snapshot.Snapshot) {
+	for _, ups := range s.List {
+		if line, ok := encodeLine(w.measurement, s.Upstream, ups.Name, metricsNut.Samples(ups), s.Time); ok {
+			w.buffer = append(w.buffer, line)
+		}
+	}
+
+	if dropped := len(w.buffer) - w.bufferSize; dropped > 0 {
+		log.Warn().Int("lines", dropped).Msg("InfluxDB buffer is full, the oldest lines are dropped")
+
+		w.buffer = append(w.buffer[:0], w.buffer[dropped:]...)
+	}
+}
+
+// tryFlush Flushes the buffer unless flushes are postponed after failures, the delay is doubled
+// after every failed flush up to maxRetryBackoff or the flush interval if it's longer.
+func (w *Writer) tryFlush(ctx context.Context, now time.Time) {
+	if now.Before(w.retryAt) {
+		return
+	}
+
+	if err := w.flush(ctx); err != nil {
+		limit := maxRetryBackoff
+		if limit < w.flushInterval {
+			limit = w.flushInterval
+		}
+
+		w.backoff *= 2
+		if w.backoff == 0 {
+			w.backoff = w.flushInterval
+		}
+		if w.backoff > limit {
+			w.backoff = limit
+		}
+
+		w.retryAt = now.Add(w.backoff)
+
+		log.Warn().
+			Err(err).
+			Int("lines", len(w.buffer)).
+			Dur("retryIn", w.backoff).
+			Msg("InfluxDB write fail, lines are kept for retry")
+
+		return
+	}
+
+	w.backoff = 0
+	w.retryAt = time.Time{}
+}
+
+// flush Writes the buffer by batches, it stops on the first failed batch keeping it for the next flush.
+// Batches rejected by InfluxDB as malformed are dropped since retrying them is useless.
+func (w *Writer) flush(ctx context.Context) error {
+	for len(w.buffer) > 0 {
+		n := len(w.buffer)
+		if n > w.batchSize {
+			n = w.batchSize
+		}
+
+		retry, err := w.write(ctx, w.buffer[:n])
+		if err != nil && retry {
+			return err
+		}
+		if err != nil {
+			log.Error().Err(err).Int("lines", n).Msg("InfluxDB write fail, lines are dropped")
+		}
+
+		w.buffer = append(w.buffer[:0], w.buffer[n:]...)
+	}
+
+	return nil
+}
+
+// write Sends lines to InfluxDB, retry reports whether the failure is temporary.
+func (w *Writer) write(ctx context.Context, lines []string) (retry bool, err error) {
+	body, err := w.body(lines)
+	if err != nil {
+		return false, errors.Wrap(err, "encode body fail")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "create request fail")
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if len(w.token) > 0 {
+		req.Header.Set("Authorization", "Token "+w.token)
+	} else if len(w.username) > 0 {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "send request fail")
+	}
+	defer res.Body.Close()
+
+	msg, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return true, errors.Wrap(err, "read response fail")
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = errors.Errorf("unexpected status %d (%s)", res.StatusCode, strings.TrimSpace(string(msg)))
+
+	// 400 and 413 reject the data itself, other statuses like 401, 429 and 503 may pass later
+	return res.StatusCode != http.StatusBadRequest && res.StatusCode != http.StatusRequestEntityTooLarge, err
+}
+
+// body Joins lines by newlines compressing them if gzip is enabled.
+func (w *Writer) body(lines []string) ([]byte, error) {
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	if !w.gzip {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, errors.Wrap(err, "gzip write fail")
+	}
+	if err := gz.Close(); err != nil {
+		return nil, errors.Wrap(err, "gzip close fail")
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,240 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/stretchr/testify/require"
+
+	metricsNut "github.com/andreyAKor/nut_client_service/internal/metrics/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// fakeInflux records write requests and replies with queued statuses, 204 if the queue is empty.
+type fakeInflux struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err == nil {
+			body, _ = ioutil.ReadAll(gz)
+		}
+	} else {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, string(body))
+
+	status := http.StatusNoContent
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+
+	w.WriteHeader(status)
+}
+
+func testSnapshot(t time.Time, charge int64) snapshot.Snapshot {
+	return snapshot.Snapshot{
+		Upstream: "main",
+		Time:     t,
+		List: []*nut_client.UPS{{
+			Name: "my ups",
+			Variables: []nut_client.Variable{
+				{Name: "battery.charge", Value: charge, Type: "INTEGER"},
+				{Name: "input.voltage", Value: 229.5, Type: "FLOAT_64"},
+				{Name: "ups.beeper.status", Value: true, Type: "BOOLEAN"},
+				{Name: "ups.status", Value: "OB LB", Type: "STRING"},
+				{Name: "ups.model", Value: "Smart-UPS", Type: "STRING"},
+			},
+		}},
+	}
+}
+
+func TestEncodeLine(t *testing.T) {
+	ts := time.Unix(1620000000, 0)
+
+	t.Run("samples", func(t *testing.T) {
+		s := testSnapshot(ts, 100)
+
+		line, ok := encodeLine("ups", s.Upstream, s.List[0].Name, metricsNut.Samples(s.List[0]), s.Time)
+		require.True(t, ok)
+		require.Equal(t, `ups,ups=my\ ups,upstream=main battery.charge=100,input.voltage=229.5,ups.beeper.status=1,ups.status=6 1620000000000000000`, line)
+	})
+	t.Run("escaping", func(t *testing.T) {
+		line, ok := encodeLine("nut ups,x", "a=b", "c,d", []metricsNut.Sample{{Variable: "x y", Value: 1}}, ts)
+		require.True(t, ok)
+		require.Equal(t, `nut\ ups\,x,ups=c\,d,upstream=a\=b x\ y=1 1620000000000000000`, line)
+	})
+	t.Run("no fields", func(t *testing.T) {
+		_, ok := encodeLine("ups", "main", "ups", nil, ts)
+		require.False(t, ok)
+	})
+}
+
+func TestWriter(t *testing.T) {
+	ts := time.Unix(1620000000, 0)
+
+	newWriter := func(t *testing.T, version int, gzipEnabled bool, bufferSize int) (*Writer, *fakeInflux) {
+		f := &fakeInflux{}
+		srv := httptest.NewServer(f)
+		t.Cleanup(srv.Close)
+
+		w, err := New(true, version, srv.URL, "org", "bucket", "secret", "nut", "autogen", "user", "pass",
+			"ups", 2, bufferSize, "1h", "1s", gzipEnabled, snapshot.New())
+		require.NoError(t, err)
+
+		return w, f
+	}
+
+	t.Run("v2", func(t *testing.T) {
+		w, f := newWriter(t, 2, true, 10)
+
+		w.add(testSnapshot(ts, 100))
+		require.NoError(t, w.flush(context.Background()))
+
+		require.Len(t, f.requests, 1)
+		require.Empty(t, w.buffer)
+
+		r := f.requests[0]
+		require.Equal(t, "/api/v2/write", r.URL.Path)
+		require.Equal(t, "org", r.URL.Query().Get("org"))
+		require.Equal(t, "bucket", r.URL.Query().Get("bucket"))
+		require.Equal(t, "ns", r.URL.Query().Get("precision"))
+		require.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		require.True(t, strings.HasPrefix(f.bodies[0], `ups,ups=my\ ups,upstream=main battery.charge=100,`))
+	})
+	t.Run("v1", func(t *testing.T) {
+		w, f := newWriter(t, 1, false, 10)
+		w.token = ""
+
+		w.add(testSnapshot(ts, 100))
+		require.NoError(t, w.flush(context.Background()))
+
+		require.Len(t, f.requests, 1)
+
+		r := f.requests[0]
+		require.Equal(t, "/write", r.URL.Path)
+		require.Equal(t, "nut", r.URL.Query().Get("db"))
+		require.Equal(t, "autogen", r.URL.Query().Get("rp"))
+		require.Empty(t, r.Header.Get("Content-Encoding"))
+
+		username, password, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "user", username)
+		require.Equal(t, "pass", password)
+	})
+	t.Run("batches", func(t *testing.T) {
+		w, f := newWriter(t, 2, false, 10)
+
+		for i := 0; i < 5; i++ {
+			w.add(testSnapshot(ts.Add(time.Duration(i)*time.Second), int64(i)))
+		}
+		require.NoError(t, w.flush(context.Background()))
+
+		require.Len(t, f.bodies, 3)
+		require.Equal(t, 2, strings.Count(f.bodies[0], "\n"))
+		require.Equal(t, 1, strings.Count(f.bodies[2], "\n"))
+	})
+	t.Run("retry", func(t *testing.T) {
+		w, f := newWriter(t, 2, false, 3)
+		f.statuses = []int{http.StatusServiceUnavailable}
+
+		w.add(testSnapshot(ts, 1))
+		require.Error(t, w.flush(context.Background()))
+		require.Len(t, w.buffer, 1)
+
+		// the buffer keeps the newest lines during the outage
+		for i := 2; i <= 4; i++ {
+			w.add(testSnapshot(ts, int64(i)))
+		}
+		require.Len(t, w.buffer, 3)
+		require.Contains(t, w.buffer[0], "battery.charge=2,")
+
+		require.NoError(t, w.flush(context.Background()))
+		require.Empty(t, w.buffer)
+		require.Len(t, f.bodies, 3)
+		require.Contains(t, f.bodies[1], "battery.charge=2,")
+	})
+	t.Run("backoff", func(t *testing.T) {
+		w, f := newWriter(t, 2, false, 10)
+		w.flushInterval = time.Second
+		f.statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+
+		now := time.Now()
+		w.add(testSnapshot(ts, 1))
+
+		// batch flushes are postponed too, so the outage of InfluxDB isn't hammered by every snapshot
+		for _, step := range []struct {
+			after    time.Duration
+			requests int
+		}{
+			{0, 1},
+			{500 * time.Millisecond, 1},
+			{time.Second, 2},
+			{2 * time.Second, 2},
+			{3 * time.Second, 3},
+		} {
+			w.tryFlush(context.Background(), now.Add(step.after))
+			require.Len(t, f.requests, step.requests, step.after)
+		}
+
+		require.Empty(t, w.buffer)
+		require.Zero(t, w.backoff)
+		require.True(t, w.retryAt.IsZero())
+	})
+	t.Run("close without run", func(t *testing.T) {
+		w, _ := newWriter(t, 2, false, 10)
+
+		closed := make(chan error, 1)
+		go func() { closed <- w.Close() }()
+
+		select {
+		case err := <-closed:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("close is blocked")
+		}
+	})
+	t.Run("malformed", func(t *testing.T) {
+		w, f := newWriter(t, 2, false, 10)
+		f.statuses = []int{http.StatusBadRequest}
+
+		w.add(testSnapshot(ts, 1))
+		require.NoError(t, w.flush(context.Background()))
+
+		require.Empty(t, w.buffer)
+		require.Len(t, f.requests, 1)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(true, 3, "http://127.0.0.1:8086", "org", "bucket", "", "", "", "", "",
+			"ups", 2, 10, "1s", "1s", false, snapshot.New())
+		require.Error(t, err)
+
+		_, err = New(true, 2, "http://127.0.0.1:8086", "", "", "", "", "", "", "",
+			"ups", 2, 10, "1s", "1s", false, snapshot.New())
+		require.Error(t, err)
+
+		_, err = New(true, 1, "http://127.0.0.1:8086", "", "", "", "nut", "", "", "",
+			"ups", 2, 1, "1s", "1s", false, snapshot.New())
+		require.Error(t, err)
+	})
+}
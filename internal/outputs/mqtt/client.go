@@ -0,0 +1,324 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// connAck return codes.
+var connAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+var (
+	ErrConnectionRefused = errors.New("MQTT connection refused")
+	ErrConnectionClosed  = errors.New("MQTT connection closed")
+)
+
+// client is the single MQTT connection, it's replaced by the new one when it's lost.
+type client struct {
+	conn      net.Conn
+	timeout   time.Duration
+	keepAlive time.Duration
+
+	// onMessage is called by the reading goroutine for messages of subscriptions
+	onMessage func(m message)
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint16
+	acks     map[uint16]chan struct{}
+	received time.Time
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// dial Connects to the broker and starts reading packets.
+func dial(
+	ctx context.Context,
+	address string,
+	tlsConfig *tls.Config,
+	c connect,
+	timeout time.Duration,
+	onMessage func(m message),
+) (*client, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial fail")
+	}
+
+	if tlsConfig != nil {
+		tlsConn := tls.Client(conn, tlsConfig)
+
+		handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+			_ = conn.Close()
+
+			return nil, errors.Wrap(err, "TLS handshake fail")
+		}
+
+		conn = tlsConn
+	}
+
+	cl := &client{
+		conn:      conn,
+		timeout:   timeout,
+		keepAlive: time.Duration(c.keepAlive) * time.Second,
+		onMessage: onMessage,
+		acks:      make(map[uint16]chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	r := bufio.NewReader(conn)
+
+	if err := cl.handshake(r, c); err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	go cl.read(r)
+	if cl.keepAlive > 0 {
+		go cl.ping()
+	}
+
+	return cl, nil
+}
+
+// handshake Sends CONNECT and waits for CONNACK.
+func (c *client) handshake(r *bufio.Reader, conn connect) error {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return errors.Wrap(err, "set deadline fail")
+	}
+	defer func() { _ = c.conn.SetDeadline(time.Time{}) }()
+
+	if err := writePacket(c.conn, conn.encode()); err != nil {
+		return errors.Wrap(err, "write CONNECT fail")
+	}
+
+	p, err := readPacket(r)
+	if err != nil {
+		return errors.Wrap(err, "read CONNACK fail")
+	}
+	if p.kind != packetConnAck || len(p.body) < 2 {
+		return errors.Wrapf(ErrMalformedPacket, "unexpected packet %d instead of CONNACK", p.kind)
+	}
+	if code := p.body[1]; code != 0 {
+		return errors.Wrapf(ErrConnectionRefused, "%s (%d)", connAckErrors[code], code)
+	}
+
+	c.received = time.Now()
+
+	return nil
+}
+
+// publish Sends the message, the message of QoS 1 is waited to be acknowledged.
+func (c *client) publish(ctx context.Context, m message) error {
+	var ack chan struct{}
+	if m.qos > 0 {
+		m.packetID, ack = c.register()
+		defer c.unregister(m.packetID)
+	}
+
+	if err := c.write(m.encode()); err != nil {
+		return errors.Wrap(err, "write PUBLISH fail")
+	}
+
+	return c.wait(ctx, ack)
+}
+
+// subscribe Subscribes to the topic filter and waits for SUBACK.
+func (c *client) subscribe(ctx context.Context, filter string, qos byte) error {
+	id, ack := c.register()
+	defer c.unregister(id)
+
+	if err := c.write(subscribePacket(id, filter, qos)); err != nil {
+		return errors.Wrap(err, "write SUBSCRIBE fail")
+	}
+
+	return c.wait(ctx, ack)
+}
+
+// close Sends DISCONNECT, so the broker doesn't publish the last will, and closes the connection.
+func (c *client) close() error {
+	err := c.write(packet{kind: packetDisconnect})
+	c.fail(ErrConnectionClosed)
+
+	return err
+}
+
+// closed Returns the channel closed when the connection is lost.
+func (c *client) closed() <-chan struct{} {
+	return c.done
+}
+
+func (c *client) write(p packet) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return errors.Wrap(err, "set write deadline fail")
+	}
+
+	if err := writePacket(c.conn, p); err != nil {
+		c.fail(err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (c *client) wait(ctx context.Context, ack chan struct{}) error {
+	if ack == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ack:
+		return nil
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		err := errors.New("acknowledgement timeout")
+		c.fail(err)
+
+		return err
+	}
+}
+
+func (c *client) register() (uint16, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+
+	ack := make(chan struct{})
+	c.acks[c.nextID] = ack
+
+	return c.nextID, ack
+}
+
+func (c *client) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.acks, id)
+}
+
+func (c *client) acknowledge(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ack, ok := c.acks[id]; ok {
+		close(ack)
+		delete(c.acks, id)
+	}
+}
+
+// read Reads packets until the connection is lost.
+func (c *client) read(r *bufio.Reader) {
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			c.fail(err)
+
+			return
+		}
+
+		c.mu.Lock()
+		c.received = time.Now()
+		c.mu.Unlock()
+
+		switch p.kind {
+		case packetPubAck, packetSubAck:
+			id, err := p.packetID()
+			if err != nil {
+				c.fail(err)
+
+				return
+			}
+
+			c.acknowledge(id)
+		case packetPublish:
+			m, err := decodeMessage(p)
+			if err != nil {
+				c.fail(err)
+
+				return
+			}
+
+			if m.qos > 0 {
+				if err := c.write(ackPacket(packetPubAck, m.packetID)); err != nil {
+					return
+				}
+			}
+
+			if c.onMessage != nil {
+				c.onMessage(m)
+			}
+		}
+	}
+}
+
+// ping Sends PINGREQ every keep alive interval, the connection is considered lost if nothing is received
+// for one and a half intervals.
+func (c *client) ping() {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			silence := now.Sub(c.received)
+			c.mu.Unlock()
+
+			if silence > c.keepAlive*3/2 {
+				c.fail(errors.New("keep alive timeout"))
+
+				return
+			}
+
+			if err := c.write(packet{kind: packetPingReq}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// fail Closes the connection because of the error, the first error is kept.
+func (c *client) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		_ = c.conn.Close()
+		close(c.done)
+	})
+}
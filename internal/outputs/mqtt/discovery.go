@@ -0,0 +1,156 @@
+package mqtt
+
+import (
+	"strings"
+
+	nut_client "github.com/andreyAKor/nut_client"
+)
+
+// sensorClass is the Home Assistant device class and the unit of the variable.
+type sensorClass struct {
+	deviceClass string
+	unit        string
+}
+
+// sensorClasses maps NUT variables to Home Assistant sensor device classes and units,
+// variables of the same suffix share the class, e.g. "input.voltage" and "output.voltage".
+var sensorClasses = map[string]sensorClass{
+	"battery.charge":         {"battery", "%"},
+	"battery.charge.low":     {"battery", "%"},
+	"battery.charge.warning": {"battery", "%"},
+	"battery.runtime":        {"duration", "s"},
+	"battery.runtime.low":    {"duration", "s"},
+	"ups.load":               {"", "%"},
+	"ups.power":              {"apparent_power", "VA"},
+	"ups.power.nominal":      {"apparent_power", "VA"},
+	"ups.realpower":          {"power", "W"},
+	"ups.realpower.nominal":  {"power", "W"},
+	"ups.delay.shutdown":     {"duration", "s"},
+	"ups.delay.start":        {"duration", "s"},
+	"ups.timer.shutdown":     {"duration", "s"},
+	"ups.timer.start":        {"duration", "s"},
+}
+
+// sensorSuffixes maps suffixes of NUT variables to Home Assistant device classes and units.
+var sensorSuffixes = []struct {
+	suffix string
+	class  sensorClass
+}{
+	{".voltage", sensorClass{"voltage", "V"}},
+	{".voltage.nominal", sensorClass{"voltage", "V"}},
+	{".current", sensorClass{"current", "A"}},
+	{".current.nominal", sensorClass{"current", "A"}},
+	{".frequency", sensorClass{"frequency", "Hz"}},
+	{".frequency.nominal", sensorClass{"frequency", "Hz"}},
+	{".temperature", sensorClass{"temperature", "°C"}},
+	{".realpower", sensorClass{"power", "W"}},
+	{".power", sensorClass{"apparent_power", "VA"}},
+}
+
+// device is the Home Assistant device of the UPS.
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// discovery is the Home Assistant MQTT discovery payload of the sensor, the binary sensor or the button.
+type discovery struct {
+	Name              string `json:"name"`
+	UniqueID          string `json:"unique_id"`
+	ObjectID          string `json:"object_id"`
+	StateTopic        string `json:"state_topic,omitempty"`
+	CommandTopic      string `json:"command_topic,omitempty"`
+	PayloadPress      string `json:"payload_press,omitempty"`
+	PayloadOn         string `json:"payload_on,omitempty"`
+	PayloadOff        string `json:"payload_off,omitempty"`
+	AvailabilityTopic string `json:"availability_topic"`
+	DeviceClass       string `json:"device_class,omitempty"`
+	StateClass        string `json:"state_class,omitempty"`
+	Unit              string `json:"unit_of_measurement,omitempty"`
+	EntityCategory    string `json:"entity_category,omitempty"`
+	Device            device `json:"device"`
+}
+
+// classify Returns the Home Assistant component and the discovery payload fields of the variable.
+func classify(v nut_client.Variable) (string, discovery) {
+	d := discovery{}
+
+	switch v.Value.(type) {
+	case bool:
+		d.PayloadOn = "enabled"
+		d.PayloadOff = "disabled"
+
+		return "binary_sensor", d
+	case int64, float64:
+		d.StateClass = "measurement"
+	default:
+		d.EntityCategory = "diagnostic"
+
+		if v.Name == "ups.status" {
+			d.EntityCategory = ""
+		}
+
+		return "sensor", d
+	}
+
+	if c, ok := sensorClasses[v.Name]; ok {
+		d.DeviceClass, d.Unit = c.deviceClass, c.unit
+
+		return "sensor", d
+	}
+
+	for _, s := range sensorSuffixes {
+		if strings.HasSuffix(v.Name, s.suffix) {
+			d.DeviceClass, d.Unit = s.class.deviceClass, s.class.unit
+
+			break
+		}
+	}
+
+	return "sensor", d
+}
+
+// deviceOf Returns the Home Assistant device of the UPS identified by id.
+func deviceOf(id string, ups *nut_client.UPS) device {
+	d := device{
+		Identifiers: []string{"nut_client_service_" + sanitize(id)},
+		Name:        ups.Name,
+	}
+
+	for _, v := range ups.Variables {
+		value, ok := v.Value.(string)
+		if !ok {
+			continue
+		}
+
+		switch v.Name {
+		case "device.mfr", "ups.mfr":
+			d.Manufacturer = value
+		case "device.model", "ups.model":
+			d.Model = value
+		case "ups.firmware":
+			d.SWVersion = value
+		}
+	}
+
+	if len(ups.Description) > 0 {
+		d.Name = ups.Description
+	}
+
+	return d
+}
+
+// sanitize Replaces characters which aren't allowed in discovery topics and object IDs.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+
+		return '_'
+	}, s)
+}
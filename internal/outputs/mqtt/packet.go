@@ -0,0 +1,255 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	packetConnect    byte = 1
+	packetConnAck    byte = 2
+	packetPublish    byte = 3
+	packetPubAck     byte = 4
+	packetSubscribe  byte = 8
+	packetSubAck     byte = 9
+	packetPingReq    byte = 12
+	packetPingResp   byte = 13
+	packetDisconnect byte = 14
+)
+
+const (
+	protocolLevel311 byte = 4
+
+	// maxRemainingBytes is the maximum size of the remaining length of the fixed header
+	maxRemainingBytes = 4
+)
+
+// Flags of the CONNECT packet.
+const (
+	connectCleanSession byte = 0x02
+	connectWill         byte = 0x04
+	connectWillRetain   byte = 0x20
+	connectPassword     byte = 0x40
+	connectUsername     byte = 0x80
+)
+
+var ErrMalformedPacket = errors.New("malformed MQTT packet")
+
+// packet is the control packet, flags are the lower 4 bits of the fixed header.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// message is the PUBLISH packet.
+type message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retain   bool
+	packetID uint16
+}
+
+// connect is the CONNECT packet.
+type connect struct {
+	clientID  string
+	username  string
+	password  string
+	keepAlive uint16
+
+	// Last will, it's published by the broker if the connection is lost
+	willTopic   string
+	willPayload []byte
+	willQoS     byte
+	willRetain  bool
+}
+
+func (c connect) encode() packet {
+	flags := connectCleanSession
+	if len(c.willTopic) > 0 {
+		flags |= connectWill | c.willQoS<<3
+		if c.willRetain {
+			flags |= connectWillRetain
+		}
+	}
+	if len(c.username) > 0 {
+		flags |= connectUsername
+	}
+	if len(c.password) > 0 {
+		flags |= connectPassword
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, protocolLevel311, flags)
+	body = appendUint16(body, c.keepAlive)
+	body = appendString(body, c.clientID)
+
+	if len(c.willTopic) > 0 {
+		body = appendString(body, c.willTopic)
+		body = appendBytes(body, c.willPayload)
+	}
+	if len(c.username) > 0 {
+		body = appendString(body, c.username)
+	}
+	if len(c.password) > 0 {
+		body = appendString(body, c.password)
+	}
+
+	return packet{kind: packetConnect, body: body}
+}
+
+func (m message) encode() packet {
+	var flags byte
+
+	flags |= m.qos << 1
+	if m.retain {
+		flags |= 0x01
+	}
+
+	body := appendString(nil, m.topic)
+	if m.qos > 0 {
+		body = appendUint16(body, m.packetID)
+	}
+	body = append(body, m.payload...)
+
+	return packet{kind: packetPublish, flags: flags, body: body}
+}
+
+func decodeMessage(p packet) (message, error) {
+	m := message{
+		qos:    (p.flags >> 1) & 0x03,
+		retain: p.flags&0x01 != 0,
+	}
+
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return m, err
+	}
+	m.topic = topic
+
+	if m.qos > 0 {
+		if len(rest) < 2 {
+			return m, ErrMalformedPacket
+		}
+
+		m.packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	m.payload = rest
+
+	return m, nil
+}
+
+func subscribePacket(packetID uint16, filter string, qos byte) packet {
+	body := appendUint16(nil, packetID)
+	body = appendString(body, filter)
+	body = append(body, qos)
+
+	return packet{kind: packetSubscribe, flags: 0x02, body: body}
+}
+
+func ackPacket(kind byte, packetID uint16) packet {
+	return packet{kind: kind, body: appendUint16(nil, packetID)}
+}
+
+// packetID Returns the packet identifier of PUBACK and SUBACK packets.
+func (p packet) packetID() (uint16, error) {
+	if len(p.body) < 2 {
+		return 0, ErrMalformedPacket
+	}
+
+	return binary.BigEndian.Uint16(p.body), nil
+}
+
+func writePacket(w io.Writer, p packet) error {
+	buf := make([]byte, 0, len(p.body)+1+maxRemainingBytes)
+	buf = append(buf, p.kind<<4|p.flags)
+
+	// remaining length is 7 bits per byte, the high bit continues the length
+	n := len(p.body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+
+	_, err := w.Write(append(buf, p.body...))
+
+	return err
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	var (
+		length     int
+		multiplier = 1
+	)
+
+	for i := 0; ; i++ {
+		if i == maxRemainingBytes {
+			return packet{}, ErrMalformedPacket
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+
+	return packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b, data []byte) []byte {
+	b = appendUint16(b, uint16(len(data)))
+
+	return append(b, data...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, ErrMalformedPacket
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, ErrMalformedPacket
+	}
+
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
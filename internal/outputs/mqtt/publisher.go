@@ -0,0 +1,554 @@
+// Package mqtt publishes UPS variables to the MQTT broker with Home Assistant discovery.
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/andreyAKor/nut_client_service/internal/audit"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// Payloads of the availability topic, "offline" is the last will.
+const (
+	payloadOnline  = "online"
+	payloadOffline = "offline"
+)
+
+// incomingBuffer is the number of queued command messages, newer messages are dropped when it's full.
+const incomingBuffer = 16
+
+var _ io.Closer = (*Publisher)(nil)
+
+// Publisher publishes variables of snapshots taken by the poller as retained messages
+// "<prefix>/<ups>/<variable>", only changed values are published. The UPS is named "ups@upstream"
+// if several upstreams are configured.
+//
+// Instant commands are received by "<prefix>/<ups>/command" topics, the payload is the command name,
+// only commands the UPS lists in the latest snapshot are sent.
+// Retained command messages are dropped, since they're redelivered on every subscription. Dangerous
+// commands are rejected, since MQTT has neither permissions nor the confirmation.
+type Publisher struct {
+	enabled bool
+
+	address   string
+	tlsConfig *tls.Config
+	connect   connect
+	qos       byte
+
+	timeout           time.Duration
+	reconnectInterval time.Duration
+
+	prefix string
+
+	// Home Assistant discovery is published under discoveryPrefix if it's enabled
+	discovery       bool
+	discoveryPrefix string
+
+	// Name patterns of commands allowed by command topics, commands are disabled if it's empty
+	commands []string
+
+	store     *snapshot.Store
+	upstreams *nut.Upstreams
+	audit     *audit.Log
+	guard     *guard.Guard
+
+	// latest snapshots by upstream, they're published in full after reconnection
+	latest    map[string]snapshot.Snapshot
+	published map[string]string
+	announced map[string]struct{}
+	incoming  chan message
+
+	// stop is closed by Close, stopped is closed when Run has disconnected
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func New(
+	enabled bool,
+	host string,
+	port int,
+	clientID, username, password string,
+	qos int,
+	keepAlive, timeout, reconnectInterval string,
+	topicPrefix string,
+	discoveryEnabled bool,
+	discoveryPrefix string,
+	commands []string,
+	tlsSettings TLS,
+	store *snapshot.Store,
+	upstreams *nut.Upstreams,
+	auditLog *audit.Log,
+	dangerGuard *guard.Guard,
+) (*Publisher, error) {
+	p := &Publisher{
+		enabled:         enabled,
+		address:         net.JoinHostPort(host, strconv.Itoa(port)),
+		prefix:          strings.TrimSuffix(topicPrefix, "/"),
+		discovery:       discoveryEnabled,
+		discoveryPrefix: strings.TrimSuffix(discoveryPrefix, "/"),
+		commands:        commands,
+		store:           store,
+		upstreams:       upstreams,
+		audit:           auditLog,
+		guard:           dangerGuard,
+		latest:          make(map[string]snapshot.Snapshot),
+		incoming:        make(chan message, incomingBuffer),
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+
+	if !enabled {
+		return p, nil
+	}
+
+	if qos < 0 || qos > 1 {
+		return nil, errors.Errorf("QoS %d isn't supported", qos)
+	}
+	p.qos = byte(qos)
+
+	for _, c := range commands {
+		if _, err := path.Match(c, ""); err != nil {
+			return nil, errors.Wrapf(err, "command pattern %q parsing fail", c)
+		}
+	}
+
+	keepAliveDur, err := time.ParseDuration(keepAlive)
+	if err != nil {
+		return nil, errors.Wrapf(err, "keep alive parsing fail (%s)", keepAlive)
+	}
+	if p.timeout, err = time.ParseDuration(timeout); err != nil {
+		return nil, errors.Wrapf(err, "timeout parsing fail (%s)", timeout)
+	}
+	if p.reconnectInterval, err = time.ParseDuration(reconnectInterval); err != nil {
+		return nil, errors.Wrapf(err, "reconnect interval parsing fail (%s)", reconnectInterval)
+	}
+
+	if p.tlsConfig, err = tlsSettings.config(host); err != nil {
+		return nil, errors.Wrap(err, "TLS configuration fail")
+	}
+
+	p.connect = connect{
+		clientID:    clientID,
+		username:    username,
+		password:    password,
+		keepAlive:   uint16(keepAliveDur / time.Second),
+		willTopic:   p.availabilityTopic(),
+		willPayload: []byte(payloadOffline),
+		willQoS:     p.qos,
+		willRetain:  true,
+	}
+
+	return p, nil
+}
+
+// Run Publishing snapshots and reconnecting to the broker until the context is done.
+func (p *Publisher) Run(ctx context.Context) error {
+	if !p.enabled {
+		return nil
+	}
+
+	defer close(p.stopped)
+
+	ctx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+
+	go func() {
+		select {
+		case <-p.stop:
+			cancelRun()
+		case <-ctx.Done():
+		}
+	}()
+
+	snapshots, cancel := p.store.Subscribe()
+	defer cancel()
+
+	for _, s := range p.store.List() {
+		p.latest[s.Upstream] = s
+	}
+
+	for {
+		c, err := dial(ctx, p.address, p.tlsConfig, p.connect, p.timeout, p.receive)
+		if err == nil {
+			log.Info().Str("broker", p.address).Msg("MQTT connected")
+
+			err = p.serve(ctx, c, snapshots)
+			if ctx.Err() != nil {
+				p.disconnect(c)
+
+				return nil
+			}
+		}
+
+		log.Error().Err(err).Str("broker", p.address).Msg("MQTT connection fail")
+
+		if !p.wait(ctx, snapshots) {
+			return nil
+		}
+	}
+}
+
+// Close Publishes "offline" and disconnects from the broker.
+func (p *Publisher) Close() error {
+	if !p.enabled {
+		return nil
+	}
+
+	p.stopOnce.Do(func() { close(p.stop) })
+
+	select {
+	case <-p.stopped:
+	case <-time.After(p.timeout):
+		return errors.New("MQTT disconnect timeout")
+	}
+
+	return nil
+}
+
+// serve Publishes the state after connection and then publishes snapshots and runs commands
+// until the connection is lost.
+func (p *Publisher) serve(ctx context.Context, c *client, snapshots <-chan snapshot.Snapshot) error {
+	p.published = make(map[string]string)
+	p.announced = make(map[string]struct{})
+
+	if err := p.publish(ctx, c, p.availabilityTopic(), payloadOnline, true); err != nil {
+		return errors.Wrap(err, "publish availability fail")
+	}
+
+	if len(p.commands) > 0 {
+		if err := c.subscribe(ctx, p.prefix+"/+/command", p.qos); err != nil {
+			return errors.Wrap(err, "subscribe to commands fail")
+		}
+	}
+
+	for _, s := range p.latest {
+		if err := p.publishSnapshot(ctx, c, s); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.closed():
+			return c.err
+		case s := <-snapshots:
+			p.latest[s.Upstream] = s
+
+			if err := p.publishSnapshot(ctx, c, s); err != nil {
+				return err
+			}
+		case m := <-p.incoming:
+			p.command(ctx, m)
+		}
+	}
+}
+
+// wait Waits for the reconnect interval keeping the latest snapshots, it returns false if the context is done.
+func (p *Publisher) wait(ctx context.Context, snapshots <-chan snapshot.Snapshot) bool {
+	timer := time.NewTimer(p.reconnectInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case s := <-snapshots:
+			p.latest[s.Upstream] = s
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// disconnect Publishes "offline" itself since the broker doesn't publish the last will on DISCONNECT.
+func (p *Publisher) disconnect(c *client) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	if err := p.publish(ctx, c, p.availabilityTopic(), payloadOffline, true); err != nil {
+		log.Error().Err(err).Msg("MQTT publish offline fail")
+	}
+	if err := c.close(); err != nil {
+		log.Error().Err(err).Msg("MQTT disconnect fail")
+	}
+}
+
+// publishSnapshot Publishes changed variables of UPSes of the snapshot and announces new ones to Home Assistant.
+func (p *Publisher) publishSnapshot(ctx context.Context, c *client, s snapshot.Snapshot) error {
+	for _, ups := range s.List {
+		id := p.upsID(s.Upstream, ups.Name)
+
+		if p.discovery {
+			if err := p.announce(ctx, c, id, ups); err != nil {
+				return errors.Wrapf(err, "announce UPS %q fail", id)
+			}
+		}
+
+		for _, v := range ups.Variables {
+			topic := p.prefix + "/" + id + "/" + v.Name
+			payload := formatValue(v.Value)
+
+			if published, ok := p.published[topic]; ok && published == payload {
+				continue
+			}
+
+			if err := p.publish(ctx, c, topic, payload, true); err != nil {
+				return errors.Wrapf(err, "publish %q fail", topic)
+			}
+
+			p.published[topic] = payload
+		}
+	}
+
+	return nil
+}
+
+// announce Publishes Home Assistant discovery payloads of variables and allowed commands of the UPS
+// which haven't been announced since connection.
+func (p *Publisher) announce(ctx context.Context, c *client, id string, ups *nut_client.UPS) error {
+	dev := deviceOf(id, ups)
+	node := sanitize(id)
+
+	for _, v := range ups.Variables {
+		component, d := classify(v)
+
+		object := sanitize(v.Name)
+		topic := p.discoveryPrefix + "/" + component + "/" + node + "/" + object + "/config"
+		if _, ok := p.announced[topic]; ok {
+			continue
+		}
+
+		d.Name = v.Name
+		d.UniqueID = "nut_client_service_" + node + "_" + object
+		d.ObjectID = node + "_" + object
+		d.StateTopic = p.prefix + "/" + id + "/" + v.Name
+		d.AvailabilityTopic = p.availabilityTopic()
+		d.Device = dev
+
+		if err := p.publishJSON(ctx, c, topic, d); err != nil {
+			return err
+		}
+
+		p.announced[topic] = struct{}{}
+	}
+
+	for _, cmd := range ups.Commands {
+		if !p.allowed(cmd.Name) || p.dangerous(cmd.Name) {
+			continue
+		}
+
+		object := sanitize(cmd.Name)
+		topic := p.discoveryPrefix + "/button/" + node + "/" + object + "/config"
+		if _, ok := p.announced[topic]; ok {
+			continue
+		}
+
+		d := discovery{
+			Name:              cmd.Name,
+			UniqueID:          "nut_client_service_" + node + "_" + object,
+			ObjectID:          node + "_" + object,
+			CommandTopic:      p.prefix + "/" + id + "/command",
+			PayloadPress:      cmd.Name,
+			AvailabilityTopic: p.availabilityTopic(),
+			EntityCategory:    "config",
+			Device:            dev,
+		}
+
+		if err := p.publishJSON(ctx, c, topic, d); err != nil {
+			return err
+		}
+
+		p.announced[topic] = struct{}{}
+	}
+
+	return nil
+}
+
+// receive Queues the message of the command topic, it's called by the reading goroutine of the client.
+func (p *Publisher) receive(m message) {
+	select {
+	case p.incoming <- m:
+	default:
+		log.Warn().Str("topic", m.topic).Msg("MQTT command dropped, the queue is full")
+	}
+}
+
+// command Sends the instant command received by the "<prefix>/<ups>/command" topic if it's allowed.
+func (p *Publisher) command(ctx context.Context, m message) {
+	if m.retain {
+		log.Warn().Str("topic", m.topic).Msg("retained MQTT command dropped")
+
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(m.topic, p.prefix+"/"), "/command")
+	command := strings.TrimSpace(string(m.payload))
+
+	name, upstream := id, ""
+	if i := strings.LastIndex(id, "@"); i >= 0 {
+		name, upstream = id[:i], id[i+1:]
+	}
+
+	rec := audit.Record{
+		User:     "mqtt",
+		Action:   "command",
+		Upstream: upstream,
+		UPS:      name,
+		Target:   command,
+	}
+
+	l := log.With().Str("topic", m.topic).Str("command", command).Logger()
+
+	if !nut.ValidName(name) || !nut.ValidName(command) {
+		l.Warn().Msg("MQTT command isn't the NUT name")
+
+		rec.Result = audit.ResultDenied
+		rec.Error = "the UPS or the command isn't the NUT name"
+		p.audit.Write(rec)
+
+		return
+	}
+	if !p.allowed(command) {
+		l.Warn().Msg("MQTT command isn't allowed")
+
+		rec.Result = audit.ResultDenied
+		p.audit.Write(rec)
+
+		return
+	}
+	if p.dangerous(command) {
+		l.Warn().Msg("dangerous MQTT command isn't allowed")
+
+		rec.Result = audit.ResultDenied
+		rec.Error = "dangerous command needs the confirmation by the HTTP API"
+		p.audit.Write(rec)
+
+		return
+	}
+
+	upstream, err := p.upstreams.Resolve(upstream)
+	if err == nil {
+		rec.Upstream = upstream
+
+		// only the UPS and the command listed by upsd are sent to it
+		if err = p.listed(upstream, name, command); err == nil {
+			var nutClient *nut.Client
+			if nutClient, err = p.upstreams.Get(upstream); err == nil {
+				err = nutClient.SendCommand(ctx, name, command)
+			}
+		}
+	}
+
+	if err != nil {
+		l.Error().Err(err).Msg("MQTT command fail")
+
+		rec.Result = audit.ResultFailed
+		rec.Error = err.Error()
+		p.audit.Write(rec)
+
+		return
+	}
+
+	rec.Result = audit.ResultDone
+	p.audit.Write(rec)
+}
+
+func (p *Publisher) publish(ctx context.Context, c *client, topic, payload string, retain bool) error {
+	return c.publish(ctx, message{
+		topic:   topic,
+		payload: []byte(payload),
+		qos:     p.qos,
+		retain:  retain,
+	})
+}
+
+func (p *Publisher) publishJSON(ctx context.Context, c *client, topic string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "json marshal fail")
+	}
+
+	return p.publish(ctx, c, topic, string(data), true)
+}
+
+// listed Checks that the UPS and its command are listed by the latest snapshot of the upstream.
+func (p *Publisher) listed(upstream, name, command string) error {
+	ups, ok := p.latest[upstream].UPS(name)
+	if !ok {
+		return errors.Wrapf(nut.ErrUnknownUPS, "UPS %q", name)
+	}
+
+	for _, c := range ups.Commands {
+		if c.Name == command {
+			return nil
+		}
+	}
+
+	return errors.Wrapf(nut.ErrUnknownCommand, "command %q", command)
+}
+
+func (p *Publisher) allowed(command string) bool {
+	for _, c := range p.commands {
+		if ok, _ := path.Match(c, command); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Publisher) dangerous(command string) bool {
+	return p.guard.Dangerous(guard.Action{Kind: guard.ActionCommand, Command: command})
+}
+
+func (p *Publisher) availabilityTopic() string {
+	return p.prefix + "/status"
+}
+
+// upsID Returns the name of the UPS in topics, it's qualified by the upstream if several upstreams are configured.
+func (p *Publisher) upsID(upstream, ups string) string {
+	if len(p.upstreams.Names()) > 1 {
+		return ups + "@" + upstream
+	}
+
+	return ups
+}
+
+// formatValue Formats the variable value the way upsd reports it.
+func formatValue(v interface{}) string {
+	switch value := v.(type) {
+	case bool:
+		if value {
+			return "enabled"
+		}
+
+		return "disabled"
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case string:
+		return value
+	}
+
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,336 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/audit"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/http/server/guard"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// fakeBroker is the minimal MQTT broker accepting a single connection.
+type fakeBroker struct {
+	listener net.Listener
+
+	mu         sync.Mutex
+	conn       net.Conn
+	connect    packet
+	messages   []message
+	subscribed []string
+	disconnect bool
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	b := &fakeBroker{listener: l}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		b.serve(conn)
+	}()
+
+	return b
+}
+
+func (b *fakeBroker) port() int {
+	return b.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+
+		var reply *packet
+
+		switch p.kind {
+		case packetConnect:
+			b.conn = conn
+			b.connect = p
+			reply = &packet{kind: packetConnAck, body: []byte{0, 0}}
+		case packetPublish:
+			m, err := decodeMessage(p)
+			if err != nil {
+				b.mu.Unlock()
+
+				return
+			}
+
+			b.messages = append(b.messages, m)
+			if m.qos > 0 {
+				ack := ackPacket(packetPubAck, m.packetID)
+				reply = &ack
+			}
+		case packetSubscribe:
+			id, _ := p.packetID()
+			filter, _, _ := readString(p.body[2:])
+			b.subscribed = append(b.subscribed, filter)
+			reply = &packet{kind: packetSubAck, body: append(appendUint16(nil, id), 1)}
+		case packetPingReq:
+			reply = &packet{kind: packetPingResp}
+		case packetDisconnect:
+			b.disconnect = true
+		}
+
+		b.mu.Unlock()
+
+		if reply != nil {
+			if err := writePacket(conn, *reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// send Publishes the message to the client.
+func (b *fakeBroker) send(t *testing.T, topic, payload string, retain bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	require.NoError(t, writePacket(b.conn, message{topic: topic, payload: []byte(payload), retain: retain}.encode()))
+}
+
+// payloads Returns payloads published to the topic.
+func (b *fakeBroker) payloads(topic string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var res []string
+
+	for _, m := range b.messages {
+		if m.topic == topic {
+			res = append(res, string(m.payload))
+		}
+	}
+
+	return res
+}
+
+func (b *fakeBroker) retained(topic string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, m := range b.messages {
+		if m.topic == topic {
+			return m.retain
+		}
+	}
+
+	return false
+}
+
+func TestPublisher(t *testing.T) {
+	b := newFakeBroker(t)
+
+	store := snapshot.New()
+	store.Set(snapshot.Snapshot{
+		Upstream: "default",
+		Time:     time.Now(),
+		List: []*nut_client.UPS{{
+			Name: "ups",
+			Variables: []nut_client.Variable{
+				{Name: "battery.charge", Value: int64(100)},
+				{Name: "input.voltage", Value: 229.5},
+				{Name: "ups.status", Value: "OL"},
+				{Name: "ups.beeper.status", Value: true},
+				{Name: "device.model", Value: "Back-UPS"},
+			},
+			Commands: []nut_client.Command{{Name: "beeper.enable"}, {Name: "beeper.disable"}, {Name: "load.off"}},
+		}},
+	})
+
+	auditLog, err := audit.New(filepath.Join(t.TempDir(), "audit.log"), 0, 0, false)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	dangerGuard, err := guard.New([]string{"beeper.disable"}, "30s", auditLog)
+	require.NoError(t, err)
+
+	// upsd of the upstream is down, so sent commands fail
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	nutClient, err := nut.New("127.0.0.1", l.Addr().(*net.TCPAddr).Port, "", "", 1, "1m", "1m", "1h", nut.TLS{})
+	require.NoError(t, err)
+
+	upstreams := nut.NewUpstreams()
+	require.NoError(t, upstreams.Add("default", nutClient))
+
+	p, err := New(
+		true, "127.0.0.1", b.port(), "client", "user", "password", 1, "30s", "2s", "100ms",
+		"nut", true, "homeassistant", []string{"beeper.*"}, TLS{},
+		store, upstreams, auditLog, dangerGuard,
+	)
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, p.Run(context.Background()))
+	}()
+
+	eventually := func(t *testing.T, condition func() bool) {
+		require.Eventually(t, condition, time.Second*2, time.Millisecond*10)
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		eventually(t, func() bool { return len(b.payloads("nut/status")) > 0 })
+
+		b.mu.Lock()
+		connect := b.connect
+		subscribed := b.subscribed
+		b.mu.Unlock()
+
+		require.True(t, bytes.Contains(connect.body, []byte("nut/status")))
+		require.True(t, bytes.Contains(connect.body, []byte(payloadOffline)))
+		require.Equal(t, []string{payloadOnline}, b.payloads("nut/status"))
+		require.Equal(t, []string{"nut/+/command"}, subscribed)
+	})
+
+	t.Run("variables", func(t *testing.T) {
+		eventually(t, func() bool { return len(b.payloads("nut/ups/device.model")) > 0 })
+
+		require.Equal(t, []string{"100"}, b.payloads("nut/ups/battery.charge"))
+		require.Equal(t, []string{"229.5"}, b.payloads("nut/ups/input.voltage"))
+		require.Equal(t, []string{"enabled"}, b.payloads("nut/ups/ups.beeper.status"))
+		require.True(t, b.retained("nut/ups/battery.charge"))
+	})
+
+	t.Run("discovery", func(t *testing.T) {
+		var d discovery
+
+		payloads := b.payloads("homeassistant/sensor/ups/battery_charge/config")
+		require.Len(t, payloads, 1)
+		require.NoError(t, json.Unmarshal([]byte(payloads[0]), &d))
+		require.Equal(t, "battery", d.DeviceClass)
+		require.Equal(t, "%", d.Unit)
+		require.Equal(t, "nut/ups/battery.charge", d.StateTopic)
+		require.Equal(t, "nut/status", d.AvailabilityTopic)
+		require.Equal(t, "Back-UPS", d.Device.Model)
+
+		payloads = b.payloads("homeassistant/sensor/ups/input_voltage/config")
+		require.Len(t, payloads, 1)
+		require.NoError(t, json.Unmarshal([]byte(payloads[0]), &d))
+		require.Equal(t, "voltage", d.DeviceClass)
+
+		require.Len(t, b.payloads("homeassistant/binary_sensor/ups/ups_beeper_status/config"), 1)
+		require.Len(t, b.payloads("homeassistant/button/ups/beeper_enable/config"), 1)
+		require.Empty(t, b.payloads("homeassistant/button/ups/load_off/config"))
+		require.Empty(t, b.payloads("homeassistant/button/ups/beeper_disable/config"))
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		store.Set(snapshot.Snapshot{
+			Upstream: "default",
+			Time:     time.Now(),
+			List: []*nut_client.UPS{{
+				Name: "ups",
+				Variables: []nut_client.Variable{
+					{Name: "battery.charge", Value: int64(99)},
+					{Name: "ups.status", Value: "OL"},
+				},
+				Commands: []nut_client.Command{{Name: "beeper.enable"}, {Name: "beeper.disable"}, {Name: "load.off"}},
+			}},
+		})
+
+		eventually(t, func() bool { return len(b.payloads("nut/ups/battery.charge")) == 2 })
+		require.Equal(t, []string{"OL"}, b.payloads("nut/ups/ups.status"))
+	})
+
+	t.Run("commands", func(t *testing.T) {
+		// the retained command is dropped, it'd be run again on every subscription
+		b.send(t, "nut/ups/command", "beeper.enable", true)
+		b.send(t, "nut/ups/command", "load.off", false)
+		b.send(t, "nut/ups/command", "beeper.disable", false)
+		b.send(t, "nut/ups/command", "beeper.enable", false)
+
+		// names which aren't listed by the UPS aren't sent to upsd
+		b.send(t, "nut/ups/command", "beeper.enable\nINSTCMD ups load.off", false)
+		b.send(t, "nut/ups/command", "beeper.toggle", false)
+		b.send(t, "nut/other/command", "beeper.enable", false)
+
+		eventually(t, func() bool {
+			records, err := auditLog.Query(audit.Filter{Action: "command"})
+			require.NoError(t, err)
+
+			return len(records) == 6
+		})
+
+		records, err := auditLog.Query(audit.Filter{UPS: "ups"})
+		require.NoError(t, err)
+		require.Len(t, records, 5)
+		require.Equal(t, "beeper.toggle", records[0].Target)
+		require.Equal(t, audit.ResultFailed, records[0].Result)
+		require.Contains(t, records[0].Error, nut.ErrUnknownCommand.Error())
+		require.Equal(t, "beeper.enable\nINSTCMD ups load.off", records[1].Target)
+		require.Equal(t, audit.ResultDenied, records[1].Result)
+		require.Equal(t, "beeper.enable", records[2].Target)
+		require.Equal(t, audit.ResultFailed, records[2].Result)
+		require.Equal(t, "beeper.disable", records[3].Target)
+		require.Equal(t, audit.ResultDenied, records[3].Result)
+		require.Equal(t, "load.off", records[4].Target)
+		require.Equal(t, audit.ResultDenied, records[4].Result)
+
+		records, err = auditLog.Query(audit.Filter{UPS: "other"})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Contains(t, records[0].Error, nut.ErrUnknownUPS.Error())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		require.NoError(t, p.Close())
+		require.Equal(t, []string{payloadOnline, payloadOffline}, b.payloads("nut/status"))
+
+		eventually(t, func() bool {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			return b.disconnect
+		})
+	})
+}
+
+func TestPacket(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 300)
+
+	var buf bytes.Buffer
+	require.NoError(t, writePacket(&buf, message{topic: "nut/ups/ups.id", payload: payload, qos: 1, retain: true, packetID: 7}.encode()))
+
+	p, err := readPacket(bufio.NewReader(&buf))
+	require.NoError(t, err)
+	require.Equal(t, packetPublish, p.kind)
+
+	m, err := decodeMessage(p)
+	require.NoError(t, err)
+	require.Equal(t, "nut/ups/ups.id", m.topic)
+	require.Equal(t, payload, m.payload)
+	require.Equal(t, byte(1), m.qos)
+	require.True(t, m.retain)
+	require.Equal(t, uint16(7), m.packetID)
+}
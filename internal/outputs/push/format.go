@@ -0,0 +1,57 @@
+package push
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// format encodes samples to lines of the protocol.
+type format interface {
+	encode(buf *bytes.Buffer, path string, value float64, t time.Time)
+
+	// transport is the default transport of the protocol
+	transport() string
+}
+
+// formats are supported protocols by name.
+var formats = map[string]format{
+	"graphite": graphite{},
+	"statsd":   statsd{},
+}
+
+// graphite is the Graphite plaintext protocol, e.g. "nut.default.ups.battery.charge 100 1620000000".
+type graphite struct{}
+
+func (graphite) encode(buf *bytes.Buffer, path string, value float64, t time.Time) {
+	buf.WriteString(path)
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(t.Unix(), 10))
+	buf.WriteByte('\n')
+}
+
+func (graphite) transport() string {
+	return "tcp"
+}
+
+// statsd is the StatsD protocol, values are sent as gauges, e.g. "nut.default.ups.battery.charge:100|g".
+type statsd struct{}
+
+func (statsd) encode(buf *bytes.Buffer, path string, value float64, _ time.Time) {
+	// a signed gauge is the delta, so the negative value is sent after resetting the gauge to zero
+	if value < 0 {
+		buf.WriteString(path)
+		buf.WriteString(":0|g\n")
+	}
+
+	buf.WriteString(path)
+	buf.WriteByte(':')
+	buf.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	buf.WriteString("|g\n")
+}
+
+func (statsd) transport() string {
+	return "udp"
+}
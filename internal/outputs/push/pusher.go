@@ -0,0 +1,306 @@
+// Package push pushes UPS variables to Graphite and StatsD.
+package push
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	metricsNut "github.com/andreyAKor/nut_client_service/internal/metrics/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// DefaultTemplate is the metric path template used if the target doesn't set it.
+const DefaultTemplate = "nut.{upstream}.{ups}.{variable}"
+
+// maxPacketSize is the maximum size of the UDP datagram which isn't fragmented on common networks.
+const maxPacketSize = 1432
+
+var _ io.Closer = (*Pusher)(nil)
+
+// Target is the push output.
+type Target struct {
+	Name string
+
+	// "graphite" or "statsd"
+	Protocol string
+
+	// "tcp" or "udp", it's "tcp" for Graphite and "udp" for StatsD if it's empty
+	Transport string
+
+	// e.g. "127.0.0.1:2003"
+	Address string
+
+	// Interval of pushing, e.g. "10s"
+	Interval string
+
+	// Metric path with {upstream}, {ups} and {variable} placeholders, DefaultTemplate if it's empty
+	Template string
+}
+
+type target struct {
+	Target
+	format   format
+	interval time.Duration
+
+	conn net.Conn
+
+	// times of pushed snapshots by upstream, the snapshot isn't pushed twice
+	pushed map[string]time.Time
+}
+
+// Pusher pushes numeric and boolean variables and status flags of the latest snapshots to every target
+// on its interval, they're the same values exported as Prometheus metrics. Flags are pushed as "status.<flag>"
+// variables.
+//
+// Connections are kept open and reconnected on the next push after failures.
+type Pusher struct {
+	targets []*target
+	timeout time.Duration
+	store   *snapshot.Store
+
+	// stop is closed by Close, wg is done when targets are stopped
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func New(targets []Target, timeout string, store *snapshot.Store) (*Pusher, error) {
+	p := &Pusher{
+		store: store,
+		stop:  make(chan struct{}),
+	}
+
+	if len(targets) == 0 {
+		return p, nil
+	}
+
+	var err error
+
+	if p.timeout, err = time.ParseDuration(timeout); err != nil {
+		return nil, errors.Wrapf(err, "timeout parsing fail (%s)", timeout)
+	}
+
+	for _, t := range targets {
+		f, ok := formats[t.Protocol]
+		if !ok {
+			return nil, errors.Errorf("protocol %q of target %q isn't supported", t.Protocol, t.Name)
+		}
+
+		if len(t.Transport) == 0 {
+			t.Transport = f.transport()
+		}
+		if t.Transport != "tcp" && t.Transport != "udp" {
+			return nil, errors.Errorf("transport %q of target %q isn't supported", t.Transport, t.Name)
+		}
+
+		if len(t.Template) == 0 {
+			t.Template = DefaultTemplate
+		}
+		if !strings.Contains(t.Template, "{variable}") {
+			return nil, errors.Errorf("template of target %q has no {variable} placeholder", t.Name)
+		}
+
+		interval, err := time.ParseDuration(t.Interval)
+		if err != nil {
+			return nil, errors.Wrapf(err, "interval of target %q parsing fail (%s)", t.Name, t.Interval)
+		}
+		if interval <= 0 {
+			return nil, errors.Errorf("interval of target %q must be positive (%s)", t.Name, t.Interval)
+		}
+
+		p.targets = append(p.targets, &target{
+			Target:   t,
+			format:   f,
+			interval: interval,
+			pushed:   make(map[string]time.Time),
+		})
+	}
+
+	return p, nil
+}
+
+// Run Pushing to every target on its interval until the context is done.
+func (p *Pusher) Run(ctx context.Context) error {
+	for _, t := range p.targets {
+		p.wg.Add(1)
+
+		go func(t *target) {
+			defer p.wg.Done()
+
+			p.run(ctx, t)
+		}(t)
+	}
+
+	return nil
+}
+
+// Close Stops pushing and closes connections.
+func (p *Pusher) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.wg.Wait()
+
+	return nil
+}
+
+func (p *Pusher) run(ctx context.Context, t *target) {
+	defer t.close()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.push(t); err != nil {
+				log.Error().Err(err).Str("target", t.Name).Str("address", t.Address).Msg("push fail")
+			}
+		}
+	}
+}
+
+// push Sends snapshots which haven't been pushed yet, they're pushed again next time if sending fails.
+func (p *Pusher) push(t *target) error {
+	var (
+		buf       bytes.Buffer
+		snapshots []snapshot.Snapshot
+	)
+
+	for _, s := range p.store.List() {
+		if !s.Time.After(t.pushed[s.Upstream]) {
+			continue
+		}
+
+		t.encode(&buf, s)
+		snapshots = append(snapshots, s)
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	if err := t.send(buf.Bytes(), p.timeout); err != nil {
+		t.close()
+
+		return err
+	}
+
+	for _, s := range snapshots {
+		t.pushed[s.Upstream] = s.Time
+	}
+
+	return nil
+}
+
+// encode Encodes samples of UPSes of the snapshot.
+func (t *target) encode(buf *bytes.Buffer, s snapshot.Snapshot) {
+	for _, ups := range s.List {
+		write := func(variable string, value float64) {
+			// neither Graphite nor StatsD accept NaN and infinite values
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return
+			}
+
+			t.format.encode(buf, t.path(s.Upstream, ups.Name, variable), value, s.Time)
+		}
+
+		for _, sample := range metricsNut.Samples(ups) {
+			write(sample.Variable, sample.Value)
+		}
+		for _, flag := range metricsNut.StatusFlags(ups) {
+			write("status."+flag.Variable, flag.Value)
+		}
+	}
+}
+
+// path Returns the metric path by the template, dots of the upstream and UPS names are replaced,
+// so each of them is the single node of the path.
+func (t *target) path(upstream, ups, variable string) string {
+	return strings.NewReplacer(
+		"{upstream}", sanitize(upstream, false),
+		"{ups}", sanitize(ups, false),
+		"{variable}", sanitize(variable, true),
+	).Replace(t.Template)
+}
+
+// send Writes data connecting to the target if it isn't connected, UDP data is split by lines
+// into datagrams of up to maxPacketSize bytes.
+func (t *target) send(data []byte, timeout time.Duration) error {
+	if t.conn == nil {
+		conn, err := net.DialTimeout(t.Transport, t.Address, timeout)
+		if err != nil {
+			return errors.Wrap(err, "dial fail")
+		}
+
+		t.conn = conn
+	}
+
+	if err := t.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return errors.Wrap(err, "set deadline fail")
+	}
+
+	if t.Transport == "tcp" {
+		if _, err := t.conn.Write(data); err != nil {
+			return errors.Wrap(err, "write fail")
+		}
+
+		return nil
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxPacketSize {
+			// a single line longer than the packet is sent as is
+			if n = bytes.LastIndexByte(data[:maxPacketSize], '\n') + 1; n == 0 {
+				n = bytes.IndexByte(data, '\n') + 1
+			}
+		}
+
+		if _, err := t.conn.Write(data[:n]); err != nil {
+			return errors.Wrap(err, "write fail")
+		}
+
+		data = data[n:]
+	}
+
+	return nil
+}
+
+func (t *target) close() {
+	if t.conn == nil {
+		return
+	}
+
+	if err := t.conn.Close(); err != nil {
+		log.Debug().Err(err).Str("target", t.Name).Msg("push connection closing fail")
+	}
+
+	t.conn = nil
+}
+
+// sanitize Replaces characters which are special in Graphite or StatsD paths by underscores,
+// dots are kept if they separate nodes.
+func sanitize(s string, dots bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r == '.' && dots:
+			return r
+		}
+
+		return '_'
+	}, s)
+}
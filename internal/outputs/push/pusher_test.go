@@ -0,0 +1,186 @@
+package push
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+func testStore(t time.Time) *snapshot.Store {
+	store := snapshot.New()
+	store.Set(snapshot.Snapshot{
+		Upstream: "main",
+		Time:     t,
+		List: []*nut_client.UPS{{
+			Name: "rack.1",
+			Variables: []nut_client.Variable{
+				{Name: "battery.charge", Value: int64(100), Type: "INTEGER"},
+				{Name: "ambient.temperature", Value: -2.5, Type: "FLOAT_64"},
+				{Name: "ups.beeper.status", Value: false, Type: "BOOLEAN"},
+				{Name: "ups.status", Value: "OL CHRG", Type: "STRING"},
+				{Name: "ups.model", Value: "Smart-UPS", Type: "STRING"},
+			},
+		}},
+	})
+
+	return store
+}
+
+func TestFormat(t *testing.T) {
+	ts := time.Unix(1620000000, 0)
+
+	t.Run("graphite", func(t *testing.T) {
+		var buf bytes.Buffer
+		graphite{}.encode(&buf, "nut.a.b.input.voltage", 229.5, ts)
+
+		require.Equal(t, "nut.a.b.input.voltage 229.5 1620000000\n", buf.String())
+	})
+	t.Run("statsd", func(t *testing.T) {
+		var buf bytes.Buffer
+		statsd{}.encode(&buf, "nut.a.b.battery.charge", 100, ts)
+		statsd{}.encode(&buf, "nut.a.b.ambient.temperature", -2.5, ts)
+
+		require.Equal(t, "nut.a.b.battery.charge:100|g\nnut.a.b.ambient.temperature:0|g\nnut.a.b.ambient.temperature:-2.5|g\n", buf.String())
+	})
+}
+
+func TestPusher(t *testing.T) {
+	ts := time.Unix(1620000000, 0)
+
+	t.Run("graphite over tcp", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+
+		lines := make(chan string, 64)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			s := bufio.NewScanner(conn)
+			for s.Scan() {
+				lines <- s.Text()
+			}
+		}()
+
+		store := testStore(ts)
+
+		p, err := New([]Target{{
+			Name:     "graphite",
+			Protocol: "graphite",
+			Address:  l.Addr().String(),
+			Interval: "1s",
+			Template: "ups.{upstream}.{ups}.{variable}",
+		}}, "1s", store)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = p.Close() })
+
+		require.NoError(t, p.push(p.targets[0]))
+
+		var got []string
+	receive:
+		for {
+			select {
+			case line := <-lines:
+				got = append(got, line)
+			case <-time.After(200 * time.Millisecond):
+				break receive
+			}
+		}
+
+		require.Contains(t, got, "ups.main.rack_1.battery.charge 100 1620000000")
+		require.Contains(t, got, "ups.main.rack_1.ambient.temperature -2.5 1620000000")
+		require.Contains(t, got, "ups.main.rack_1.ups.beeper.status 0 1620000000")
+		require.Contains(t, got, "ups.main.rack_1.ups.status 3 1620000000")
+		require.Contains(t, got, "ups.main.rack_1.status.OL 1 1620000000")
+		require.Contains(t, got, "ups.main.rack_1.status.OB 0 1620000000")
+		require.Contains(t, got, "ups.main.rack_1.status.CHRG 1 1620000000")
+
+		for _, line := range got {
+			require.NotContains(t, line, "ups.model")
+		}
+
+		// the same snapshot isn't pushed twice
+		require.NoError(t, p.push(p.targets[0]))
+		select {
+		case line := <-lines:
+			t.Fatalf("unexpected line %q", line)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+	t.Run("statsd over udp", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		p, err := New([]Target{{
+			Name:     "statsd",
+			Protocol: "statsd",
+			Address:  conn.LocalAddr().String(),
+			Interval: "1s",
+		}}, "1s", testStore(ts))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = p.Close() })
+		require.Equal(t, "udp", p.targets[0].Transport)
+
+		require.NoError(t, p.push(p.targets[0]))
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		buf := make([]byte, 65536)
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+
+		data := string(buf[:n])
+		require.True(t, strings.HasSuffix(data, "\n"))
+		require.Contains(t, data, "nut.main.rack_1.battery.charge:100|g\n")
+		require.Contains(t, data, "nut.main.rack_1.ambient.temperature:0|g\nnut.main.rack_1.ambient.temperature:-2.5|g\n")
+	})
+	t.Run("udp datagrams", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		tg := &target{Target: Target{Transport: "udp", Address: conn.LocalAddr().String()}}
+		t.Cleanup(tg.close)
+
+		line := strings.Repeat("x", 99) + "\n"
+		require.NoError(t, tg.send([]byte(strings.Repeat(line, 30)), time.Second))
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		buf := make([]byte, 65536)
+
+		var total int
+		for total < 30*len(line) {
+			n, _, err := conn.ReadFrom(buf)
+			require.NoError(t, err)
+			require.LessOrEqual(t, n, maxPacketSize)
+			require.Zero(t, n%len(line))
+
+			total += n
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, target := range []Target{
+			{Name: "a", Protocol: "collectd", Address: "127.0.0.1:25826", Interval: "1s"},
+			{Name: "b", Protocol: "graphite", Transport: "sctp", Address: "127.0.0.1:2003", Interval: "1s"},
+			{Name: "c", Protocol: "graphite", Address: "127.0.0.1:2003", Interval: "1s", Template: "nut.{ups}"},
+			{Name: "d", Protocol: "statsd", Address: "127.0.0.1:8125", Interval: "0s"},
+		} {
+			_, err := New([]Target{target}, "1s", snapshot.New())
+			require.Error(t, err, target.Name)
+		}
+	})
+}
@@ -0,0 +1,366 @@
+// Package shutdown shuts the local host down on power events like upsmon does.
+package shutdown
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/andreyAKor/nut_client_service/internal/events"
+	"github.com/andreyAKor/nut_client_service/internal/http/clients/nut"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+// checkInterval is the interval of checking how long UPSes are on battery.
+const checkInterval = time.Second
+
+var _ events.Sink = (*Orchestrator)(nil)
+
+// Command is the shutdown hook.
+type Command struct {
+	// Program and its arguments, e.g. ["systemctl", "stop", "app"]
+	Command []string
+
+	// The command is killed after this timeout, e.g. "30s"
+	Timeout string
+}
+
+// Stage is the named group of commands, stages are run one after another.
+type Stage struct {
+	Name     string
+	Commands []Command
+}
+
+type command struct {
+	args    []string
+	timeout time.Duration
+}
+
+type stage struct {
+	name     string
+	commands []command
+}
+
+// trigger is the reason of the shutdown and the UPS which caused it.
+type trigger struct {
+	upstream, ups string
+	reason        string
+}
+
+// Orchestrator runs shutdown stages once one of monitored UPSes is on battery for too long,
+// its battery is low, it's forced to shut down or its runtime falls below the minimum.
+// The shutdown is triggered once until all UPSes are back on line power.
+type Orchestrator struct {
+	enabled bool
+
+	// Steps are only logged in the dry-run mode
+	dryRun bool
+
+	// Monitored UPSes as "ups@upstream" or "ups", all UPSes are monitored if it's empty
+	ups []string
+
+	// Triggers, zero values disable them
+	onBatteryFor time.Duration
+	minRuntime   float64
+	onLowBattery bool
+	onFSD        bool
+
+	// FSD is set on the UPS before stages are run, so other clients of upsd shut down too
+	forceShutdown bool
+
+	stages []stage
+
+	store     *snapshot.Store
+	upstreams *nut.Upstreams
+
+	mu        sync.Mutex
+	onBattery map[string]time.Time
+	triggered bool
+	triggers  chan trigger
+}
+
+func New(
+	enabled, dryRun bool,
+	ups []string,
+	onBatteryFor string,
+	minRuntime float64,
+	onLowBattery, onFSD, forceShutdown bool,
+	stages []Stage,
+	store *snapshot.Store,
+	upstreams *nut.Upstreams,
+) (*Orchestrator, error) {
+	o := &Orchestrator{
+		enabled:       enabled,
+		dryRun:        dryRun,
+		ups:           ups,
+		minRuntime:    minRuntime,
+		onLowBattery:  onLowBattery,
+		onFSD:         onFSD,
+		forceShutdown: forceShutdown,
+		store:         store,
+		upstreams:     upstreams,
+		onBattery:     make(map[string]time.Time),
+		triggers:      make(chan trigger, 1),
+	}
+
+	if len(onBatteryFor) > 0 {
+		var err error
+
+		if o.onBatteryFor, err = time.ParseDuration(onBatteryFor); err != nil {
+			return nil, errors.Wrapf(err, "on battery for parsing fail (%s)", onBatteryFor)
+		}
+	}
+
+	for _, s := range stages {
+		st := stage{name: s.Name}
+
+		for _, c := range s.Commands {
+			if len(c.Command) == 0 {
+				return nil, errors.Errorf("empty command of stage %q", s.Name)
+			}
+
+			timeout, err := time.ParseDuration(c.Timeout)
+			if err != nil {
+				return nil, errors.Wrapf(err, "timeout of command %q parsing fail (%s)", strings.Join(c.Command, " "), c.Timeout)
+			}
+
+			st.commands = append(st.commands, command{args: c.Command, timeout: timeout})
+		}
+
+		o.stages = append(o.stages, st)
+	}
+
+	return o, nil
+}
+
+// Notify Tracks ONBATT and ONLINE events and triggers the shutdown on FSD events and when the battery
+// of the UPS on battery is low, like upsmon does on OB LB. The low battery of the UPS on line power is only
+// charging, so the shutdown is triggered by ONBATT if the battery is still low, since LOWBATT isn't sent again.
+func (o *Orchestrator) Notify(ctx context.Context, e events.Event) error {
+	if !o.enabled || !o.monitored(e.Upstream, e.UPS) {
+		return nil
+	}
+
+	key := e.UPS + "@" + e.Upstream
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch e.Type {
+	case events.TypeOnBatt:
+		o.onBattery[key] = e.Time
+
+		if o.onLowBattery && e.LowBattery {
+			o.fire(trigger{e.Upstream, e.UPS, "battery is low"})
+		}
+	case events.TypeOnline:
+		delete(o.onBattery, key)
+
+		// the next outage triggers the shutdown again, e.g. in the dry-run mode or if the shutdown was aborted
+		if o.triggered && len(o.onBattery) == 0 {
+			o.triggered = false
+
+			log.Info().Bool("dryRun", o.dryRun).Msg("UPSes are on line power, the shutdown can be triggered again")
+		}
+	case events.TypeLowBatt:
+		if o.onLowBattery && isOnBattery(e.Status) {
+			o.fire(trigger{e.Upstream, e.UPS, "battery is low"})
+		}
+	case events.TypeFSD:
+		if o.onFSD {
+			o.fire(trigger{e.Upstream, e.UPS, "forced shutdown is set"})
+		}
+	}
+
+	return nil
+}
+
+// Run Checking triggers and running the shutdown once until the context is done.
+func (o *Orchestrator) Run(ctx context.Context) error {
+	if !o.enabled {
+		return nil
+	}
+
+	snapshots, cancel := o.store.Subscribe()
+	defer cancel()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case s := <-snapshots:
+			o.checkRuntime(s)
+		case now := <-ticker.C:
+			o.checkOnBattery(now)
+		case t := <-o.triggers:
+			o.shutdown(ctx, t)
+		}
+	}
+}
+
+// checkOnBattery Triggers the shutdown if a UPS is on battery for longer than onBatteryFor.
+func (o *Orchestrator) checkOnBattery(now time.Time) {
+	if o.onBatteryFor <= 0 {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for key, since := range o.onBattery {
+		if now.Sub(since) >= o.onBatteryFor {
+			i := strings.LastIndex(key, "@")
+			o.fire(trigger{key[i+1:], key[:i], "on battery for " + now.Sub(since).Round(time.Second).String()})
+		}
+	}
+}
+
+// checkRuntime Triggers the shutdown if the runtime of a UPS on battery falls below minRuntime.
+func (o *Orchestrator) checkRuntime(s snapshot.Snapshot) {
+	if o.minRuntime <= 0 {
+		return
+	}
+
+	for _, ups := range s.List {
+		if !o.monitored(s.Upstream, ups.Name) {
+			continue
+		}
+
+		var (
+			onBattery bool
+			runtime   float64
+			ok        bool
+		)
+
+		for _, v := range ups.Variables {
+			switch value := v.Value.(type) {
+			case string:
+				if v.Name == "ups.status" {
+					onBattery = isOnBattery(value)
+				}
+			case int64:
+				if v.Name == "battery.runtime" {
+					runtime, ok = float64(value), true
+				}
+			case float64:
+				if v.Name == "battery.runtime" {
+					runtime, ok = value, true
+				}
+			}
+		}
+
+		if onBattery && ok && runtime < o.minRuntime {
+			o.mu.Lock()
+			o.fire(trigger{s.Upstream, ups.Name, "battery runtime is " + time.Duration(runtime*float64(time.Second)).String()})
+			o.mu.Unlock()
+		}
+	}
+}
+
+// fire Queues the shutdown if it hasn't been triggered since all UPSes were on line power, o.mu must be held.
+func (o *Orchestrator) fire(t trigger) {
+	if o.triggered {
+		return
+	}
+
+	o.triggered = true
+	o.triggers <- t
+}
+
+// shutdown Sets FSD on the UPS if it's configured and runs stages one after another,
+// failed commands are logged and don't stop the shutdown.
+func (o *Orchestrator) shutdown(ctx context.Context, t trigger) {
+	log.Warn().
+		Str("upstream", t.upstream).
+		Str("ups", t.ups).
+		Str("reason", t.reason).
+		Bool("dryRun", o.dryRun).
+		Msg("shutdown is triggered")
+
+	if o.forceShutdown {
+		if err := o.setFSD(ctx, t); err != nil {
+			log.Error().Err(err).Msg("set FSD fail")
+		}
+	}
+
+	for _, s := range o.stages {
+		log.Warn().Str("stage", s.name).Bool("dryRun", o.dryRun).Msg("shutdown stage is started")
+
+		for _, c := range s.commands {
+			if err := o.run(ctx, c); err != nil {
+				log.Error().Err(err).Str("stage", s.name).Strs("command", c.args).Msg("shutdown command fail")
+			}
+		}
+	}
+
+	log.Warn().Bool("dryRun", o.dryRun).Msg("shutdown stages are finished")
+}
+
+func (o *Orchestrator) setFSD(ctx context.Context, t trigger) error {
+	if o.dryRun {
+		log.Warn().Str("upstream", t.upstream).Str("ups", t.ups).Msg("dry run: FSD would be set")
+
+		return nil
+	}
+
+	nutClient, err := o.upstreams.Get(t.upstream)
+	if err != nil {
+		return errors.Wrap(err, "get upstream fail")
+	}
+
+	if err := nutClient.ForceShutdown(ctx, t.ups); err != nil {
+		return errors.Wrap(err, "force shutdown fail")
+	}
+
+	log.Warn().Str("upstream", t.upstream).Str("ups", t.ups).Msg("FSD is set")
+
+	return nil
+}
+
+func (o *Orchestrator) run(ctx context.Context, c command) error {
+	if o.dryRun {
+		log.Warn().Strs("command", c.args).Dur("timeout", c.timeout).Msg("dry run: command would be run")
+
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	//nolint:gosec
+	out, err := exec.CommandContext(ctx, c.args[0], c.args[1:]...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "run fail (%s)", strings.TrimSpace(string(out)))
+	}
+
+	log.Info().Strs("command", c.args).Str("output", strings.TrimSpace(string(out))).Msg("shutdown command is done")
+
+	return nil
+}
+
+func (o *Orchestrator) monitored(upstream, ups string) bool {
+	if len(o.ups) == 0 {
+		return true
+	}
+
+	for _, name := range o.ups {
+		if name == ups || name == ups+"@"+upstream {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isOnBattery Checks the OB flag of ups.status.
+func isOnBattery(status string) bool {
+	return strings.Contains(" "+status+" ", " OB ")
+}
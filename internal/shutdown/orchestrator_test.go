@@ -0,0 +1,182 @@
+package shutdown
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andreyAKor/nut_client_service/internal/events"
+	"github.com/andreyAKor/nut_client_service/internal/snapshot"
+)
+
+func newOrchestrator(t *testing.T, dryRun bool, file string) *Orchestrator {
+	o, err := New(true, dryRun, []string{"ups@default"}, "1m", 120, true, true, false, []Stage{
+		{Name: "first", Commands: []Command{{Command: []string{"sh", "-c", "echo first >> " + file}, Timeout: "1s"}}},
+		{Name: "second", Commands: []Command{{Command: []string{"sh", "-c", "echo second >> " + file}, Timeout: "1s"}}},
+	}, snapshot.New(), nil)
+	require.NoError(t, err)
+
+	return o
+}
+
+// sinkFunc delivers events to the function.
+type sinkFunc func(e events.Event)
+
+func (f sinkFunc) Notify(ctx context.Context, e events.Event) error {
+	f(e)
+
+	return nil
+}
+
+func TestOrchestrator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("low battery", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "out")
+		o := newOrchestrator(t, false, file)
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeLowBatt, Upstream: "default", UPS: "ups", Status: "OB LB"}))
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeFSD, Upstream: "default", UPS: "ups"}))
+		require.Len(t, o.triggers, 1)
+
+		o.shutdown(ctx, <-o.triggers)
+
+		out, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		require.Equal(t, "first\nsecond\n", string(out))
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "out")
+		o := newOrchestrator(t, true, file)
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnBatt, Upstream: "default", UPS: "ups", Status: "OB"}))
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeLowBatt, Upstream: "default", UPS: "ups", Status: "OB LB"}))
+		o.shutdown(ctx, <-o.triggers)
+
+		require.NoFileExists(t, file)
+
+		// the shutdown is triggered once per outage
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeFSD, Upstream: "default", UPS: "ups", Status: "OB LB FSD"}))
+		require.Len(t, o.triggers, 0)
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnline, Upstream: "default", UPS: "ups", Status: "OL"}))
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnBatt, Upstream: "default", UPS: "ups", Status: "OB"}))
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeLowBatt, Upstream: "default", UPS: "ups", Status: "OB LB"}))
+		require.Len(t, o.triggers, 1)
+	})
+
+	t.Run("low battery on line power", func(t *testing.T) {
+		o := newOrchestrator(t, true, "")
+
+		// the engine raises LOWBATT by battery.charge of the charging UPS too
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeLowBatt, Upstream: "default", UPS: "ups", Status: "OL LB"}))
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeLowBatt, Upstream: "default", UPS: "ups", Status: "OL CHRG"}))
+		require.Len(t, o.triggers, 0)
+
+		// events derived from the snapshot are delivered to the orchestrator before the next sink
+		delivered := make(chan events.Event, 16)
+		engine, err := events.New(o.store, []events.Sink{o, sinkFunc(func(e events.Event) { delivered <- e })}, "0s", "15s", "1m", 20, 5, 10)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go func() { _ = engine.Run(ctx) }()
+
+		status := "OL LB"
+
+		// the snapshot is set again until the engine raises the event
+		await := func(eventType string) {
+			require.Eventually(t, func() bool {
+				o.store.Set(snapshot.Snapshot{Upstream: "default", Time: time.Now(), List: []*nut_client.UPS{{
+					Name: "ups",
+					Variables: []nut_client.Variable{
+						{Name: "ups.status", Value: status},
+						{Name: "battery.charge", Value: int64(5)},
+					},
+				}}})
+
+				for {
+					select {
+					case e := <-delivered:
+						if e.Type == eventType {
+							return true
+						}
+					case <-time.After(10 * time.Millisecond):
+						return false
+					}
+				}
+			}, 5*time.Second, 10*time.Millisecond)
+		}
+
+		await(events.TypeLowBatt)
+		require.Len(t, o.triggers, 0)
+
+		// the battery is still low when the UPS goes on battery, LOWBATT isn't raised again
+		status = "OB"
+
+		await(events.TypeOnBatt)
+		require.Len(t, o.triggers, 1)
+	})
+
+	t.Run("on battery with low battery", func(t *testing.T) {
+		o := newOrchestrator(t, true, "")
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnBatt, Upstream: "default", UPS: "ups", Status: "OB"}))
+		require.Len(t, o.triggers, 0)
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnline, Upstream: "default", UPS: "ups", Status: "OL"}))
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnBatt, Upstream: "default", UPS: "ups", Status: "OB", LowBattery: true}))
+		require.Len(t, o.triggers, 1)
+	})
+
+	t.Run("not monitored", func(t *testing.T) {
+		o := newOrchestrator(t, true, "")
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeLowBatt, Upstream: "other", UPS: "ups"}))
+		require.Len(t, o.triggers, 0)
+	})
+
+	t.Run("on battery for too long", func(t *testing.T) {
+		o := newOrchestrator(t, true, "")
+		now := time.Now()
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnBatt, Upstream: "default", UPS: "ups", Time: now}))
+		o.checkOnBattery(now.Add(time.Second * 30))
+		require.Len(t, o.triggers, 0)
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnline, Upstream: "default", UPS: "ups"}))
+		o.checkOnBattery(now.Add(time.Minute))
+		require.Len(t, o.triggers, 0)
+
+		require.NoError(t, o.Notify(ctx, events.Event{Type: events.TypeOnBatt, Upstream: "default", UPS: "ups", Time: now}))
+		o.checkOnBattery(now.Add(time.Minute))
+		require.Len(t, o.triggers, 1)
+	})
+
+	t.Run("runtime", func(t *testing.T) {
+		o := newOrchestrator(t, true, "")
+		s := func(status string, runtime int64) snapshot.Snapshot {
+			return snapshot.Snapshot{Upstream: "default", List: []*nut_client.UPS{{
+				Name: "ups",
+				Variables: []nut_client.Variable{
+					{Name: "ups.status", Value: status},
+					{Name: "battery.runtime", Value: runtime},
+				},
+			}}}
+		}
+
+		o.checkRuntime(s("OL CHRG", 60))
+		o.checkRuntime(s("OB DISCHRG", 600))
+		require.Len(t, o.triggers, 0)
+
+		o.checkRuntime(s("OB DISCHRG", 60))
+		require.Len(t, o.triggers, 1)
+	})
+}
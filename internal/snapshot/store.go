@@ -0,0 +1,110 @@
+package snapshot
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	nut_client "github.com/andreyAKor/nut_client"
+)
+
+// Snapshot is the UPS list read from the NUT upstream at the moment of Time.
+//
+// Snapshot is shared between readers, so the list must not be modified.
+type Snapshot struct {
+	Upstream string
+	Time     time.Time
+	List     []*nut_client.UPS
+}
+
+// Age Returns how long ago the snapshot was taken.
+func (s Snapshot) Age() time.Duration {
+	return time.Since(s.Time)
+}
+
+// UPS Returns the UPS of the snapshot by the name.
+func (s Snapshot) UPS(name string) (*nut_client.UPS, bool) {
+	for _, ups := range s.List {
+		if ups.Name == name {
+			return ups, true
+		}
+	}
+
+	return nil, false
+}
+
+// subscriptionBuffer is the number of snapshots queued for a slow subscriber, newer snapshots are dropped
+// for the subscriber when its queue is full.
+const subscriptionBuffer = 16
+
+// Store keeps the latest snapshots of upstreams refreshed by the metrics poller.
+type Store struct {
+	mu          sync.RWMutex
+	snapshots   map[string]Snapshot
+	subscribers map[chan Snapshot]struct{}
+}
+
+func New() *Store {
+	return &Store{
+		snapshots:   make(map[string]Snapshot),
+		subscribers: make(map[chan Snapshot]struct{}),
+	}
+}
+
+// Set Replaces the latest snapshot of the upstream and sends it to subscribers.
+func (s *Store) Set(snapshot Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshots[snapshot.Upstream] = snapshot
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- snapshot:
+		default:
+		}
+	}
+}
+
+// Subscribe Returns the channel receiving every snapshot set after subscribing and the function cancelling
+// the subscription, a slow subscriber may miss snapshots, so it must not rely on receiving each of them.
+func (s *Store) Subscribe() (<-chan Snapshot, func()) {
+	ch := make(chan Snapshot, subscriptionBuffer)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
+
+// Get Returns the latest snapshot of the upstream, false if nothing has been polled yet.
+func (s *Store) Get(upstream string) (Snapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot, ok := s.snapshots[upstream]
+
+	return snapshot, ok
+}
+
+// List Returns the latest snapshots of all upstreams sorted by the upstream name.
+func (s *Store) List() []Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Snapshot, 0, len(s.snapshots))
+	for _, snapshot := range s.snapshots {
+		res = append(res, snapshot)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Upstream < res[j].Upstream
+	})
+
+	return res
+}